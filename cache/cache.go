@@ -1,46 +1,38 @@
 package cache
 
 import (
-	"sync"
 	"time"
 
 	"github.com/suconghou/videoproxy/db"
+	"github.com/suconghou/videoproxy/store"
 	"github.com/suconghou/videoproxy/util"
 )
 
-// string : cacheItem
-var caches = sync.Map{}
+// 白名单查询结果的缓存时间
+const whiteListTTL = time.Hour
 
-type cacheItem struct {
-	t int64
-	v bool
-}
-
-func init() {
-	go func() {
-		for {
-			var now = time.Now().Unix()
-			caches.Range(func(k interface{}, v interface{}) bool {
-				t, ok := v.(*cacheItem)
-				if !ok || t.t < now {
-					caches.Delete(k)
-				}
-				return true
-			})
-			time.Sleep(time.Minute)
-		}
-	}()
-}
+const keyPrefix = "whitelist:"
 
 func InWhiteList(vid string) bool {
-	v, ok := caches.Load(vid)
+	v, ok, err := store.Default.Get(keyPrefix + vid)
+	if err != nil {
+		util.Log.Print(err)
+	}
 	if ok {
-		return v.(*cacheItem).v
+		return len(v) == 1 && v[0] == '1'
 	}
-	retId, exist, err := db.FindId(vid, db.TABLE_WHITELIST)
+	_, exist, err := db.FindId(vid, db.TABLE_WHITELIST)
 	if err != nil {
+		// 查询出错时不缓存,下次重新查询
+		util.Log.Print(err)
+		return false
+	}
+	var value = []byte{'0'}
+	if exist {
+		value[0] = '1'
+	}
+	if err = store.Default.Set(keyPrefix+vid, value, whiteListTTL); err != nil {
 		util.Log.Print(err)
 	}
-	caches.Store(retId, &cacheItem{time.Now().Unix() + 3600, exist})
 	return exist
 }
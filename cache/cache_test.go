@@ -0,0 +1,28 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/suconghou/videoproxy/store"
+)
+
+func TestInWhiteListKey(t *testing.T) {
+	defer func(s store.Store) { store.Default = s }(store.Default)
+	var s = store.NewMemory()
+	store.Default = s
+	// 未配置数据库与上游白名单时全部放行
+	if !InWhiteList("abcdefghijk") {
+		t.Fatal("not allowed")
+	}
+	v, ok, err := s.Get(keyPrefix + "abcdefghijk")
+	if !ok || err != nil || string(v) != "1" {
+		t.Fatal(v, ok, err)
+	}
+	if _, ok, _ := s.Get(keyPrefix); ok {
+		t.Fatal("empty key stored")
+	}
+	s.Set(keyPrefix+"zzzzzzzzzzz", []byte("0"), whiteListTTL)
+	if InWhiteList("zzzzzzzzzzz") {
+		t.Fatal("cached false ignored")
+	}
+}
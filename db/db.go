@@ -168,3 +168,42 @@ func SaveCacheItem(id string, data string, table tableName) error {
 	_, err = stmt.Exec(id, data)
 	return err
 }
+
+// GetCacheVariant 同一个ID可以有多个变体,例如不同参数生成的mpd
+func GetCacheVariant(id string, variant string, table tableName) (string, bool, error) {
+	if db == nil {
+		return "", false, nil
+	}
+	var data string
+	err := db.QueryRow(fmt.Sprintf("SELECT data FROM %s WHERE `id` = ? AND `variant` = ? AND time > 0", table), id, variant).Scan(&data)
+	switch {
+	case err == sql.ErrNoRows:
+		return data, false, nil
+	case err != nil:
+		return data, false, err
+	default:
+		return data, true, nil
+	}
+}
+
+func SaveCacheVariant(id string, variant string, data string, table tableName) error {
+	if db == nil {
+		return nil
+	}
+	stmt, err := db.Prepare(fmt.Sprintf("REPLACE INTO %s (`id`, `variant`, `data`, `time`) VALUES (?, ?, ?, %d)", table, time.Now().Unix()))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(id, variant, data)
+	return err
+}
+
+// DeleteCacheItem 删除此ID的全部缓存,包括所有变体和语言
+func DeleteCacheItem(id string, table tableName) error {
+	if db == nil {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE `id` = ?", table), id)
+	return err
+}
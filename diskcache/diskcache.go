@@ -0,0 +1,293 @@
+package diskcache
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/suconghou/videoproxy/request"
+	"github.com/suconghou/videoproxy/util"
+)
+
+// 每个分片的大小,与nginx slice类似
+const sliceSize int64 = 1 << 20
+
+// Default 由环境变量SLICE_CACHE_DIR启用,未配置时为nil
+var Default = fromEnv()
+
+// Key 缓存以视频ID,itag,文件大小区分,地址刷新后仍可命中
+type Key struct {
+	ID   string
+	Itag string
+	Size int64
+}
+
+// Fetcher 从上游获取[start,end]区间的数据
+type Fetcher func(start int64, end int64) ([]byte, error)
+
+type entry struct {
+	path string
+	size int64
+}
+
+type fill struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// Cache 磁盘分片缓存,超出limit时按LRU淘汰分片
+type Cache struct {
+	dir   string
+	limit int64
+	mu    sync.Mutex
+	total int64
+	items map[string]*list.Element
+	lru   *list.List
+	fills map[string]*fill
+}
+
+func fromEnv() *Cache {
+	var dir = os.Getenv("SLICE_CACHE_DIR")
+	if dir == "" {
+		return nil
+	}
+	var limit int64 = 1024
+	if n, err := strconv.ParseInt(os.Getenv("SLICE_CACHE_SIZE"), 10, 64); err == nil && n > 0 {
+		limit = n
+	}
+	c, err := New(dir, limit<<20)
+	if err != nil {
+		util.Log.Print(err)
+		return nil
+	}
+	return c
+}
+
+// New 扫描已有的分片,按修改时间恢复LRU顺序
+func New(dir string, limit int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var (
+		c = &Cache{
+			dir:   dir,
+			limit: limit,
+			items: map[string]*list.Element{},
+			lru:   list.New(),
+			fills: map[string]*fill{},
+		}
+		files []os.FileInfo
+		paths = map[os.FileInfo]string{}
+	)
+	err := filepath.Walk(dir, func(path string, f os.FileInfo, err error) error {
+		if err != nil || f.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			return os.Remove(path)
+		}
+		files = append(files, f)
+		paths[f] = path
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	c.mu.Lock()
+	for _, f := range files {
+		c.add(paths[f], f.Size())
+	}
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Status 输出前判断区间内的分片是否都已缓存 HIT MISS PARTIAL
+func (c *Cache) Status(key Key, start int64, end int64) string {
+	var hit, miss int
+	for n := start / sliceSize; n <= end/sliceSize; n++ {
+		c.mu.Lock()
+		_, ok := c.items[c.path(key, n)]
+		c.mu.Unlock()
+		if ok {
+			hit++
+		} else {
+			miss++
+		}
+	}
+	if miss == 0 {
+		return "HIT"
+	}
+	if hit == 0 {
+		return "MISS"
+	}
+	return "PARTIAL"
+}
+
+// Serve 支持单个Range请求,缺失的分片从上游获取并写入缓存
+func (c *Cache) Serve(w http.ResponseWriter, r *http.Request, key Key, mime string, fetch Fetcher) error {
+	var (
+		start, end = int64(0), key.Size - 1
+		status     = http.StatusOK
+		to         = w.Header()
+		ok         bool
+	)
+	if rg := r.Header.Get("Range"); rg != "" {
+		if start, end, ok = request.ParseRange(rg, key.Size); !ok {
+			to.Set("Content-Range", fmt.Sprintf("bytes */%d", key.Size))
+			http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+		status = http.StatusPartialContent
+		to.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, key.Size))
+	}
+	to.Set("Accept-Ranges", "bytes")
+	return c.ServeRange(w, r, key, mime, start, end, status, fetch)
+}
+
+// ServeRange 输出[start,end]区间,响应状态码由调用方决定
+func (c *Cache) ServeRange(w http.ResponseWriter, r *http.Request, key Key, mime string, start int64, end int64, status int, fetch Fetcher) error {
+	if start < 0 || end >= key.Size || start > end {
+		http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+	var to = w.Header()
+	to.Set("X-Cache", c.Status(key, start, end))
+	to.Set("Content-Type", mime)
+	to.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	to.Set("Access-Control-Allow-Origin", "*")
+	to.Set("Access-Control-Max-Age", "864000")
+	to.Set("Cache-Control", "public, max-age=864000")
+	var first = start / sliceSize
+	// 第一片失败时还可以响应错误
+	data, err := c.slice(key, first, fetch)
+	if err != nil {
+		to.Del("Content-Length")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	w.WriteHeader(status)
+	for n := first; ; n++ {
+		var a, b = n * sliceSize, n*sliceSize + int64(len(data))
+		if start > a {
+			data = data[start-a:]
+		}
+		if end+1 < b {
+			data = data[:int64(len(data))-(b-end-1)]
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		if n >= end/sliceSize || r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+		if data, err = c.slice(key, n+1, fetch); err != nil {
+			return err
+		}
+	}
+}
+
+// slice 读取第n片,不存在时从上游获取,同一分片的并发请求合并为一次
+func (c *Cache) slice(key Key, n int64, fetch Fetcher) ([]byte, error) {
+	var (
+		path   = c.path(key, n)
+		start  = n * sliceSize
+		end    = start + sliceSize - 1
+		length int64
+	)
+	if end >= key.Size {
+		end = key.Size - 1
+	}
+	length = end - start + 1
+	c.mu.Lock()
+	if el, ok := c.items[path]; ok {
+		c.lru.MoveToFront(el)
+		c.mu.Unlock()
+		if data, err := os.ReadFile(path); err == nil && int64(len(data)) == length {
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			return data, nil
+		}
+		c.mu.Lock()
+		c.remove(path)
+	}
+	if f, ok := c.fills[path]; ok {
+		c.mu.Unlock()
+		f.wg.Wait()
+		return f.data, f.err
+	}
+	var f = &fill{}
+	f.wg.Add(1)
+	c.fills[path] = f
+	c.mu.Unlock()
+
+	f.data, f.err = fetch(start, end)
+	if f.err == nil && int64(len(f.data)) != length {
+		f.data, f.err = nil, fmt.Errorf("slice %d-%d got %d bytes", start, end, len(f.data))
+	}
+	var saved = f.err == nil && c.write(path, f.data) == nil
+
+	c.mu.Lock()
+	delete(c.fills, path)
+	if saved {
+		c.add(path, length)
+	}
+	c.mu.Unlock()
+	f.wg.Done()
+	return f.data, f.err
+}
+
+// write 先写临时文件再重命名,不会留下不完整的分片
+func (c *Cache) write(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		util.Log.Print(err)
+		return err
+	}
+	var tmp = path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		util.Log.Print(err)
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// add 需持有锁
+func (c *Cache) add(path string, size int64) {
+	if el, ok := c.items[path]; ok {
+		c.total -= el.Value.(*entry).size
+		c.lru.Remove(el)
+	}
+	c.items[path] = c.lru.PushFront(&entry{path, size})
+	c.total += size
+	for c.total > c.limit && c.lru.Len() > 1 {
+		c.remove(c.lru.Back().Value.(*entry).path)
+	}
+}
+
+// remove 需持有锁,同时删除空目录
+func (c *Cache) remove(path string) {
+	if el, ok := c.items[path]; ok {
+		c.total -= el.Value.(*entry).size
+		c.lru.Remove(el)
+		delete(c.items, path)
+	}
+	os.Remove(path)
+	for dir := filepath.Dir(path); dir != c.dir && strings.HasPrefix(dir, c.dir); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+func (c *Cache) path(key Key, n int64) string {
+	return filepath.Join(c.dir, key.ID, fmt.Sprintf("%s-%d", key.Itag, key.Size), strconv.FormatInt(n, 10))
+}
@@ -0,0 +1,124 @@
+package media
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	key    string
+	value  interface{}
+	expire int64
+}
+
+// cacheCall 正在进行的加载,同一key的并发请求合并为一次
+type cacheCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// cache 定时过期的缓存,条目数超过size时按LRU淘汰,加载出错时不缓存
+type cache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	lru   *list.List
+	calls map[string]*cacheCall
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:  size,
+		items: map[string]*list.Element{},
+		lru:   list.New(),
+		calls: map[string]*cacheCall{},
+	}
+}
+
+// get 未命中时调用load,load同时返回缓存时间(秒),ttl<=0时不缓存
+func (c *cache) get(key string, load func() (interface{}, int64, error)) (interface{}, error) {
+	c.mu.Lock()
+	if v, ok := c.lookup(key, time.Now().Unix()); ok {
+		c.mu.Unlock()
+		return v, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.value, call.err
+	}
+	var call = &cacheCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	var ttl int64
+	call.value, ttl, call.err = load()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if call.err == nil && ttl > 0 {
+		c.set(key, call.value, time.Now().Unix()+ttl)
+	}
+	c.mu.Unlock()
+	call.wg.Done()
+	return call.value, call.err
+}
+
+// peek 返回未过期的缓存,不发起加载
+func (c *cache) peek(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookup(key, time.Now().Unix())
+}
+
+// lookup 需持有锁
+func (c *cache) lookup(key string, now int64) (interface{}, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	var e = el.Value.(*cacheEntry)
+	if e.expire <= now {
+		c.lru.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.value, true
+}
+
+// set 需持有锁
+func (c *cache) set(key string, value interface{}, expire int64) {
+	if el, ok := c.items[key]; ok {
+		c.lru.Remove(el)
+	}
+	c.items[key] = c.lru.PushFront(&cacheEntry{key, value, expire})
+	for c.lru.Len() > c.size {
+		var el = c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.items, el.Value.(*cacheEntry).key)
+	}
+}
+
+// clean 删除已过期的条目
+func (c *cache) clean(now int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.lru.Back(); el != nil; {
+		var prev = el.Prev()
+		if e := el.Value.(*cacheEntry); e.expire <= now {
+			c.lru.Remove(el)
+			delete(c.items, e.key)
+		}
+		el = prev
+	}
+}
+
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,74 @@
+package media
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheCoalesce(t *testing.T) {
+	var (
+		c     = newCache(10)
+		calls int32
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			v, err := c.get("k", func() (interface{}, int64, error) {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(20 * time.Millisecond)
+				return 1, 60, nil
+			})
+			if err != nil || v.(int) != 1 {
+				t.Error(v, err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatal(calls)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	var (
+		c     = newCache(2)
+		calls int
+		load  = func(v int, ttl int64, err error) func() (interface{}, int64, error) {
+			return func() (interface{}, int64, error) {
+				calls++
+				return v, ttl, err
+			}
+		}
+	)
+	c.get("a", load(1, 60, nil))
+	c.get("b", load(2, 60, nil))
+	c.get("a", load(0, 60, nil))
+	c.get("c", load(3, 60, nil))
+	// b最久未使用,被淘汰
+	if _, ok := c.peek("b"); ok || c.len() != 2 || calls != 3 {
+		t.Fatal(c.len(), calls)
+	}
+	// 出错与ttl<=0的结果不缓存
+	if _, err := c.get("e", load(0, 60, fmt.Errorf("x"))); err == nil {
+		t.Fatal("expected error")
+	}
+	c.get("z", load(0, 0, nil))
+	if _, ok := c.peek("e"); ok {
+		t.Fatal("error cached")
+	}
+	if _, ok := c.peek("z"); ok {
+		t.Fatal("ttl 0 cached")
+	}
+	c.clean(time.Now().Unix() + 61)
+	if c.len() != 0 {
+		t.Fatal(c.len())
+	}
+}
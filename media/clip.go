@@ -0,0 +1,236 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// matroska element id used for clipping
+const idTimecode = 0xE7
+
+// Clip 截取包含[start,end]秒的分段,与初始化段组成可独立播放的文件,时间戳从0开始,end<=0表示直到结尾
+func Clip(index *Index, url string, start float64, end float64) (*File, error) {
+	if len(index.Segments) == 0 {
+		return nil, fmt.Errorf("no segments")
+	}
+	var first, last = index.clipRange(start, end)
+	if index.WebM {
+		return clipWebm(index, url, first, last)
+	}
+	return clipMp4(index, url, first, last)
+}
+
+// clipRange 返回覆盖区间的第一个与最后一个分段序号
+func (i *Index) clipRange(start float64, end float64) (int, int) {
+	var (
+		first = i.Find(start)
+		last  = len(i.Segments) - 1
+	)
+	if end > 0 {
+		for last > first && i.Seconds(i.Segments[last].Time) >= end {
+			last--
+		}
+	}
+	return first, last
+}
+
+// clipMp4 ftyp + moov(去掉mehd) + 重新生成的sidx + 分段,tfdt减去第一个分段的时间
+func clipMp4(index *Index, url string, first int, last int) (*File, error) {
+	var (
+		ftyp = findBox(index.Init, "ftyp")
+		moov = findBox(index.Init, "moov")
+		mdhd = findBox(moov, "trak", "mdia", "mdhd")
+		tkhd = findBox(moov, "trak", "tkhd")
+	)
+	if ftyp == nil || len(mdhd) < 24 || len(tkhd) < 24 {
+		return nil, fmt.Errorf("moov not found")
+	}
+	var (
+		timescale = binary.BigEndian.Uint32(mdhd[12:])
+		trackID   = binary.BigEndian.Uint32(tkhd[12:])
+	)
+	if mdhd[0] == 1 {
+		timescale = binary.BigEndian.Uint32(mdhd[20:])
+	}
+	if tkhd[0] == 1 {
+		trackID = binary.BigEndian.Uint32(tkhd[20:])
+	}
+	// sidx与tfdt的timescale可能不同,按比例换算
+	var (
+		segments = index.Segments[first : last+1]
+		base     = segments[0].Time * uint64(timescale) / index.Timescale
+		head     = make([]byte, 32)
+		refs     = []byte{}
+		file     = &File{Sources: []string{url}, Mime: "video/mp4"}
+	)
+	if isAudio(moov) {
+		file.Mime = "audio/mp4"
+	}
+	head[0] = 1
+	binary.BigEndian.PutUint32(head[4:], trackID)
+	binary.BigEndian.PutUint32(head[8:], uint32(index.Timescale))
+	binary.BigEndian.PutUint16(head[30:], uint16(len(segments)))
+	for _, seg := range segments {
+		var ref = make([]byte, 12)
+		binary.BigEndian.PutUint32(ref, uint32(seg.End-seg.Start+1)&0x7fffffff)
+		binary.BigEndian.PutUint32(ref[4:], uint32(seg.Duration))
+		binary.BigEndian.PutUint32(ref[8:], 0x90000000)
+		refs = append(refs, ref...)
+		file.Parts = append(file.Parts, Part{Start: seg.Start, End: seg.End, Rewrite: func(b []byte) error {
+			return rebaseFragments(b, base)
+		}})
+	}
+	var moovBody = rebuildBox(moov, func(name string, body []byte) []byte {
+		if name != "mvex" {
+			return makeBox(name, body)
+		}
+		return makeBox(name, rebuildBox(body, func(name string, body []byte) []byte {
+			if name == "mehd" {
+				return nil
+			}
+			return makeBox(name, body)
+		}))
+	})
+	var init = append(append(makeBox("ftyp", ftyp), makeBox("moov", moovBody)...), makeBox("sidx", head, refs)...)
+	file.Parts = append([]Part{{Data: init}}, file.Parts...)
+	return file, nil
+}
+
+// clipWebm EBML头 + 未知长度的Segment(Info,Tracks,Cues) + Cluster,Cluster的Timecode减去第一个分段的时间
+func clipWebm(index *Index, url string, first int, last int) (*File, error) {
+	head, info, entry, err := webmParts(index.Init)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		segments = index.Segments[first : last+1]
+		base     = segments[0].Time
+		duration uint64
+	)
+	for _, seg := range segments {
+		duration += seg.Duration
+	}
+	info, entry = cloneBox(info), cloneBox(entry)
+	setInfoDuration(info, float64(duration))
+	setTrackEntry(entry, 1)
+	var (
+		tracks   = makeElement(idTracks, makeElement(idTrackEntry, entry))
+		cuesSize = len(makeElement(idCues, make([]byte, len(makeCuePoint(0, 0))*len(segments))))
+		offset   = int64(len(info) + len(tracks) + cuesSize)
+		cues     = []byte{}
+		file     = &File{Sources: []string{url}, Mime: "video/webm"}
+		segStart = append(makeID(idSegment), uint64Bytes(unknownSizeVint)...)
+	)
+	if t, _ := ParseTrack(true, index.Init); t.SampleRate > 0 {
+		file.Mime = "audio/webm"
+	}
+	for _, seg := range segments {
+		cues = append(cues, makeCuePoint(seg.Time-base, uint64(offset))...)
+		file.Parts = append(file.Parts, Part{Start: seg.Start, End: seg.End, Rewrite: func(b []byte) error {
+			if err := rewriteClusters(b, 1); err != nil {
+				return err
+			}
+			return rebaseClusters(b, base)
+		}})
+		offset += seg.End - seg.Start + 1
+	}
+	var init = append(append(append(append(append([]byte{}, head...), segStart...), info...), tracks...), makeElement(idCues, cues)...)
+	file.Parts = append([]Part{{Data: init}}, file.Parts...)
+	return file, nil
+}
+
+// rebuildBox 遍历同级box,fn返回新的box拼接,返回nil时删除该box
+func rebuildBox(b []byte, fn func(name string, body []byte) []byte) []byte {
+	var res = []byte{}
+	eachBox(b, func(name string, body []byte) bool {
+		res = append(res, fn(name, body)...)
+		return true
+	})
+	return res
+}
+
+func isAudio(moov []byte) bool {
+	var hdlr = findBox(moov, "trak", "mdia", "hdlr")
+	return len(hdlr) >= 12 && string(hdlr[8:12]) == "soun"
+}
+
+// rebaseFragments 每个traf中tfdt的baseMediaDecodeTime减去base,长度不变
+func rebaseFragments(b []byte, base uint64) error {
+	var err error
+	eachBox(b, func(name string, moof []byte) bool {
+		if name != "moof" {
+			return true
+		}
+		eachBox(moof, func(name string, traf []byte) bool {
+			if name != "traf" {
+				return true
+			}
+			var tfdt = findBox(traf, "tfdt")
+			switch {
+			case len(tfdt) >= 12 && tfdt[0] == 1:
+				binary.BigEndian.PutUint64(tfdt[4:], sub(binary.BigEndian.Uint64(tfdt[4:]), base))
+			case len(tfdt) >= 8:
+				binary.BigEndian.PutUint32(tfdt[4:], uint32(sub(uint64(binary.BigEndian.Uint32(tfdt[4:])), base)))
+			default:
+				err = fmt.Errorf("tfdt not found")
+			}
+			return err == nil
+		})
+		return err == nil
+	})
+	return err
+}
+
+// rebaseClusters Cluster的Timecode减去base,长度不变
+func rebaseClusters(b []byte, base uint64) error {
+	return eachElement(b, func(e element, _ int, data []byte) bool {
+		if e.ID == idCluster {
+			eachElement(data, func(e element, _ int, data []byte) bool {
+				if e.ID == idTimecode {
+					putUint(data, sub(readUint(data), base))
+					return false
+				}
+				return true
+			})
+		}
+		return true
+	})
+}
+
+// setInfoDuration 原地修改Info中的Duration
+func setInfoDuration(info []byte, duration float64) {
+	eachElement(info, func(e element, _ int, data []byte) bool {
+		if e.ID != idInfo {
+			return true
+		}
+		eachElement(data, func(e element, _ int, data []byte) bool {
+			if e.ID == idDuration {
+				switch len(data) {
+				case 4:
+					binary.BigEndian.PutUint32(data, math.Float32bits(float32(duration)))
+				case 8:
+					binary.BigEndian.PutUint64(data, math.Float64bits(duration))
+				}
+				return false
+			}
+			return true
+		})
+		return false
+	})
+}
+
+// putUint 按原有长度写入无符号整数
+func putUint(b []byte, v uint64) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(v)
+		v >>= 8
+	}
+}
+
+func sub(a uint64, b uint64) uint64 {
+	if a < b {
+		return 0
+	}
+	return a - b
+}
@@ -0,0 +1,399 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// movieFixture 构造非分段mp4,mdat中依次为视频0-4 音频0-9 视频5-9 音频10-19,每个sample的内容为其序号
+func movieFixture() []byte {
+	var (
+		mvhd = make([]byte, 100)
+		ftyp = box("ftyp", []byte("isom"))
+		vs   = make([]uint32, 10)
+		as   = make([]uint32, 20)
+	)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	for i := range vs {
+		vs[i] = uint32(10 + i)
+	}
+	for i := range as {
+		as[i] = uint32(3 + i%4)
+	}
+	sum := func(s []uint32) (n uint32) {
+		for _, v := range s {
+			n += v
+		}
+		return n
+	}
+	build := func(base uint32) []byte {
+		v1 := base
+		a1 := v1 + sum(vs[:5])
+		v2 := a1 + sum(as[:10])
+		a2 := v2 + sum(vs[5:])
+		return box("moov", box("mvhd", mvhd), mkTrak("vide", 1000, 10, 100, []uint32{1, 6}, 5, []uint32{v1, v2}, vs), mkTrak("soun", 1000, 20, 50, nil, 10, []uint32{a1, a2}, as))
+	}
+	var (
+		moov = build(0)
+		data []byte
+		seq  byte
+	)
+	// moov的长度与偏移无关,先计算长度再写入实际偏移
+	moov = build(uint32(len(ftyp) + len(moov) + 8))
+	for _, sizes := range [][]uint32{vs[:5], as[:10], vs[5:], as[10:]} {
+		for _, s := range sizes {
+			data = append(data, bytes.Repeat([]byte{seq}, int(s))...)
+			seq++
+		}
+	}
+	return append(append(ftyp, moov...), box("mdat", data)...)
+}
+
+func movieTracks(t *testing.T, moov []byte) []*movieTrack {
+	var res []*movieTrack
+	eachBox(moov, func(name string, b []byte) bool {
+		if name == "trak" {
+			tr, err := parseMovieTrack(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, tr)
+		}
+		return true
+	})
+	return res
+}
+
+func TestClipMovie(t *testing.T) {
+	file := movieFixture()
+	srv := upstream(map[string][]byte{"m": file})
+	defer srv.Close()
+	m, err := LoadMovie("clip", srv.URL+"?f=m", int64(len(file)), *srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := movieTracks(t, m.Moov)
+	f, err := ClipMovie(m, srv.URL+"?f=m", 0.7, 0.9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	f.Serve(rec, httptest.NewRequest("GET", "/", nil), *srv.Client(), nil, nil)
+	out := rec.Body.Bytes()
+	got := movieTracks(t, findBox(out, "moov"))
+	// 0.7之前最近的关键帧为5(0.5秒),音频从0.5秒即第10个sample开始,到0.9秒之前结束
+	want := [][2]int{{5, 8}, {10, 17}}
+	if len(got) != len(want) {
+		t.Fatal(len(got))
+	}
+	for i, tr := range got {
+		o := orig[i]
+		if len(tr.samples) != want[i][1]-want[i][0]+1 {
+			t.Fatal(i, len(tr.samples))
+		}
+		for k, s := range tr.samples {
+			os := o.samples[want[i][0]+k]
+			if !bytes.Equal(out[s.offset:s.offset+int64(s.size)], file[os.offset:os.offset+int64(os.size)]) || s.dur != os.dur || s.sync != os.sync {
+				t.Fatal(i, k, s, os)
+			}
+		}
+		if tr.samples[0].dts != 0 {
+			t.Fatal(i, "dts", tr.samples[0].dts)
+		}
+	}
+	if d := binary.BigEndian.Uint32(findBox(out, "moov", "mvhd")[16:]); d != 400 {
+		t.Fatal("duration", d)
+	}
+	if _, err = ClipMovie(m, srv.URL+"?f=m", 0.7, 0.5); err == nil {
+		t.Fatal("expected error for empty range")
+	}
+}
+
+// trakBody 构造trak的内容,stbl为nil时不包含stbl
+func trakBody(kind string, stbl ...[]byte) []byte {
+	mdhd := make([]byte, 24)
+	binary.BigEndian.PutUint32(mdhd[12:], 1000)
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], kind)
+	minf := box("minf")
+	if stbl != nil {
+		minf = box("minf", box("stbl", stbl...))
+	}
+	return box("mdia", box("mdhd", mdhd), box("hdlr", hdlr), minf)
+}
+
+func TestParseMovieTrackMalformed(t *testing.T) {
+	var (
+		stts = box("stts", be(0, 1, 3, 100))
+		stsc = box("stsc", be(0, 1, 1, 3, 1))
+		stsz = box("stsz", be(0, 0, 3, 1, 2, 3))
+		stco = box("stco", be(0, 1, 1000))
+	)
+	tests := []struct {
+		name string
+		trak []byte
+		err  string
+	}{
+		{"no mdhd", box("mdia", box("hdlr", make([]byte, 24)), box("minf", box("stbl"))), "bad trak"},
+		{"no stbl", trakBody("vide"), "bad trak"},
+		{"no stsz", trakBody("vide", stts, stsc, stco), "sample table not found"},
+		{"no stts", trakBody("vide", stsc, stsz, stco), "sample table not found"},
+		{"stsz truncated", trakBody("vide", stts, stsc, box("stsz", be(0, 0, 3, 1, 2)), stco), "stsz truncated"},
+		{"too many samples", trakBody("vide", stts, stsc, box("stsz", be(0, 4, 1<<30)), stco), "too many samples"},
+		{"stco truncated", trakBody("vide", stts, stsc, stsz, box("stco", be(0, 2, 1000))), "stco truncated"},
+		{"co64 truncated", trakBody("vide", stts, stsc, stsz, box("co64", be(0, 1, 0))), "co64 truncated"},
+		{"no chunk offset", trakBody("vide", stts, stsc, stsz), "chunk offset not found"},
+		{"stsc truncated", trakBody("vide", stts, box("stsc", be(0, 2, 1, 3, 1)), stsz, stco), "stsc truncated"},
+		{"stsc short", trakBody("vide", stts, box("stsc", be(0, 1, 1, 2, 1)), stsz, stco), "stsc covers 2 of 3"},
+		{"stsc chunk zero", trakBody("vide", stts, box("stsc", be(0, 1, 0, 3, 1)), stsz, stco), "stsc covers 0 of 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseMovieTrack(tt.trak)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseMovieTrack(t *testing.T) {
+	// 固定大小的sample,co64,两个chunk,stsc中第二个条目从chunk 2开始,没有stss时全部为关键帧
+	trak := trakBody("soun", box("stts", be(0, 2, 2, 100, 1, 50)), box("stsc", be(0, 2, 1, 2, 1, 2, 1, 1)), box("stsz", be(0, 8, 3)), box("co64", be(0, 2, 0, 100, 1, 0)))
+	tr, err := parseMovieTrack(trak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sample{
+		{offset: 100, size: 8, dts: 0, dur: 100, sync: true},
+		{offset: 108, size: 8, dts: 100, dur: 100, sync: true},
+		{offset: 1 << 32, size: 8, dts: 200, dur: 50, sync: true},
+	}
+	if tr.video || tr.timescale != 1000 || tr.stss || tr.cttsVersion != -1 || len(tr.samples) != len(want) {
+		t.Fatal(tr)
+	}
+	for i, s := range tr.samples {
+		if s != want[i] {
+			t.Fatal(i, s, want[i])
+		}
+	}
+	// 截断在任意位置都不能panic
+	for n := 0; n < len(trak); n++ {
+		parseMovieTrack(trak[:n])
+	}
+}
+
+func TestStblRebuild(t *testing.T) {
+	var (
+		tkhd = make([]byte, 84)
+		edts = box("edts", box("elst", be(0, 1, 1000, 200, 0x10000)))
+		trak = append(append(box("tkhd", tkhd), edts...), trakBody("vide",
+			box("stsd", be(0, 0)),
+			box("stts", be(0, 1, 6, 100)),
+			box("ctts", be(0x01000000, 2, 3, 200, 3, 0)),
+			box("stss", be(0, 2, 1, 4)),
+			box("stsc", be(0, 1, 1, 3, 1)),
+			box("stsz", be(0, 0, 6, 1, 2, 3, 4, 5, 6)),
+			box("stco", be(0, 2, 1000, 2000)),
+		)...)
+	)
+	orig, err := parseMovieTrack(trak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig.first, orig.last = 3, 5
+	body := orig.rebuild(1000, []int64{0, 10, 20}, 500)
+	got, err := parseMovieTrack(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.samples) != 3 || got.cttsVersion != 1 || !got.stss {
+		t.Fatal(got)
+	}
+	for i, s := range got.samples {
+		o := orig.samples[3+i]
+		if s.offset != 500+int64(i*10) || s.size != o.size || s.dur != o.dur || s.cto != o.cto || s.sync != o.sync || s.dts != o.dts-300 {
+			t.Fatal(i, s, o)
+		}
+	}
+	if findBox(body, "mdia", "minf", "stbl", "stco") != nil || findBox(body, "mdia", "minf", "stbl", "co64") == nil {
+		t.Fatal("chunk offsets should be co64")
+	}
+	if d := binary.BigEndian.Uint32(findBox(body, "mdia", "mdhd")[16:]); d != 300 {
+		t.Fatal("mdhd duration", d)
+	}
+	if d := binary.BigEndian.Uint32(findBox(body, "tkhd")[20:]); d != 300 {
+		t.Fatal("tkhd duration", d)
+	}
+	if d := binary.BigEndian.Uint32(findBox(body, "edts", "elst")[8:]); d != 300 {
+		t.Fatal("elst duration", d)
+	}
+	// 多条目的编辑列表无法保持,直接去掉
+	trak = append(box("edts", box("elst", be(0, 2, 0, 0, 0, 0, 0, 0))), trakBody("vide", box("stsd"), box("stts", be(0, 1, 1, 1)), box("stsc", be(0, 1, 1, 1, 1)), box("stsz", be(0, 1, 1)), box("stco", be(0, 1, 0)))...)
+	if orig, err = parseMovieTrack(trak); err != nil {
+		t.Fatal(err)
+	}
+	if body = orig.rebuild(1000, []int64{0}, 0); findBox(body, "edts") != nil || findBox(body, "mdia", "minf", "stbl", "stss") != nil || findBox(body, "mdia", "minf", "stbl", "ctts") != nil {
+		t.Fatal("unexpected edts/stss/ctts")
+	}
+}
+
+func TestClipRange(t *testing.T) {
+	idx := &Index{Timescale: 1000}
+	for i := 0; i < 5; i++ {
+		idx.Segments = append(idx.Segments, Segment{Time: uint64(i * 2000), Duration: 2000})
+	}
+	tests := []struct {
+		start, end  float64
+		first, last int
+	}{
+		{0, 0, 0, 4},
+		{3, 6, 1, 2},
+		{4, 4.5, 2, 2},
+		{9, 0, 4, 4},
+		{20, 30, 4, 4},
+		{5, 1, 2, 2},
+	}
+	for _, tt := range tests {
+		if first, last := idx.clipRange(tt.start, tt.end); first != tt.first || last != tt.last {
+			t.Errorf("clipRange(%v, %v) = %d, %d, want %d, %d", tt.start, tt.end, first, last, tt.first, tt.last)
+		}
+	}
+}
+
+func TestClipMp4(t *testing.T) {
+	var (
+		mdhd = make([]byte, 24)
+		tkhd = make([]byte, 84)
+	)
+	binary.BigEndian.PutUint32(mdhd[12:], 1000)
+	binary.BigEndian.PutUint32(tkhd[12:], 1)
+	init := append(box("ftyp", []byte("iso5")), box("moov", box("mvhd", make([]byte, 100)), box("trak", box("tkhd", tkhd), box("mdia", box("mdhd", mdhd))), box("mvex", box("mehd", make([]byte, 8)), box("trex", make([]byte, 24))))...)
+	vfile := append([]byte{}, init...)
+	idx := &Index{Timescale: 1000, Init: init}
+	for i := 0; i < 5; i++ {
+		tfdt := make([]byte, 12)
+		tfdt[0] = 1
+		binary.BigEndian.PutUint64(tfdt[4:], uint64(i*2000))
+		f := append(box("moof", box("mfhd", make([]byte, 8)), box("traf", box("tfhd", be(0, 1)), box("tfdt", tfdt))), box("mdat", []byte("xyz"))...)
+		idx.Segments = append(idx.Segments, Segment{Time: uint64(i * 2000), Duration: 2000, Start: int64(len(vfile)), End: int64(len(vfile) + len(f) - 1)})
+		vfile = append(vfile, f...)
+	}
+	srv := upstream(map[string][]byte{"v": vfile})
+	defer srv.Close()
+	f, err := Clip(idx, srv.URL+"?f=v", 3, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	f.Serve(rec, httptest.NewRequest("GET", "/", nil), *srv.Client(), nil, nil)
+	out := rec.Body.Bytes()
+	if findBox(out, "moov", "mvex", "mehd") != nil || findBox(out, "moov", "mvex", "trex") == nil {
+		t.Fatal("mvex")
+	}
+	ts, segs, err := parseSidxBox(findBox(out, "sidx"), 0)
+	if err != nil || ts != 1000 || len(segs) != 2 {
+		t.Fatal(ts, segs, err)
+	}
+	var tf []uint64
+	eachBox(out, func(name string, b []byte) bool {
+		if name == "moof" {
+			tf = append(tf, binary.BigEndian.Uint64(findBox(b, "traf", "tfdt")[4:]))
+		}
+		return true
+	})
+	if len(tf) != 2 || tf[0] != 0 || tf[1] != 2000 {
+		t.Fatal(tf)
+	}
+	// 初始化段不完整时返回错误
+	for _, bad := range [][]byte{nil, init[:len(init)-1], box("ftyp", []byte("iso5"))} {
+		if _, err = Clip(&Index{Timescale: 1000, Init: bad, Segments: idx.Segments}, "", 0, 0); err == nil {
+			t.Fatal("expected error for bad init", len(bad))
+		}
+	}
+	if _, err = Clip(&Index{Timescale: 1000, Init: init}, "", 0, 0); err == nil {
+		t.Fatal("expected error for empty index")
+	}
+}
+
+func TestRebaseFragments(t *testing.T) {
+	v0 := box("moof", box("traf", box("tfdt", be(0, 5000))))
+	if err := rebaseFragments(v0, 2000); err != nil || binary.BigEndian.Uint32(findBox(v0, "moof", "traf", "tfdt")[4:]) != 3000 {
+		t.Fatal(err)
+	}
+	// 小于base时为0
+	v0 = box("moof", box("traf", box("tfdt", be(0, 1000))))
+	if err := rebaseFragments(v0, 2000); err != nil || binary.BigEndian.Uint32(findBox(v0, "moof", "traf", "tfdt")[4:]) != 0 {
+		t.Fatal(err)
+	}
+	if err := rebaseFragments(box("moof", box("traf", box("tfdt", be(0)))), 0); err == nil {
+		t.Fatal("expected error for truncated tfdt")
+	}
+}
+
+func TestClipWebm(t *testing.T) {
+	info := el(idInfo, el(idTimecodeScale, u(1000000)), el(idDuration, u(math.Float64bits(20000))))
+	tr := el(idTracks, el(idTrackEntry, el(idTrackNumber, []byte{1}), el(idTrackUID, u(77))))
+	seg := []byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	init := append(append(append(el(idEBML, el(0x4282, []byte("webm"))), seg...), info...), tr...)
+	file := append([]byte{}, init...)
+	idx := &Index{WebM: true, Timescale: 1000, Init: init}
+	for i := 0; i < 4; i++ {
+		c := el(idCluster, el(idTimecode, u(uint64(i*5000))), el(idSimpleBlock, []byte{0x81, 0, 0, 0x80, byte('0' + i)}))
+		idx.Segments = append(idx.Segments, Segment{Time: uint64(i * 5000), Duration: 5000, Start: int64(len(file)), End: int64(len(file) + len(c) - 1)})
+		file = append(file, c...)
+	}
+	srv := upstream(map[string][]byte{"v": file})
+	defer srv.Close()
+	f, err := Clip(idx, srv.URL+"?f=v", 6, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	f.Serve(rec, httptest.NewRequest("GET", "/", nil), *srv.Client(), nil, nil)
+	out := rec.Body.Bytes()
+	off, ts, dur, err := webmInfo(out)
+	if err != nil || ts != 1000 || dur != 10000 {
+		t.Fatal(off, ts, dur, err)
+	}
+	var (
+		tcs    []uint64
+		blocks []byte
+		cues   []Segment
+	)
+	eachElement(out[off:], func(e element, o int, d []byte) bool {
+		switch e.ID {
+		case idCluster:
+			eachElement(d, func(e element, _ int, d []byte) bool {
+				if e.ID == idTimecode {
+					tcs = append(tcs, readUint(d))
+				}
+				if e.ID == idSimpleBlock {
+					blocks = append(blocks, d[4])
+				}
+				return true
+			})
+		case idCues:
+			cues, _ = ParseCues(out[off+int64(o):], off, int64(len(out)), 10000)
+		}
+		return true
+	})
+	if len(tcs) != 2 || tcs[0] != 0 || tcs[1] != 5000 || string(blocks) != "12" || len(cues) != 2 {
+		t.Fatal(tcs, string(blocks), cues)
+	}
+	for _, c := range cues {
+		if e, _ := readElement(out[c.Start:]); e.ID != idCluster {
+			t.Fatal("cue pos", c)
+		}
+	}
+	// 缺少Info或Tracks时返回错误
+	for _, bad := range [][]byte{el(idEBML), init[:len(init)-len(tr)]} {
+		if _, err = Clip(&Index{WebM: true, Timescale: 1000, Init: bad, Segments: idx.Segments}, "", 0, 0); err == nil {
+			t.Fatal("expected error for bad init", len(bad))
+		}
+	}
+}
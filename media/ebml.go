@@ -0,0 +1,220 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// matroska element id
+const (
+	idEBML          = 0x1A45DFA3
+	idSegment       = 0x18538067
+	idInfo          = 0x1549A966
+	idTimecodeScale = 0x2AD7B1
+	idDuration      = 0x4489
+	idCues          = 0x1C53BB6B
+	idCuePoint      = 0xBB
+	idCueTime       = 0xB3
+	idCueTrackPos   = 0xB7
+	idCueClusterPos = 0xF1
+	idCluster       = 0x1F43B675
+)
+
+// ebml element头部,Size为-1表示长度未知
+type element struct {
+	ID     uint64
+	Size   int64
+	Header int
+}
+
+// readVint 读取变长整数,keep为true时保留长度标记位(用于element id)
+func readVint(b []byte, keep bool) (uint64, int, error) {
+	if len(b) == 0 || b[0] == 0 {
+		return 0, 0, fmt.Errorf("bad vint")
+	}
+	var (
+		n    = 1
+		mask = byte(0x80)
+	)
+	for b[0]&mask == 0 {
+		n++
+		mask >>= 1
+	}
+	if len(b) < n {
+		return 0, 0, fmt.Errorf("vint truncated")
+	}
+	var v = uint64(b[0])
+	if !keep {
+		v = uint64(b[0] & (mask - 1))
+	}
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, nil
+}
+
+func readElement(b []byte) (element, error) {
+	id, n, err := readVint(b, true)
+	if err != nil {
+		return element{}, err
+	}
+	size, m, err := readVint(b[n:], false)
+	if err != nil {
+		return element{}, err
+	}
+	var e = element{ID: id, Size: int64(size), Header: n + m}
+	if size == 1<<(7*uint(m))-1 {
+		e.Size = -1
+	}
+	return e, nil
+}
+
+func readUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func readFloat(b []byte) float64 {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// eachElement 遍历b中的同级element,回调返回false时停止;长度未知或超出b的element,data截取到b的末尾
+func eachElement(b []byte, fn func(e element, offset int, data []byte) bool) error {
+	for pos := 0; pos < len(b); {
+		e, err := readElement(b[pos:])
+		if err != nil {
+			return err
+		}
+		var (
+			start = pos + e.Header
+			end   = len(b)
+		)
+		if e.Size >= 0 && start+int(e.Size) < end {
+			end = start + int(e.Size)
+		}
+		if !fn(e, pos, b[start:end]) {
+			return nil
+		}
+		if e.Size < 0 {
+			return nil
+		}
+		pos = start + int(e.Size)
+	}
+	return nil
+}
+
+// webmInfo 解析初始化段,返回Segment数据的起始偏移(相对b),每秒的tick数与总时长(tick)
+func webmInfo(b []byte) (int64, uint64, uint64, error) {
+	var (
+		segOffset int64  = -1
+		scale     uint64 = 1000000
+		duration  float64
+	)
+	err := eachElement(b, func(e element, offset int, data []byte) bool {
+		if e.ID != idSegment {
+			return true
+		}
+		segOffset = int64(offset + e.Header)
+		eachElement(data, func(e element, _ int, data []byte) bool {
+			if e.ID == idInfo {
+				eachElement(data, func(e element, _ int, data []byte) bool {
+					switch e.ID {
+					case idTimecodeScale:
+						scale = readUint(data)
+					case idDuration:
+						duration = readFloat(data)
+					}
+					return true
+				})
+				return false
+			}
+			return e.ID != idCluster
+		})
+		return false
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if segOffset < 0 {
+		return 0, 0, 0, fmt.Errorf("webm segment not found")
+	}
+	if scale == 0 {
+		return 0, 0, 0, fmt.Errorf("bad timecode scale")
+	}
+	return segOffset, 1000000000 / scale, uint64(duration), nil
+}
+
+// ParseCues 解析Matroska Cues element,segOffset为Segment数据在文件中的起始位置,size为文件总长度,duration为总时长(tick)
+func ParseCues(b []byte, segOffset int64, size int64, duration uint64) ([]Segment, error) {
+	var (
+		segments = []Segment{}
+		found    = false
+	)
+	err := eachElement(b, func(e element, _ int, data []byte) bool {
+		if e.ID != idCues {
+			return true
+		}
+		found = true
+		eachElement(data, func(e element, _ int, data []byte) bool {
+			if e.ID != idCuePoint {
+				return true
+			}
+			var (
+				t   uint64
+				pos int64 = -1
+			)
+			eachElement(data, func(e element, _ int, data []byte) bool {
+				switch e.ID {
+				case idCueTime:
+					t = readUint(data)
+				case idCueTrackPos:
+					eachElement(data, func(e element, _ int, data []byte) bool {
+						if e.ID == idCueClusterPos && pos < 0 {
+							pos = int64(readUint(data))
+						}
+						return true
+					})
+				}
+				return true
+			})
+			if pos < 0 {
+				return true
+			}
+			var start = segOffset + pos
+			if n := len(segments); n > 0 && segments[n-1].Start == start {
+				return true
+			}
+			segments = append(segments, Segment{Time: t, Start: start})
+			return true
+		})
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("cues not found")
+	}
+	for i := range segments {
+		if i+1 < len(segments) {
+			segments[i].End = segments[i+1].Start - 1
+			segments[i].Duration = segments[i+1].Time - segments[i].Time
+			continue
+		}
+		segments[i].End = size - 1
+		if duration > segments[i].Time {
+			segments[i].Duration = duration - segments[i].Time
+		}
+	}
+	return segments, nil
+}
@@ -0,0 +1,247 @@
+package media
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/suconghou/videoproxy/request"
+)
+
+// 同时预取的分段数
+const prefetch = 4
+
+// Part 虚拟文件的一部分,Data不为nil时为内存数据,否则为上游Sources[Src]的[Start,End]区间
+// Rewrite 对取回的数据原地修改,不能改变长度
+type Part struct {
+	Data    []byte
+	Src     int
+	Start   int64
+	End     int64
+	Rewrite func([]byte) error
+}
+
+// Size 此部分的长度
+func (p *Part) Size() int64 {
+	if p.Data != nil {
+		return int64(len(p.Data))
+	}
+	return p.End - p.Start + 1
+}
+
+// File 由内存数据与上游区间拼接成的虚拟文件,总长度预先可知,因此可以响应range请求
+// ETag不为空时输出,If-Range与之不一致或ETag为空时忽略range,返回完整文件
+type File struct {
+	Sources []string
+	Parts   []Part
+	Mime    string
+	ETag    string
+}
+
+// SetETag 根据各部分的内存数据与上游区间计算ETag,布局不同的文件ETag不同
+func (f *File) SetETag() {
+	var (
+		h   = sha1.New()
+		buf = make([]byte, 24)
+	)
+	for i := range f.Parts {
+		var p = &f.Parts[i]
+		if p.Data != nil {
+			h.Write(p.Data)
+			continue
+		}
+		binary.BigEndian.PutUint64(buf, uint64(p.Src))
+		binary.BigEndian.PutUint64(buf[8:], uint64(p.Start))
+		binary.BigEndian.PutUint64(buf[16:], uint64(p.End))
+		h.Write(buf)
+	}
+	f.ETag = fmt.Sprintf(`"%x"`, h.Sum(nil))
+}
+
+// Size 文件总长度
+func (f *File) Size() int64 {
+	var n int64
+	for i := range f.Parts {
+		n += f.Parts[i].Size()
+	}
+	return n
+}
+
+// sources 一次响应中使用的上游地址,地址过期时每个Source只刷新一次,并发的分段共用新地址
+type sources struct {
+	mu      sync.Mutex
+	urls    []string
+	refresh []func() (string, error)
+	done    []bool
+}
+
+func newSources(urls []string, refresh []func() (string, error)) *sources {
+	return &sources{urls: append([]string{}, urls...), refresh: refresh, done: make([]bool, len(urls))}
+}
+
+func (s *sources) get(i int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.urls[i]
+}
+
+// renew old对应的地址已过期,若已被其他分段刷新过则直接返回新地址
+func (s *sources) renew(i int, old string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.urls[i] != old {
+		return s.urls[i], nil
+	}
+	if i >= len(s.refresh) || s.refresh[i] == nil || s.done[i] {
+		return "", fmt.Errorf("source %d expired", i)
+	}
+	s.done[i] = true
+	url, err := s.refresh[i]()
+	if err != nil {
+		return "", err
+	}
+	s.urls[i] = url
+	return url, nil
+}
+
+func (f *File) load(ctx context.Context, p *Part, src *sources, client http.Client) ([]byte, error) {
+	if p.Data != nil {
+		return p.Data, nil
+	}
+	var url = src.get(p.Src)
+	data, err := fetchRange(ctx, url, p.Start, p.End, client)
+	if _, ok := err.(expiredError); ok {
+		if url, err = src.renew(p.Src, url); err == nil {
+			data, err = fetchRange(ctx, url, p.Start, p.End, client)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != p.Size() {
+		return nil, fmt.Errorf("part size mismatch %d != %d", len(data), p.Size())
+	}
+	if p.Rewrite != nil {
+		if err = p.Rewrite(data); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// Serve 响应虚拟文件,支持单个range请求,rewriteHeader可追加响应头
+// refresh与Sources一一对应,上游响应403或410时调用一次取得新地址后重试
+func (f *File) Serve(w http.ResponseWriter, r *http.Request, client http.Client, rewriteHeader func(http.Header), refresh []func() (string, error)) error {
+	var (
+		size       = f.Size()
+		start, end = int64(0), size - 1
+		status     = http.StatusOK
+		h          = w.Header()
+	)
+	if f.ETag != "" {
+		h.Set("ETag", f.ETag)
+	}
+	if rg := r.Header.Get("Range"); rg != "" && f.ifRange(r.Header.Get("If-Range")) {
+		var ok bool
+		if start, end, ok = request.ParseRange(rg, size); !ok {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+		status = http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	h.Set("Content-Type", f.Mime)
+	h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Max-Age", "864000")
+	h.Set("Cache-Control", "public, max-age=864000")
+	if rewriteHeader != nil {
+		rewriteHeader(h)
+	}
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	return f.write(r.Context(), w, start, end, newSources(f.Sources, refresh), client)
+}
+
+// ifRange If-Range为空或与ETag一致时才响应range请求
+func (f *File) ifRange(v string) bool {
+	return v == "" || (f.ETag != "" && v == f.ETag)
+}
+
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// write 按顺序输出[start,end]区间,后续的分段并发预取
+func (f *File) write(ctx context.Context, w http.ResponseWriter, start int64, end int64, src *sources, client http.Client) error {
+	type span struct {
+		part     *Part
+		from, to int64
+	}
+	var (
+		spans  = []span{}
+		offset int64
+	)
+	for i := range f.Parts {
+		var (
+			p    = &f.Parts[i]
+			size = p.Size()
+		)
+		if offset+size > start && offset <= end {
+			var from, to = int64(0), size - 1
+			if start > offset {
+				from = start - offset
+			}
+			if end < offset+size-1 {
+				to = end - offset
+			}
+			spans = append(spans, span{p, from, to})
+		}
+		offset += size
+	}
+	var (
+		results = make([]chan partResult, len(spans))
+		sem     = make(chan struct{}, prefetch)
+	)
+	for i := range results {
+		results[i] = make(chan partResult, 1)
+	}
+	go func() {
+		for i := range spans {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(i int) {
+				data, err := f.load(ctx, spans[i].part, src, client)
+				results[i] <- partResult{data, err}
+			}(i)
+		}
+	}()
+	for i, s := range spans {
+		var res partResult
+		select {
+		case res = <-results[i]:
+			<-sem
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if res.err != nil {
+			return res.err
+		}
+		if _, err := w.Write(res.data[s.from : s.to+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package media
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServeRefresh(t *testing.T) {
+	var files = map[string][]byte{"a": []byte("0123456789"), "b": []byte("abcdefghij")}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("expired") == "1" {
+			http.Error(w, "expired", http.StatusForbidden)
+			return
+		}
+		upstreamHandler(files)(w, r)
+	}))
+	defer srv.Close()
+	var (
+		calls int32
+		f     = &File{
+			Sources: []string{srv.URL + "/?f=a&expired=1", srv.URL + "/?f=b"},
+			Parts:   []Part{{Src: 0, Start: 0, End: 3}, {Src: 1, Start: 0, End: 4}, {Src: 0, Start: 4, End: 6}, {Src: 0, Start: 7, End: 9}},
+			Mime:    "video/mp4",
+		}
+		refresh = []func() (string, error){func() (string, error) {
+			atomic.AddInt32(&calls, 1)
+			return srv.URL + "/?f=a", nil
+		}, nil}
+	)
+	rec := httptest.NewRecorder()
+	if err := f.Serve(rec, httptest.NewRequest("GET", "/", nil), *srv.Client(), nil, refresh); err != nil {
+		t.Fatal(err)
+	}
+	// 并发的分段共用一次刷新的结果,File本身的地址不变
+	if !bytes.Equal(rec.Body.Bytes(), []byte("0123abcde456789")) || calls != 1 || f.Sources[0] != srv.URL+"/?f=a&expired=1" {
+		t.Fatal(rec.Body.String(), calls, f.Sources)
+	}
+	// 没有refresh时直接返回错误
+	if err := f.Serve(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), *srv.Client(), nil, nil); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,270 @@
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// 读取每个分段开头的长度,一般足以包含整个moof
+const moofProbe = 8 * 1024
+
+// key : *movieTrack
+var flats = newCache(flatCacheSize)
+
+// Flatten 将分段的mp4转换为非分段的mp4,读取每个分段的moof得到sample表,mdat中的数据仍按原有的位置从上游获取,ctx取消时中断读取
+func Flatten(ctx context.Context, key string, index *Index, url string, client http.Client) (*File, error) {
+	if index.WebM {
+		return nil, fmt.Errorf("webm can not be flattened")
+	}
+	var (
+		ftyp = findBox(index.Init, "ftyp")
+		moov = findBox(index.Init, "moov")
+		mvhd = findBox(moov, "mvhd")
+	)
+	if ftyp == nil || len(mvhd) < 24 {
+		return nil, fmt.Errorf("moov not found")
+	}
+	var movieScale = binary.BigEndian.Uint32(mvhd[12:])
+	if mvhd[0] == 1 {
+		movieScale = binary.BigEndian.Uint32(mvhd[20:])
+	}
+	var load = func() (interface{}, int64, error) {
+		track, err := fragmentSamples(ctx, index, url, client)
+		return track, mediaTTL, err
+	}
+	v, err := flats.get(key, load)
+	// 合并的读取被发起的请求取消时,自己的请求仍有效则重新读取
+	for err != nil && ctx.Err() == nil && (err == context.Canceled || err == context.DeadlineExceeded) {
+		v, err = flats.get(key, load)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var track = v.(*movieTrack)
+	// 只有一个trak,track中的状态不会被修改,可以共用
+	return layoutMovie(ftyp, moov, []*movieTrack{track}, movieScale, url), nil
+}
+
+// fragmentRange 一次请求读取的区间,包含分段[first,last]
+type fragmentRange struct {
+	first int
+	last  int
+	start int64
+	end   int64
+}
+
+// fragmentRanges 每个分段只读取开头的moofProbe字节,上一个分段已被完整读取并且相邻时才合并到同一个请求,不会多读数据,单个请求不超过mergeLimit
+func fragmentRanges(segments []Segment) []fragmentRange {
+	var res = []fragmentRange{}
+	for i, seg := range segments {
+		var end = min64(seg.Start+moofProbe-1, seg.End)
+		if n := len(res); n > 0 && res[n-1].end == segments[i-1].End && segments[i-1].End+1 == seg.Start && end-res[n-1].start+1 <= mergeLimit {
+			res[n-1].last = i
+			res[n-1].end = end
+			continue
+		}
+		res = append(res, fragmentRange{first: i, last: i, start: seg.Start, end: end})
+	}
+	return res
+}
+
+// fragmentSamples 并发读取各分段的moof,按顺序拼接sample
+func fragmentSamples(ctx context.Context, index *Index, url string, client http.Client) (*movieTrack, error) {
+	var trak = findBox(index.Init, "moov", "trak")
+	if trak == nil {
+		return nil, fmt.Errorf("trak not found")
+	}
+	t, err := parseMovieTrack(trak)
+	if err != nil {
+		return nil, err
+	}
+	var trex = findBox(index.Init, "moov", "mvex", "trex")
+	if len(trex) < 24 {
+		return nil, fmt.Errorf("trex not found")
+	}
+	var (
+		defaults = fragmentDefaults{
+			duration: binary.BigEndian.Uint32(trex[12:]),
+			size:     binary.BigEndian.Uint32(trex[16:]),
+		}
+		results = make([][]sample, len(index.Segments))
+		errs    = make([]error, len(index.Segments))
+		sem     = make(chan struct{}, prefetch)
+		wg      sync.WaitGroup
+	)
+	for _, fr := range fragmentRanges(index.Segments) {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+		wg.Add(1)
+		go func(fr fragmentRange) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			data, err := fetchRange(ctx, url, fr.start, fr.end, client)
+			for i := fr.first; i <= fr.last; i++ {
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				var (
+					seg  = index.Segments[i]
+					from = min64(seg.Start-fr.start, int64(len(data)))
+					to   = min64(seg.End-fr.start+1, int64(len(data)))
+				)
+				results[i], errs[i] = segmentSamples(ctx, seg, data[from:to], url, defaults, client)
+			}
+		}(fr)
+	}
+	wg.Wait()
+	t.samples = nil
+	t.cttsVersion = -1
+	t.stss = false
+	var dts uint64
+	for i, res := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		for _, s := range res {
+			s.dts = dts
+			dts += uint64(s.dur)
+			t.samples = append(t.samples, s)
+		}
+	}
+	if len(t.samples) == 0 {
+		return nil, fmt.Errorf("no samples")
+	}
+	t.first, t.last = 0, len(t.samples)-1
+	return t, nil
+}
+
+type fragmentDefaults struct {
+	duration uint32
+	size     uint32
+}
+
+// segmentSamples 解析分段开头的moof得到每个sample在文件中的位置,data为分段开头的部分数据,moof不完整时再单独读取
+func segmentSamples(ctx context.Context, seg Segment, data []byte, url string, defaults fragmentDefaults, client http.Client) ([]sample, error) {
+	var (
+		pos int64
+		err error
+	)
+	for pos+8 <= int64(len(data)) {
+		size, header := boxSize(data[pos:])
+		if size < header {
+			return nil, fmt.Errorf("bad box size %d at %d", size, seg.Start+pos)
+		}
+		if string(data[pos+4:pos+8]) != "moof" {
+			pos += int64(size)
+			continue
+		}
+		if pos+int64(size) > int64(len(data)) {
+			if data, err = fetchRange(ctx, url, seg.Start+pos, seg.Start+pos+int64(size)-1, client); err != nil {
+				return nil, err
+			}
+			if len(data) != size {
+				return nil, fmt.Errorf("moof truncated")
+			}
+			return moofSamples(data[header:], seg.Start+pos, defaults)
+		}
+		return moofSamples(data[pos+int64(header):pos+int64(size)], seg.Start+pos, defaults)
+	}
+	return nil, fmt.Errorf("moof not found at %d", seg.Start)
+}
+
+// moofSamples 解析moof中第一个traf的tfhd与trun,moofStart为moof在文件中的位置
+func moofSamples(moof []byte, moofStart int64, defaults fragmentDefaults) ([]sample, error) {
+	var (
+		traf = findBox(moof, "traf")
+		tfhd = findBox(traf, "tfhd")
+	)
+	if len(tfhd) < 8 {
+		return nil, fmt.Errorf("tfhd not found")
+	}
+	var (
+		flags = binary.BigEndian.Uint32(tfhd) & 0xffffff
+		pos   = 8
+		base  = moofStart
+	)
+	if flags&0x1 != 0 && len(tfhd) >= pos+8 {
+		base = int64(binary.BigEndian.Uint64(tfhd[pos:]))
+		pos += 8
+	}
+	if flags&0x2 != 0 {
+		pos += 4
+	}
+	if flags&0x8 != 0 && len(tfhd) >= pos+4 {
+		defaults.duration = binary.BigEndian.Uint32(tfhd[pos:])
+		pos += 4
+	}
+	if flags&0x10 != 0 && len(tfhd) >= pos+4 {
+		defaults.size = binary.BigEndian.Uint32(tfhd[pos:])
+	}
+	var (
+		samples = []sample{}
+		offset  = base
+		err     error
+	)
+	eachBox(traf, func(name string, trun []byte) bool {
+		if name != "trun" {
+			return true
+		}
+		if len(trun) < 8 {
+			err = fmt.Errorf("bad trun")
+			return false
+		}
+		var (
+			flags = binary.BigEndian.Uint32(trun) & 0xffffff
+			count = int(binary.BigEndian.Uint32(trun[4:]))
+			pos   = 8
+			entry = 0
+		)
+		if flags&0x1 != 0 {
+			pos += 4
+		}
+		if flags&0x4 != 0 {
+			pos += 4
+		}
+		for _, f := range []uint32{0x100, 0x200, 0x400, 0x800} {
+			if flags&f != 0 {
+				entry += 4
+			}
+		}
+		if count > maxSamples || len(trun) < pos+count*entry {
+			err = fmt.Errorf("trun truncated")
+			return false
+		}
+		if flags&0x1 != 0 {
+			offset = base + int64(int32(binary.BigEndian.Uint32(trun[8:])))
+		}
+		for i := 0; i < count; i++ {
+			var s = sample{offset: offset, size: defaults.size, dur: defaults.duration, sync: true}
+			if flags&0x100 != 0 {
+				s.dur = binary.BigEndian.Uint32(trun[pos:])
+				pos += 4
+			}
+			if flags&0x200 != 0 {
+				s.size = binary.BigEndian.Uint32(trun[pos:])
+				pos += 4
+			}
+			if flags&0x400 != 0 {
+				pos += 4
+			}
+			if flags&0x800 != 0 {
+				s.cto = binary.BigEndian.Uint32(trun[pos:])
+				pos += 4
+			}
+			offset += int64(s.size)
+			samples = append(samples, s)
+		}
+		return true
+	})
+	return samples, err
+}
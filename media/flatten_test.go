@@ -0,0 +1,258 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fragmentedAudio 构造3个分段的音频,每个分段3个sample,大小为5,7,9,时长取trex中的1024
+func fragmentedAudio() ([]byte, *Index, []byte) {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	mdhd := make([]byte, 24)
+	binary.BigEndian.PutUint32(mdhd[12:], 48000)
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], "soun")
+	stbl := box("stbl", box("stsd", be(0, 0)), box("stts", be(0, 0)), box("stsc", be(0, 0)), box("stsz", be(0, 0, 0)), box("stco", be(0, 0)))
+	trex := be(0, 1, 1, 1024, 0, 0)
+	init := append(box("ftyp", []byte("dash")), box("moov", box("mvhd", mvhd), box("trak", box("tkhd", make([]byte, 84)), box("mdia", box("mdhd", mdhd), box("hdlr", hdlr), box("minf", stbl))), box("mvex", box("trex", trex)))...)
+	var (
+		file  = append([]byte{}, init...)
+		idx   = &Index{Timescale: 48000, Init: init}
+		want  []byte
+		n     byte
+		sizes = []uint32{5, 7, 9}
+	)
+	for i := 0; i < 3; i++ {
+		var payload []byte
+		for _, s := range sizes {
+			payload = append(payload, bytes.Repeat([]byte{n}, int(s))...)
+			n++
+		}
+		want = append(want, payload...)
+		// default-base-is-moof,trun的data offset相对moof开头
+		mk := func(off uint32) []byte {
+			trun := append(be(0x000201, 3, off), be(sizes...)...)
+			return box("moof", box("mfhd", make([]byte, 8)), box("traf", box("tfhd", be(0x020000, 1)), box("tfdt", be(0, 0)), box("trun", trun)))
+		}
+		moof := mk(0)
+		moof = mk(uint32(len(moof) + 8))
+		f := append(moof, box("mdat", payload)...)
+		idx.Segments = append(idx.Segments, Segment{Time: uint64(i * 3072), Duration: 3072, Start: int64(len(file)), End: int64(len(file) + len(f) - 1)})
+		file = append(file, f...)
+	}
+	return file, idx, want
+}
+
+// countingUpstream 同upstream,记录请求次数
+func countingUpstream(files map[string][]byte, calls *int32) *httptest.Server {
+	var handler = upstreamHandler(files)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func TestFlatten(t *testing.T) {
+	file, idx, want := fragmentedAudio()
+	var calls int32
+	srv := countingUpstream(map[string][]byte{"a": file}, &calls)
+	defer srv.Close()
+	f, err := Flatten(context.Background(), "flatten", idx, srv.URL+"?f=a", *srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3个相邻的小分段合并为一个请求
+	if calls != 1 {
+		t.Fatal("calls", calls)
+	}
+	rec := httptest.NewRecorder()
+	f.Serve(rec, httptest.NewRequest("GET", "/", nil), *srv.Client(), nil, nil)
+	out := rec.Body.Bytes()
+	if f.Mime != "audio/mp4" || findBox(out, "moov", "mvex") != nil {
+		t.Fatal("mime/mvex")
+	}
+	tr, err := parseMovieTrack(findBox(out, "moov", "trak"))
+	if err != nil || len(tr.samples) != 9 {
+		t.Fatal(err)
+	}
+	var got []byte
+	for i, s := range tr.samples {
+		if s.dts != uint64(i*1024) || !s.sync {
+			t.Fatal(i, s)
+		}
+		got = append(got, out[s.offset:s.offset+int64(s.size)]...)
+	}
+	if !bytes.Equal(got, want) || !bytes.Equal(findBox(out, "mdat"), want) {
+		t.Fatal("data")
+	}
+	if d := binary.BigEndian.Uint32(findBox(out, "moov", "trak", "mdia", "mdhd")[16:]); d != 9*1024 {
+		t.Fatal(d)
+	}
+	// 第二次使用缓存的sample表,不再请求上游
+	calls = 0
+	if _, err = Flatten(context.Background(), "flatten", idx, srv.URL+"?f=a", *srv.Client()); err != nil || calls != 0 {
+		t.Fatal(err, calls)
+	}
+}
+
+func TestFlattenCancel(t *testing.T) {
+	file, idx, _ := fragmentedAudio()
+	srv := upstream(map[string][]byte{"a": file})
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Flatten(ctx, "flatten-cancel", idx, srv.URL+"?f=a", *srv.Client()); err == nil {
+		t.Fatal("expected error for canceled context")
+	}
+	// 取消时的错误不缓存
+	if _, err := Flatten(context.Background(), "flatten-cancel", idx, srv.URL+"?f=a", *srv.Client()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlattenMalformed(t *testing.T) {
+	file, idx, _ := fragmentedAudio()
+	srv := upstream(map[string][]byte{"a": file})
+	defer srv.Close()
+	noTrex := append(box("ftyp", []byte("dash")), box("moov", rebuildBox(findBox(idx.Init, "moov"), func(name string, body []byte) []byte {
+		if name == "mvex" {
+			return nil
+		}
+		return box(name, body)
+	}))...)
+	tests := []struct {
+		name string
+		idx  *Index
+		err  string
+	}{
+		{"webm", &Index{WebM: true}, "webm"},
+		{"no moov", &Index{Init: box("ftyp", []byte("dash"))}, "moov not found"},
+		{"no trex", &Index{Init: noTrex, Segments: idx.Segments}, "trex not found"},
+		{"bad segment", &Index{Init: idx.Init, Segments: []Segment{{Start: 0, End: 99}}}, "moof not found"},
+		{"out of range", &Index{Init: idx.Init, Segments: []Segment{{Start: int64(len(file)), End: int64(len(file)) + 99}}}, "Range Not Satisfiable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Flatten(context.Background(), "flatten-"+tt.name, tt.idx, srv.URL+"?f=a", *srv.Client())
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestFragmentRanges(t *testing.T) {
+	seg := func(start, size int64) Segment {
+		return Segment{Start: start, End: start + size - 1}
+	}
+	var limitSegments []Segment
+	for i := int64(0); i < 130; i++ {
+		limitSegments = append(limitSegments, seg(i*moofProbe, moofProbe))
+	}
+	tests := []struct {
+		name     string
+		segments []Segment
+		want     []fragmentRange
+	}{
+		{"empty", nil, []fragmentRange{}},
+		{"small", []Segment{seg(100, 50), seg(150, 50), seg(200, 50)}, []fragmentRange{{0, 2, 100, 249}}},
+		{"gap", []Segment{seg(100, 50), seg(151, 50)}, []fragmentRange{{0, 0, 100, 149}, {1, 1, 151, 200}}},
+		{"probe", []Segment{seg(0, 100000)}, []fragmentRange{{0, 0, 0, moofProbe - 1}}},
+		// 较大的分段各自只读取开头,不读取中间的媒体数据
+		{"large", []Segment{seg(0, 300000), seg(300000, 300000), seg(600000, 300000)},
+			[]fragmentRange{{0, 0, 0, moofProbe - 1}, {1, 1, 300000, 300000 + moofProbe - 1}, {2, 2, 600000, 600000 + moofProbe - 1}}},
+		{"small then large", []Segment{seg(0, 50), seg(50, 50), seg(100, 300000), seg(300100, 50)},
+			[]fragmentRange{{0, 2, 0, 100 + moofProbe - 1}, {3, 3, 300100, 300149}}},
+		{"limit", limitSegments, []fragmentRange{{0, 127, 0, mergeLimit - 1}, {128, 129, mergeLimit, mergeLimit + 2*moofProbe - 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fragmentRanges(tt.segments)
+			if len(got) != len(tt.want) {
+				t.Fatal(got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatal(i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSegmentSamples(t *testing.T) {
+	file, idx, _ := fragmentedAudio()
+	srv := upstream(map[string][]byte{"a": file})
+	defer srv.Close()
+	var (
+		seg      = idx.Segments[1]
+		data     = file[seg.Start : seg.End+1]
+		defaults = fragmentDefaults{duration: 1024}
+		url      = srv.URL + "?f=a"
+	)
+	want, err := segmentSamples(context.Background(), seg, data, url, defaults, *srv.Client())
+	if err != nil || len(want) != 3 || want[0].offset != seg.Start+int64(len(findBox(data, "moof"))+16) {
+		t.Fatal(want, err)
+	}
+	// 只有moof的一部分时单独读取整个moof
+	for n := 8; n < len(data); n++ {
+		got, err := segmentSamples(context.Background(), seg, data[:n], url, defaults, *srv.Client())
+		if err != nil || len(got) != 3 || got[2] != want[2] {
+			t.Fatal(n, got, err)
+		}
+	}
+	for n := 0; n < 8; n++ {
+		if _, err = segmentSamples(context.Background(), seg, data[:n], url, defaults, *srv.Client()); err == nil {
+			t.Fatal(n, "expected error")
+		}
+	}
+	bad := append(be(4), "moof"...)
+	if _, err = segmentSamples(context.Background(), seg, bad, url, defaults, *srv.Client()); err == nil || !strings.Contains(err.Error(), "bad box size") {
+		t.Fatal(err)
+	}
+}
+
+func TestMoofSamples(t *testing.T) {
+	tests := []struct {
+		name string
+		moof []byte
+		want []sample
+		err  string
+	}{
+		{"trex defaults", box("traf", box("tfhd", be(0, 1)), box("trun", be(0, 2))), []sample{{offset: 1000, size: 4, dur: 10, sync: true}, {offset: 1004, size: 4, dur: 10, sync: true}}, ""},
+		{"tfhd defaults", box("traf", box("tfhd", be(0x18, 1, 20, 6)), box("trun", be(0, 1))), []sample{{offset: 1000, size: 6, dur: 20, sync: true}}, ""},
+		{"base data offset", box("traf", box("tfhd", be(0x1, 1, 0, 5000)), box("trun", be(0x1, 1, 8))), []sample{{offset: 5008, size: 4, dur: 10, sync: true}}, ""},
+		{"sample fields", box("traf", box("tfhd", be(0, 1)), box("trun", be(0xf05, 2, 100, 0, 30, 3, 0, 7, 40, 5, 0, 9))), []sample{{offset: 1100, size: 3, dur: 30, cto: 7, sync: true}, {offset: 1103, size: 5, dur: 40, cto: 9, sync: true}}, ""},
+		{"no tfhd", box("traf", box("trun", be(0, 0))), nil, "tfhd not found"},
+		{"bad trun", box("traf", box("tfhd", be(0, 1)), box("trun", be(0))), nil, "bad trun"},
+		{"trun truncated", box("traf", box("tfhd", be(0, 1)), box("trun", be(0x200, 2, 1))), nil, "trun truncated"},
+		{"data offset truncated", box("traf", box("tfhd", be(0, 1)), box("trun", be(0x1, 0))), nil, "trun truncated"},
+		{"too many samples", box("traf", box("tfhd", be(0, 1)), box("trun", be(0, 1<<30))), nil, "trun truncated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := moofSamples(tt.moof, 1000, fragmentDefaults{duration: 10, size: 4})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || len(got) != len(tt.want) {
+				t.Fatal(got, err)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatal(i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
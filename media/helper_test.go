@@ -0,0 +1,88 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+)
+
+// box 构造mp4 box,不依赖被测试的makeBox
+func box(name string, body ...[]byte) []byte {
+	var b []byte
+	for _, x := range body {
+		b = append(b, x...)
+	}
+	h := binary.BigEndian.AppendUint32(nil, uint32(len(b)+8))
+	return append(append(h, name...), b...)
+}
+
+// el 构造ebml元素,长度固定使用8字节的vint
+func el(id uint64, data ...[]byte) []byte {
+	var body []byte
+	for _, d := range data {
+		body = append(body, d...)
+	}
+	var idb []byte
+	for v := id; v > 0; v >>= 8 {
+		idb = append([]byte{byte(v)}, idb...)
+	}
+	size := uint64(len(body)) | 0x01<<56
+	sb := binary.BigEndian.AppendUint64(nil, size)
+	return append(append(idb, sb...), body...)
+}
+
+func u(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+func be(v ...uint32) []byte { return uint32s(v...) }
+
+// mkTrak 构造一个trak,n个sample时长均为dur,每个chunk有spc个sample
+func mkTrak(kind string, ts uint32, n int, dur uint32, stss []uint32, spc uint32, chunks []uint32, sizes []uint32) []byte {
+	mdhd := make([]byte, 24)
+	binary.BigEndian.PutUint32(mdhd[12:], ts)
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], kind)
+	tkhd := make([]byte, 84)
+	stbl := [][]byte{box("stsd", be(0, 0)), box("stts", be(0, 1, uint32(n), dur))}
+	if stss != nil {
+		stbl = append(stbl, box("stss", be(0, uint32(len(stss))), be(stss...)))
+	}
+	stbl = append(stbl, box("stsc", be(0, 1, 1, spc, 1)), box("stsz", be(0, 0, uint32(len(sizes))), be(sizes...)), box("stco", be(0, uint32(len(chunks))), be(chunks...)))
+	return box("trak", box("tkhd", tkhd), box("mdia", box("mdhd", mdhd), box("hdlr", hdlr), box("minf", box("stbl", stbl...))))
+}
+
+// upstream 模拟上游,f参数选择文件,range参数选择区间
+func upstream(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(upstreamHandler(files))
+}
+
+func upstreamHandler(files map[string][]byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		f := files[r.URL.Query().Get("f")]
+		var a, b int
+		fmt.Sscanf(r.URL.Query().Get("range"), "%d-%d", &a, &b)
+		if a > b || b >= len(f) {
+			http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Write(f[a : b+1])
+	}
+}
+
+// mkInit 构造分段mp4的初始化段,只有一个trak
+func mkInit(tid uint32) []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[12:], tid)
+	trex := make([]byte, 24)
+	binary.BigEndian.PutUint32(trex[4:], tid)
+	mvhd := make([]byte, 100)
+	return append(box("ftyp", []byte("iso5")), box("moov", box("mvhd", mvhd), box("trak", box("tkhd", tkhd)), box("mvex", box("trex", trex)))...)
+}
+
+// mkFrag 构造一个moof+mdat分段
+func mkFrag(tid uint32, payload string) []byte {
+	mfhd := make([]byte, 8)
+	tfhd := make([]byte, 8)
+	binary.BigEndian.PutUint32(tfhd[4:], tid)
+	return append(box("moof", box("mfhd", mfhd), box("traf", box("tfhd", tfhd))), box("mdat", []byte(payload))...)
+}
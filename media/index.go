@@ -0,0 +1,181 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/suconghou/videoproxy/request"
+)
+
+// init与index相距不超过此值时合并为一个请求
+const mergeGap = 64 * 1024
+
+// Source 一个可以使用&range=请求的上游流
+type Source struct {
+	URL        string
+	Size       int64
+	WebM       bool
+	InitStart  int64
+	InitEnd    int64
+	IndexStart int64
+	IndexEnd   int64
+}
+
+// Index 流的分段索引
+type Index struct {
+	WebM      bool
+	Timescale uint64
+	Duration  uint64
+	Size      int64
+	InitStart int64
+	InitEnd   int64
+	Init      []byte
+	Segments  []Segment
+	Track     Track
+}
+
+const (
+	// 索引与Movie缓存一天
+	mediaTTL = 86400
+	// 各缓存的最大条目数,Movie的moov与Flatten的sample表较大,条目数更少
+	indexCacheSize = 2000
+	movieCacheSize = 200
+	metaCacheSize  = 500
+	flatCacheSize  = 100
+	// 直播初始化段只有几KB
+	liveInitCacheSize = 1000
+)
+
+// key : *Index
+var indexes = newCache(indexCacheSize)
+
+func init() {
+	go func() {
+		for {
+			var now = time.Now().Unix()
+			indexes.clean(now)
+			movies.clean(now)
+			metas.clean(now)
+			flats.clean(now)
+			liveInits.clean(now)
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// Load 获取索引,key一般为 ID/itag,同一个key的索引缓存一天,并发的首次请求只读取一次
+func Load(key string, src Source, client http.Client) (*Index, error) {
+	v, err := indexes.get(key, func() (interface{}, int64, error) {
+		index, err := Fetch(src, client)
+		return index, mediaTTL, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Index), nil
+}
+
+// Cached 返回已缓存的索引,不发起请求
+func Cached(key string) (*Index, bool) {
+	if v, ok := indexes.peek(key); ok {
+		return v.(*Index), true
+	}
+	return nil, false
+}
+
+// Fetch 请求流的init与index部分,解析出分段列表
+func Fetch(src Source, client http.Client) (*Index, error) {
+	if src.InitEnd < src.InitStart || src.IndexEnd < src.IndexStart {
+		return nil, fmt.Errorf("bad init or index range")
+	}
+	var (
+		init  []byte
+		index []byte
+	)
+	if src.IndexStart >= src.InitStart && src.IndexStart-src.InitEnd <= mergeGap {
+		data, err := fetchRange(context.Background(), src.URL, src.InitStart, src.IndexEnd, client)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) < src.IndexEnd-src.InitStart+1 {
+			return nil, fmt.Errorf("index truncated")
+		}
+		init = data[:src.InitEnd-src.InitStart+1]
+		index = data[src.IndexStart-src.InitStart:]
+	} else {
+		var err error
+		if init, err = fetchRange(context.Background(), src.URL, src.InitStart, src.InitEnd, client); err != nil {
+			return nil, err
+		}
+		if index, err = fetchRange(context.Background(), src.URL, src.IndexStart, src.IndexEnd, client); err != nil {
+			return nil, err
+		}
+	}
+	var res = &Index{
+		WebM:      src.WebM,
+		Size:      src.Size,
+		InitStart: src.InitStart,
+		InitEnd:   src.InitEnd,
+		Init:      init,
+	}
+	var err error
+	if src.WebM {
+		var segOffset int64
+		if segOffset, res.Timescale, res.Duration, err = webmInfo(init); err != nil {
+			return nil, err
+		}
+		res.Segments, err = ParseCues(index, src.InitStart+segOffset, src.Size, res.Duration)
+	} else {
+		res.Timescale, res.Segments, err = ParseSidx(index, src.IndexStart)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Segments) == 0 || res.Timescale == 0 {
+		return nil, fmt.Errorf("no segments")
+	}
+	// 轨道信息仅用于输出更丰富的属性,解析失败不影响分段索引
+	res.Track, _ = ParseTrack(src.WebM, init)
+	if !src.WebM {
+		var last = res.Segments[len(res.Segments)-1]
+		res.Duration = last.Time + last.Duration
+	}
+	return res, nil
+}
+
+// Seconds 将以Timescale为单位的时间转换为秒
+func (i *Index) Seconds(t uint64) float64 {
+	return float64(t) / float64(i.Timescale)
+}
+
+// Find 返回包含时间点t(秒)的分段序号,即最后一个开始时间不晚于t的分段
+func (i *Index) Find(t float64) int {
+	var n = 0
+	for k, seg := range i.Segments {
+		if i.Seconds(seg.Time) > t {
+			break
+		}
+		n = k
+	}
+	return n
+}
+
+// expiredError 上游地址已过期
+type expiredError struct {
+	error
+}
+
+func fetchRange(ctx context.Context, url string, start int64, end int64, client http.Client) ([]byte, error) {
+	data, _, status, err := request.GetContext(ctx, fmt.Sprintf("%s&range=%d-%d", url, start, end), client, http.Header{})
+	if err != nil {
+		if request.Expired(status) {
+			return nil, expiredError{err}
+		}
+		return nil, err
+	}
+	var bs = append([]byte{}, data.Bytes()...)
+	request.PutBuffer(data)
+	return bs, nil
+}
@@ -0,0 +1,44 @@
+package media
+
+import "fmt"
+
+// key : []byte
+var liveInits = newCache(liveInitCacheSize)
+
+// LoadInitSegment 直播的初始化段按key(一般为 ID/itag)缓存ttl秒,并发的首次请求只调用一次load
+func LoadInitSegment(key string, ttl int64, load func() ([]byte, error)) ([]byte, error) {
+	v, err := liveInits.get(key, func() (interface{}, int64, error) {
+		data, err := load()
+		return data, ttl, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// InitSegment 从直播分段中取出初始化段,mp4为ftyp与moov,webm为EBML头与未知长度的Segment(Info,Tracks)
+func InitSegment(data []byte, webm bool) ([]byte, error) {
+	if webm {
+		head, info, entry, err := webmParts(data)
+		if err != nil {
+			return nil, err
+		}
+		var segStart = append(makeID(idSegment), uint64Bytes(unknownSizeVint)...)
+		return append(append(append(append([]byte{}, head...), segStart...), info...), makeElement(idTracks, makeElement(idTrackEntry, entry))...), nil
+	}
+	var ftyp, moov []byte
+	eachBox(data, func(name string, body []byte) bool {
+		switch name {
+		case "ftyp":
+			ftyp = body
+		case "moov":
+			moov = body
+		}
+		return ftyp == nil || moov == nil
+	})
+	if ftyp == nil || moov == nil {
+		return nil, fmt.Errorf("moov not found")
+	}
+	return append(makeBox("ftyp", ftyp), makeBox("moov", moov)...), nil
+}
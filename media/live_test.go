@@ -0,0 +1,47 @@
+package media
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+func TestInitSegment(t *testing.T) {
+	var (
+		ftyp = box("ftyp", []byte("iso5"))
+		moov = box("moov", box("mvhd", make([]byte, 100)))
+		seg  = append(append(append(append([]byte{}, ftyp...), moov...), box("moof", box("mfhd", make([]byte, 8)))...), box("mdat", []byte("data"))...)
+	)
+	init, err := InitSegment(seg, false)
+	if err != nil || !bytes.Equal(init, append(append([]byte{}, ftyp...), moov...)) {
+		t.Fatal(init, err)
+	}
+	for _, bad := range [][]byte{nil, ftyp, seg[:len(ftyp)+len(moov)-1], box("moof")} {
+		if _, err = InitSegment(bad, false); err == nil {
+			t.Fatal("expected error", len(bad))
+		}
+	}
+
+	var (
+		info    = el(idInfo, el(idTimecodeScale, u(1000000)), el(idDuration, u(math.Float64bits(0))))
+		entry   = el(idTrackEntry, el(idTrackNumber, []byte{1}), el(idTrackUID, u(77)))
+		cluster = el(idCluster, el(idTimecode, u(0)), el(idSimpleBlock, []byte{0x81, 0, 0, 0x80, 'x'}))
+		webm    = append(el(idEBML, el(0x4282, []byte("webm"))), el(idSegment, el(0x114D9B74), info, el(idTracks, entry), cluster)...)
+	)
+	init, err = InitSegment(webm, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(init, makeID(idCluster)) || bytes.Contains(init, makeID(0x114D9B74)) {
+		t.Fatal("init should only contain Info and Tracks")
+	}
+	if tr, err := ParseTrack(true, init); err != nil || tr.SampleRate != 0 {
+		t.Fatal(tr, err)
+	}
+	if _, ts, _, err := webmInfo(init); err != nil || ts != 1000 || !bytes.Contains(init, info) || !bytes.Contains(init, entry) {
+		t.Fatal(ts, err)
+	}
+	if _, err = InitSegment(el(idEBML), true); err == nil {
+		t.Fatal("expected error for missing segment")
+	}
+}
@@ -0,0 +1,371 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// matroska element id used for metadata
+const (
+	idSeekHead         = 0x114D9B74
+	idSeek             = 0x4DBB
+	idSeekID           = 0x53AB
+	idSeekPosition     = 0x53AC
+	idVoid             = 0xEC
+	idTags             = 0x1254C367
+	idTag              = 0x7373
+	idTargets          = 0x63C0
+	idTargetTypeValue  = 0x68CA
+	idSimpleTag        = 0x67C8
+	idTagName          = 0x45A3
+	idTagString        = 0x4487
+	idAttachments      = 0x1941A469
+	idAttachedFile     = 0x61A7
+	idFileName         = 0x466E
+	idFileMimeType     = 0x4660
+	idFileData         = 0x465C
+	idFileUID          = 0x46AE
+	idChapters         = 0x1043A770
+	idEditionEntry     = 0x45B9
+	idChapterAtom      = 0xB6
+	idChapterUID       = 0x73C4
+	idChapterTimeStart = 0x91
+	idChapterTimeEnd   = 0x92
+	idChapterDisplay   = 0x80
+	idChapString       = 0x85
+	idChapLanguage     = 0x437C
+)
+
+// Chapter 章节,Start为秒数
+type Chapter struct {
+	Start float64
+	Title string
+}
+
+// Metadata 写入下载文件的元数据,Cover为jpeg图片,Duration(秒)用于计算最后一个章节的结束时间
+type Metadata struct {
+	Title       string
+	Author      string
+	Date        string
+	Description string
+	Cover       []byte
+	Chapters    []Chapter
+	Duration    float64
+}
+
+const (
+	// 完整的元数据与Movie,Index缓存相同的时间
+	metaTTL = mediaTTL
+	// 部分获取失败的元数据稍后重新获取
+	metaPartialTTL = 600
+)
+
+// key : Metadata
+var metas = newCache(metaCacheSize)
+
+// LoadMetadata 同一key的元数据只获取一次,保证多次range请求得到的文件布局一致;load返回false表示部分获取失败,只缓存较短时间
+func LoadMetadata(key string, load func() (Metadata, bool)) Metadata {
+	v, _ := metas.get(key, func() (interface{}, int64, error) {
+		var meta, complete = load()
+		if !complete {
+			return meta, metaPartialTTL, nil
+		}
+		return meta, metaTTL, nil
+	})
+	return v.(Metadata)
+}
+
+// TagMp4 替换moov/udta,写入iTunes风格的元数据与Nero章节(chpl),位于moov之后的chunk偏移相应调整,其余部分从上游获取
+func TagMp4(m *Movie, url string, meta Metadata) (*File, error) {
+	if m.MoovEnd <= m.MoovStart {
+		return nil, fmt.Errorf("moov not found")
+	}
+	var udta = []byte{}
+	eachBox(findBox(m.Moov, "udta"), func(name string, body []byte) bool {
+		if name != "meta" && name != "chpl" {
+			udta = append(udta, makeBox(name, body)...)
+		}
+		return true
+	})
+	udta = append(udta, mp4Meta(meta)...)
+	if len(meta.Chapters) > 0 {
+		udta = append(udta, mp4Chapters(meta.Chapters)...)
+	}
+	var moov = makeBox("moov", append(rebuildBox(m.Moov, func(name string, body []byte) []byte {
+		if name == "udta" {
+			return nil
+		}
+		return makeBox(name, body)
+	}), makeBox("udta", udta)...))
+	var (
+		delta = int64(len(moov)) - (m.MoovEnd - m.MoovStart)
+		err   error
+	)
+	eachBox(moov[8:], func(name string, trak []byte) bool {
+		if name == "trak" {
+			err = shiftChunks(findBox(trak, "mdia", "minf", "stbl"), m.MoovEnd, delta)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var file = &File{Sources: []string{url}, Mime: "video/mp4"}
+	if isAudio(m.Moov) {
+		file.Mime = "audio/mp4"
+	}
+	file.Parts = append(spanParts(0, m.MoovStart), Part{Data: moov})
+	file.Parts = append(file.Parts, spanParts(m.MoovEnd, m.Size)...)
+	file.SetETag()
+	return file, nil
+}
+
+// shiftChunks 不早于from的chunk偏移加上delta,stco的偏移超出32位时返回错误
+func shiftChunks(stbl []byte, from int64, delta int64) error {
+	var err error
+	if stco := findBox(stbl, "stco"); len(stco) >= 8 {
+		eachEntry(stco, 4, func(b []byte) {
+			if v := int64(binary.BigEndian.Uint32(b)); v >= from {
+				if v+delta > math.MaxUint32 || v+delta < 0 {
+					err = fmt.Errorf("stco offset overflow")
+					return
+				}
+				binary.BigEndian.PutUint32(b, uint32(v+delta))
+			}
+		})
+	}
+	if co64 := findBox(stbl, "co64"); len(co64) >= 8 {
+		eachEntry(co64, 8, func(b []byte) {
+			if v := int64(binary.BigEndian.Uint64(b)); v >= from {
+				binary.BigEndian.PutUint64(b, uint64(v+delta))
+			}
+		})
+	}
+	return err
+}
+
+// mp4Meta meta(hdlr mdir + ilst)
+func mp4Meta(meta Metadata) []byte {
+	var (
+		hdlr  = fullBox("hdlr", 0, make([]byte, 4), []byte("mdirappl"), make([]byte, 9))
+		items = []byte{}
+		add   = func(name string, kind uint32, value []byte) {
+			if len(value) > 0 {
+				items = append(items, makeBox(name, makeBox("data", uint32s(kind, 0), value))...)
+			}
+		}
+	)
+	add("\xa9nam", 1, []byte(meta.Title))
+	add("\xa9ART", 1, []byte(meta.Author))
+	add("\xa9day", 1, []byte(meta.Date))
+	add("desc", 1, []byte(meta.Description))
+	add("covr", 13, meta.Cover)
+	return fullBox("meta", 0, hdlr, makeBox("ilst", items))
+}
+
+// mp4Chapters Nero章节 chpl,时间单位为100纳秒,标题最长255字节,最多255个
+func mp4Chapters(chapters []Chapter) []byte {
+	var body = []byte{0, 0, 0, 0}
+	if len(chapters) > 255 {
+		chapters = chapters[:255]
+	}
+	body = append(body, byte(len(chapters)))
+	for _, c := range chapters {
+		var title = []byte(c.Title)
+		if len(title) > 255 {
+			title = title[:255]
+		}
+		body = append(body, uint64Bytes(uint64(c.Start*1e7))...)
+		body = append(body, byte(len(title)))
+		body = append(body, title...)
+	}
+	return fullBox("chpl", 1, body)
+}
+
+// TagWebm 在Segment末尾追加Tags,Attachments,Chapters,修改Segment长度,若SeekHead之后的Void足够则在SeekHead中加入索引
+func TagWebm(index *Index, url string, meta Metadata) (*File, error) {
+	var (
+		init    = index.Init
+		segHead = -1
+		segData = 0
+		segSize int64
+		segLen  int
+	)
+	err := eachElement(init, func(e element, offset int, data []byte) bool {
+		if e.ID == idSegment {
+			segHead, segData, segSize = offset, offset+e.Header, e.Size
+			segLen = e.Header - len(makeID(idSegment))
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if segHead < 0 || index.InitStart != 0 {
+		return nil, fmt.Errorf("segment not found")
+	}
+	var (
+		segEnd = index.Size
+		tail   = []byte{}
+	)
+	if segSize >= 0 && int64(segData)+segSize < segEnd {
+		segEnd = int64(segData) + segSize
+	}
+	// 各元素相对于Segment数据起点的位置
+	var (
+		pos  = segEnd - int64(segData)
+		seek = []byte{}
+		add  = func(id uint64, b []byte) {
+			seek = append(seek, makeSmallElement(idSeek, makeSmallElement(idSeekID, makeID(id)), makeSmallElement(idSeekPosition, uintBytes(uint64(pos)+uint64(len(tail)))))...)
+			tail = append(tail, b...)
+		}
+	)
+	add(idTags, webmTags(meta))
+	if len(meta.Cover) > 0 {
+		add(idAttachments, makeElement(idAttachments, makeElement(idAttachedFile,
+			makeElement(idFileName, []byte("cover.jpg")),
+			makeElement(idFileMimeType, []byte("image/jpeg")),
+			makeElement(idFileData, meta.Cover),
+			makeElement(idFileUID, uint64Bytes(1)),
+		)))
+	}
+	if len(meta.Chapters) > 0 {
+		add(idChapters, webmChapters(meta.Chapters, meta.Duration))
+	}
+	var head = cloneBox(init[:segData])
+	if segSize >= 0 {
+		var n = uint64(segSize) + uint64(len(tail))
+		if n >= 1<<(7*uint(segLen))-1 {
+			return nil, fmt.Errorf("segment size overflow")
+		}
+		var size = head[segHead+len(makeID(idSegment)) : segData]
+		putUint(size, n)
+		size[0] |= 0x80 >> uint(segLen-1)
+	}
+	var from = int64(segData)
+	if b, n := webmSeekHead(init[segData:], seek); b != nil {
+		head = append(head, b...)
+		from += int64(n)
+	}
+	var file = &File{Sources: []string{url}, Mime: "video/webm"}
+	if t, _ := ParseTrack(true, init); t.SampleRate > 0 {
+		file.Mime = "audio/webm"
+	}
+	file.Parts = append([]Part{{Data: head}}, spanParts(from, segEnd)...)
+	file.Parts = append(file.Parts, Part{Data: tail})
+	file.Parts = append(file.Parts, spanParts(segEnd, index.Size)...)
+	file.SetETag()
+	return file, nil
+}
+
+// webmSeekHead 在原SeekHead中追加seek,与其后的Void占用相同的长度,空间不足时返回nil;n为替换的原有长度
+func webmSeekHead(b []byte, seek []byte) ([]byte, int) {
+	var (
+		entries []byte
+		n       = 0
+		found   = false
+	)
+	eachElement(b, func(e element, offset int, data []byte) bool {
+		switch {
+		case !found && e.ID == idSeekHead:
+			found = true
+			entries = data
+			n = offset + e.Header + len(data)
+			return true
+		case found && e.ID == idVoid:
+			n = offset + e.Header + len(data)
+		}
+		return false
+	})
+	if !found {
+		return nil, 0
+	}
+	var (
+		res  = makeSmallElement(idSeekHead, entries, seek)
+		rest = n - len(res)
+	)
+	if rest == 0 {
+		return res, n
+	}
+	if rest < 2 {
+		return nil, 0
+	}
+	if rest-2 < 0x7f {
+		return append(append(res, idVoid, 0x80|byte(rest-2)), make([]byte, rest-2)...), n
+	}
+	if rest < 9 {
+		return nil, 0
+	}
+	return append(res, makeElement(idVoid, make([]byte, rest-9))...), n
+}
+
+func webmTags(meta Metadata) []byte {
+	var tags = [][]byte{makeElement(idTargets, makeElement(idTargetTypeValue, []byte{50}))}
+	for _, kv := range [][2]string{{"TITLE", meta.Title}, {"ARTIST", meta.Author}, {"DATE_RELEASED", meta.Date}, {"DESCRIPTION", meta.Description}} {
+		if kv[1] != "" {
+			tags = append(tags, makeElement(idSimpleTag, makeElement(idTagName, []byte(kv[0])), makeElement(idTagString, []byte(kv[1]))))
+		}
+	}
+	return makeElement(idTags, makeElement(idTag, tags...))
+}
+
+// webmChapters 时间单位为纳秒,最后一个章节在duration结束
+func webmChapters(chapters []Chapter, duration float64) []byte {
+	var atoms = [][]byte{}
+	for i, c := range chapters {
+		var end = duration
+		if i+1 < len(chapters) {
+			end = chapters[i+1].Start
+		}
+		var atom = [][]byte{
+			makeElement(idChapterUID, uint64Bytes(uint64(i+1))),
+			makeElement(idChapterTimeStart, uint64Bytes(uint64(c.Start*1e9))),
+		}
+		if end > c.Start {
+			atom = append(atom, makeElement(idChapterTimeEnd, uint64Bytes(uint64(end*1e9))))
+		}
+		atom = append(atom, makeElement(idChapterDisplay, makeElement(idChapString, []byte(c.Title)), makeElement(idChapLanguage, []byte("eng"))))
+		atoms = append(atoms, makeElement(idChapterAtom, atom...))
+	}
+	return makeElement(idChapters, makeElement(idEditionEntry, atoms...))
+}
+
+// makeSmallElement 生成element,长度使用最短的vint
+func makeSmallElement(id uint64, body ...[]byte) []byte {
+	var size = 0
+	for _, b := range body {
+		size += len(b)
+	}
+	var n = 1
+	for uint64(size) >= 1<<(7*uint(n))-1 {
+		n++
+	}
+	var head = make([]byte, n)
+	putUint(head, uint64(size))
+	head[0] |= 0x80 >> uint(n-1)
+	var res = append(makeID(id), head...)
+	for _, b := range body {
+		res = append(res, b...)
+	}
+	return res
+}
+
+// uintBytes 最短的大端表示
+func uintBytes(v uint64) []byte {
+	var b = uint64Bytes(v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// spanParts 将上游区间[start,end)拆分为多个请求
+func spanParts(start int64, end int64) []Part {
+	var parts = []Part{}
+	for ; start < end; start += mergeLimit {
+		parts = append(parts, Part{Start: start, End: min64(start+mergeLimit, end) - 1})
+	}
+	return parts
+}
@@ -0,0 +1,193 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// tagMovie 构造ftyp+moov+mdat,moov中的chunk偏移指向mdat的数据
+func tagMovie(t *testing.T) ([]byte, *Movie, string, func()) {
+	mvhd := make([]byte, 100)
+	ftyp := box("ftyp", []byte("isom"))
+	build := func(off uint32) []byte {
+		return box("moov", box("mvhd", mvhd), mkTrak("soun", 1000, 2, 10, nil, 2, []uint32{off}, []uint32{3, 4}), box("udta", box("xyz1", []byte("keep")), box("meta", []byte("old"))))
+	}
+	moov := build(uint32(len(ftyp) + len(build(0)) + 8))
+	file := append(append(append([]byte{}, ftyp...), moov...), box("mdat", []byte("abcdefg"))...)
+	srv := upstream(map[string][]byte{"m": file})
+	m, err := LoadMovie(t.Name(), srv.URL+"?f=m", int64(len(file)), *srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, m, srv.URL + "?f=m", srv.Close
+}
+
+func TestTagMp4(t *testing.T) {
+	_, m, url, done := tagMovie(t)
+	defer done()
+	f, err := TagMp4(m, url, Metadata{Title: "T", Author: "A", Cover: []byte{0xff, 0xd8}, Chapters: []Chapter{{0, "a"}, {1, "b"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	f.Serve(rec, httptest.NewRequest("GET", "/", nil), http.Client{}, nil, nil)
+	out := rec.Body.Bytes()
+	if int64(len(out)) != f.Size() {
+		t.Fatal("size", len(out), f.Size())
+	}
+	tr, err := parseMovieTrack(findBox(out, "moov", "trak"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := tr.samples[0]
+	if string(out[s.offset:s.offset+7]) != "abcdefg" {
+		t.Fatal("offset", s.offset)
+	}
+	if findBox(out, "moov", "udta", "xyz1") == nil || findBox(out, "moov", "udta", "chpl") == nil {
+		t.Fatal("udta")
+	}
+	meta := findBox(out, "moov", "udta", "meta")
+	nam := findBox(meta[4:], "ilst", "\xa9nam", "data")
+	if string(nam[8:]) != "T" || !bytes.Equal(findBox(meta[4:], "ilst", "covr", "data")[8:], []byte{0xff, 0xd8}) {
+		t.Fatal("ilst")
+	}
+}
+
+func TestTagMp4ETag(t *testing.T) {
+	_, m, url, done := tagMovie(t)
+	defer done()
+	a, err := TagMp4(m, url, Metadata{Title: "T"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := TagMp4(m, url, Metadata{Title: "T", Cover: []byte{1}})
+	c, _ := TagMp4(m, url, Metadata{Title: "T"})
+	if a.ETag == "" || a.ETag == b.ETag || a.ETag != c.ETag {
+		t.Fatal(a.ETag, b.ETag, c.ETag)
+	}
+	var cases = []struct {
+		ifRange string
+		status  int
+	}{
+		{"", 206},
+		{a.ETag, 206},
+		{b.ETag, 200},
+	}
+	for _, cs := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Range", "bytes=0-9")
+		if cs.ifRange != "" {
+			req.Header.Set("If-Range", cs.ifRange)
+		}
+		rec := httptest.NewRecorder()
+		a.Serve(rec, req, http.Client{}, nil, nil)
+		if rec.Code != cs.status || rec.Header().Get("ETag") != a.ETag {
+			t.Error(cs.ifRange, rec.Code)
+		}
+	}
+}
+
+func TestShiftChunksOverflow(t *testing.T) {
+	stbl := box("stco", be(0, 2, 100, math.MaxUint32-10))
+	if err := shiftChunks(stbl, 50, 5); err != nil {
+		t.Fatal(err)
+	}
+	if v := binary.BigEndian.Uint32(stbl[16:]); v != 105 {
+		t.Fatal(v)
+	}
+	if err := shiftChunks(stbl, 50, 20); err == nil {
+		t.Fatal("overflow not detected")
+	}
+	co64 := box("co64", be(0, 1), u(math.MaxUint32))
+	if err := shiftChunks(co64, 50, 20); err != nil || binary.BigEndian.Uint64(co64[16:]) != math.MaxUint32+20 {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadMetadata(t *testing.T) {
+	var calls int
+	load := func() (Metadata, bool) {
+		calls++
+		return Metadata{Title: "x"}, false
+	}
+	a := LoadMetadata(t.Name(), load)
+	b := LoadMetadata(t.Name(), load)
+	if calls != 1 || a.Title != "x" || b.Title != "x" {
+		t.Fatal(calls)
+	}
+	metas.mu.Lock()
+	ttl := metas.items[t.Name()].Value.(*cacheEntry).expire - time.Now().Unix()
+	metas.mu.Unlock()
+	if ttl > metaPartialTTL {
+		t.Fatal(ttl)
+	}
+}
+
+func TestTagWebm(t *testing.T) {
+	info := el(idInfo, el(idTimecodeScale, u(1000000)))
+	tr := el(idTracks, el(idTrackEntry, el(idTrackNumber, []byte{1})))
+	seekhead := []byte{0x11, 0x4D, 0x9B, 0x74, 0x80}
+	void := append([]byte{0xEC, 0x80 | 100}, make([]byte, 100)...)
+	cl := el(idCluster, el(0xE7, u(0)), el(idSimpleBlock, []byte{0x81, 0, 0, 0x80, 'x'}))
+	body := append(append(append(append(append([]byte{}, seekhead...), void...), info...), tr...), cl...)
+	sz := u(uint64(len(body)))
+	sz[0] = 0x01
+	seg := append([]byte{0x18, 0x53, 0x80, 0x67}, sz...)
+	head := el(idEBML, el(0x4282, []byte("webm")))
+	file := append(append(append([]byte{}, head...), seg...), body...)
+	initEnd := len(head) + len(seg) + len(seekhead) + len(void) + len(info) + len(tr)
+	idx := &Index{WebM: true, Init: file[:initEnd], Size: int64(len(file))}
+	srv := upstream(map[string][]byte{"w": file})
+	defer srv.Close()
+	f, err := TagWebm(idx, srv.URL+"?f=w", Metadata{Title: "T", Cover: []byte{1, 2}, Chapters: []Chapter{{0, "a"}, {5, "b"}}, Duration: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.ETag == "" {
+		t.Fatal("etag")
+	}
+	rec := httptest.NewRecorder()
+	f.Serve(rec, httptest.NewRequest("GET", "/", nil), *srv.Client(), nil, nil)
+	out := rec.Body.Bytes()
+	segStart := -1
+	var ids []uint64
+	var seekPos []uint64
+	eachElement(out, func(e element, o int, d []byte) bool {
+		if e.ID == idSegment {
+			segStart = o + e.Header
+			if o+e.Header+len(d) != len(out) {
+				t.Fatal("segment size", len(d))
+			}
+			eachElement(d, func(e element, o int, d []byte) bool {
+				ids = append(ids, e.ID)
+				if e.ID == idSeekHead {
+					eachElement(d, func(e element, _ int, d []byte) bool {
+						eachElement(d, func(e element, _ int, d []byte) bool {
+							if e.ID == idSeekPosition {
+								seekPos = append(seekPos, readUint(d))
+							}
+							return true
+						})
+						return true
+					})
+				}
+				return true
+			})
+		}
+		return true
+	})
+	if len(ids) != 8 || ids[0] != idSeekHead || ids[1] != idVoid || ids[5] != idTags || ids[7] != idChapters || len(seekPos) != 3 {
+		t.Fatalf("%x", ids)
+	}
+	for i, p := range seekPos {
+		e, _ := readElement(out[segStart+int(p):])
+		if e.ID != []uint64{idTags, idAttachments, idChapters}[i] {
+			t.Fatal("seek", i)
+		}
+	}
+}
@@ -0,0 +1,519 @@
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// 相邻的sample合并为一个上游请求,单个请求不超过此长度
+const mergeLimit = 1 << 20
+
+// 单个轨道sample数量上限,防止异常的stsz申请过多内存
+const maxSamples = 1 << 24
+
+// Movie mp4的ftyp与moov内容,MoovStart与MoovEnd为moov box在文件中的区间(不含MoovEnd)
+type Movie struct {
+	Ftyp      []byte
+	Moov      []byte
+	Size      int64
+	MoovStart int64
+	MoovEnd   int64
+}
+
+// key : *Movie
+var movies = newCache(movieCacheSize)
+
+// sample 文件中的一个sample,时间以轨道的timescale为单位
+type sample struct {
+	offset int64
+	size   uint32
+	dts    uint64
+	dur    uint32
+	cto    uint32
+	sync   bool
+}
+
+type movieTrack struct {
+	trak        []byte
+	timescale   uint32
+	video       bool
+	cttsVersion int // -1表示没有ctts
+	stss        bool
+	samples     []sample
+	first       int
+	last        int
+}
+
+// LoadMovie 同一个key缓存一天,并发的首次请求只读取一次
+func LoadMovie(key string, url string, size int64, client http.Client) (*Movie, error) {
+	v, err := movies.get(key, func() (interface{}, int64, error) {
+		m, err := loadMovie(url, size, client)
+		return m, mediaTTL, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Movie), nil
+}
+
+// loadMovie 依次读取顶层box的头部,取出ftyp与moov
+func loadMovie(url string, size int64, client http.Client) (*Movie, error) {
+	var m = &Movie{Size: size}
+	for pos := int64(0); pos+8 <= size && (m.Ftyp == nil || m.Moov == nil); {
+		head, err := fetchRange(context.Background(), url, pos, min64(pos+15, size-1), client)
+		if err != nil {
+			return nil, err
+		}
+		if len(head) < 8 {
+			return nil, fmt.Errorf("box header truncated at %d", pos)
+		}
+		n, header := boxSize(head)
+		var length = int64(n)
+		if n == 0 {
+			length = size - pos
+		}
+		if length < int64(header) {
+			return nil, fmt.Errorf("bad box size %d at %d", length, pos)
+		}
+		if name := string(head[4:8]); name == "ftyp" || name == "moov" {
+			data, err := fetchRange(context.Background(), url, pos, pos+length-1, client)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(data)) != length {
+				return nil, fmt.Errorf("%s truncated", name)
+			}
+			if name == "ftyp" {
+				m.Ftyp = data[header:]
+			} else {
+				m.Moov = data[header:]
+				m.MoovStart, m.MoovEnd = pos, pos+length
+			}
+		}
+		pos += length
+	}
+	if m.Ftyp == nil || m.Moov == nil {
+		return nil, fmt.Errorf("moov not found")
+	}
+	return m, nil
+}
+
+// ClipMovie 截取[start,end]秒,从start之前最近的关键帧开始,重建各轨道的sample表,每个sample单独作为一个chunk,end<=0表示直到结尾
+func ClipMovie(m *Movie, url string, start float64, end float64) (*File, error) {
+	var (
+		mvhd   = findBox(m.Moov, "mvhd")
+		tracks = []*movieTrack{}
+		err    error
+	)
+	if len(mvhd) < 20 {
+		return nil, fmt.Errorf("mvhd not found")
+	}
+	var movieScale = binary.BigEndian.Uint32(mvhd[12:])
+	if mvhd[0] == 1 {
+		movieScale = binary.BigEndian.Uint32(mvhd[20:])
+	}
+	eachBox(m.Moov, func(name string, body []byte) bool {
+		if name == "trak" {
+			var t *movieTrack
+			if t, err = parseMovieTrack(body); err == nil {
+				tracks = append(tracks, t)
+			}
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 || movieScale == 0 {
+		return nil, fmt.Errorf("no tracks")
+	}
+	var from = start
+	for _, t := range tracks {
+		if t.video {
+			from = t.syncBefore(start)
+			break
+		}
+	}
+	for _, t := range tracks {
+		if !t.clip(from, end) {
+			return nil, fmt.Errorf("no samples between %.3f and %.3f", start, end)
+		}
+	}
+	return layoutMovie(m.Ftyp, m.Moov, tracks, movieScale, url), nil
+}
+
+// layoutMovie 输出ftyp + moov + mdat,mdat中依次为各轨道[first,last]之间的sample
+func layoutMovie(ftypBody []byte, moovBody []byte, tracks []*movieTrack, movieScale uint32, url string) *File {
+	// 按原文件中的位置排序,保持音视频交织,相邻的sample合并请求
+	type ref struct {
+		track int
+		index int
+	}
+	var (
+		order   = []ref{}
+		offsets = make([][]int64, len(tracks))
+		parts   = []Part{}
+		pos     int64
+	)
+	for ti, t := range tracks {
+		offsets[ti] = make([]int64, t.last-t.first+1)
+		for i := t.first; i <= t.last; i++ {
+			order = append(order, ref{ti, i})
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return tracks[order[i].track].samples[order[i].index].offset < tracks[order[j].track].samples[order[j].index].offset
+	})
+	for _, o := range order {
+		var (
+			t = tracks[o.track]
+			s = t.samples[o.index]
+		)
+		offsets[o.track][o.index-t.first] = pos
+		pos += int64(s.size)
+		if n := len(parts); n > 0 && parts[n-1].End+1 == s.offset && parts[n-1].Size()+int64(s.size) <= mergeLimit {
+			parts[n-1].End += int64(s.size)
+			continue
+		}
+		parts = append(parts, Part{Start: s.offset, End: s.offset + int64(s.size) - 1})
+	}
+	var mdat = make([]byte, 8)
+	binary.BigEndian.PutUint32(mdat, uint32(pos+8))
+	copy(mdat[4:], "mdat")
+	if pos+8 > math.MaxUint32 {
+		mdat = make([]byte, 16)
+		binary.BigEndian.PutUint32(mdat, 1)
+		copy(mdat[4:], "mdat")
+		binary.BigEndian.PutUint64(mdat[8:], uint64(pos+16))
+	}
+	// co64的长度固定,先计算moov的长度再写入实际偏移
+	var (
+		ftyp = makeBox("ftyp", ftypBody)
+		moov = makeBox("moov", buildMoov(moovBody, tracks, movieScale, offsets, 0))
+		base = int64(len(ftyp) + len(moov) + len(mdat))
+	)
+	moov = makeBox("moov", buildMoov(moovBody, tracks, movieScale, offsets, base))
+	var file = &File{Sources: []string{url}, Mime: "video/mp4"}
+	if len(tracks) == 1 && !tracks[0].video {
+		file.Mime = "audio/mp4"
+	}
+	file.Parts = append([]Part{{Data: append(append(ftyp, moov...), mdat...)}}, parts...)
+	return file
+}
+
+func parseMovieTrack(trak []byte) (*movieTrack, error) {
+	var (
+		mdhd = findBox(trak, "mdia", "mdhd")
+		hdlr = findBox(trak, "mdia", "hdlr")
+		stbl = findBox(trak, "mdia", "minf", "stbl")
+		t    = &movieTrack{trak: trak, cttsVersion: -1}
+	)
+	if len(mdhd) < 24 || len(hdlr) < 12 || stbl == nil {
+		return nil, fmt.Errorf("bad trak")
+	}
+	t.timescale = binary.BigEndian.Uint32(mdhd[12:])
+	if mdhd[0] == 1 {
+		t.timescale = binary.BigEndian.Uint32(mdhd[20:])
+	}
+	t.video = string(hdlr[8:12]) == "vide"
+	var (
+		stsz = findBox(stbl, "stsz")
+		stsc = findBox(stbl, "stsc")
+		stts = findBox(stbl, "stts")
+	)
+	if len(stsz) < 12 || len(stsc) < 8 || len(stts) < 8 {
+		return nil, fmt.Errorf("sample table not found")
+	}
+	var (
+		fixed = binary.BigEndian.Uint32(stsz[4:])
+		count = int(binary.BigEndian.Uint32(stsz[8:]))
+		sizes = stsz[12:]
+	)
+	if count > maxSamples {
+		return nil, fmt.Errorf("too many samples %d", count)
+	}
+	if fixed == 0 && len(sizes) < count*4 {
+		return nil, fmt.Errorf("stsz truncated")
+	}
+	var chunks = []int64{}
+	if stco := findBox(stbl, "stco"); len(stco) >= 8 {
+		var n = int(binary.BigEndian.Uint32(stco[4:]))
+		if len(stco) < 8+n*4 {
+			return nil, fmt.Errorf("stco truncated")
+		}
+		for i := 0; i < n; i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint32(stco[8+i*4:])))
+		}
+	} else if co64 := findBox(stbl, "co64"); len(co64) >= 8 {
+		var n = int(binary.BigEndian.Uint32(co64[4:]))
+		if len(co64) < 8+n*8 {
+			return nil, fmt.Errorf("co64 truncated")
+		}
+		for i := 0; i < n; i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint64(co64[8+i*8:])))
+		}
+	} else {
+		return nil, fmt.Errorf("chunk offset not found")
+	}
+	var entries = int(binary.BigEndian.Uint32(stsc[4:]))
+	if len(stsc) < 8+entries*12 {
+		return nil, fmt.Errorf("stsc truncated")
+	}
+	t.samples = make([]sample, count)
+	var k = 0
+	for e := 0; e < entries; e++ {
+		var (
+			b     = stsc[8+e*12:]
+			first = int(binary.BigEndian.Uint32(b))
+			spc   = int(binary.BigEndian.Uint32(b[4:]))
+			next  = len(chunks) + 1
+		)
+		if e+1 < entries {
+			next = int(binary.BigEndian.Uint32(stsc[8+(e+1)*12:]))
+		}
+		for c := first; c < next && c <= len(chunks) && c > 0; c++ {
+			var off = chunks[c-1]
+			for j := 0; j < spc && k < count; j++ {
+				var size = fixed
+				if fixed == 0 {
+					size = binary.BigEndian.Uint32(sizes[k*4:])
+				}
+				t.samples[k].offset = off
+				t.samples[k].size = size
+				off += int64(size)
+				k++
+			}
+		}
+	}
+	if k != count {
+		return nil, fmt.Errorf("stsc covers %d of %d samples", k, count)
+	}
+	var dts uint64
+	k = 0
+	eachEntry(stts, 8, func(b []byte) {
+		var n, delta = binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+		for j := uint32(0); j < n && k < count; j++ {
+			t.samples[k].dts = dts
+			t.samples[k].dur = delta
+			dts += uint64(delta)
+			k++
+		}
+	})
+	if ctts := findBox(stbl, "ctts"); len(ctts) >= 8 {
+		t.cttsVersion = int(ctts[0])
+		k = 0
+		eachEntry(ctts, 8, func(b []byte) {
+			var n, offset = binary.BigEndian.Uint32(b), binary.BigEndian.Uint32(b[4:])
+			for j := uint32(0); j < n && k < count; j++ {
+				t.samples[k].cto = offset
+				k++
+			}
+		})
+	}
+	if stss := findBox(stbl, "stss"); len(stss) >= 8 {
+		t.stss = true
+		eachEntry(stss, 4, func(b []byte) {
+			if n := int(binary.BigEndian.Uint32(b)); n > 0 && n <= count {
+				t.samples[n-1].sync = true
+			}
+		})
+	} else {
+		for i := range t.samples {
+			t.samples[i].sync = true
+		}
+	}
+	return t, nil
+}
+
+// eachEntry 遍历full box中entry_count之后的定长条目
+func eachEntry(b []byte, size int, fn func([]byte)) {
+	var n = int(binary.BigEndian.Uint32(b[4:]))
+	for i := 0; i < n && 8+(i+1)*size <= len(b); i++ {
+		fn(b[8+i*size:])
+	}
+}
+
+func (t *movieTrack) seconds(dts uint64) float64 {
+	return float64(dts) / float64(t.timescale)
+}
+
+// syncBefore 不晚于start的最后一个关键帧的时间
+func (t *movieTrack) syncBefore(start float64) float64 {
+	var res float64
+	for _, s := range t.samples {
+		if t.seconds(s.dts) > start {
+			break
+		}
+		if s.sync {
+			res = t.seconds(s.dts)
+		}
+	}
+	return res
+}
+
+// clip 选取[from,end)之间的sample,没有sample时返回false
+func (t *movieTrack) clip(from float64, end float64) bool {
+	t.first = sort.Search(len(t.samples), func(i int) bool {
+		return t.seconds(t.samples[i].dts) >= from-1e-6
+	})
+	t.last = len(t.samples) - 1
+	if end > 0 {
+		t.last = sort.Search(len(t.samples), func(i int) bool {
+			return t.seconds(t.samples[i].dts) >= end
+		}) - 1
+	}
+	return t.first <= t.last
+}
+
+func (t *movieTrack) duration() uint64 {
+	var d uint64
+	for _, s := range t.samples[t.first : t.last+1] {
+		d += uint64(s.dur)
+	}
+	return d
+}
+
+// buildMoov 修改各处时长,替换每个trak的sample表,去掉mvex,base为mdat数据的起始位置
+func buildMoov(moov []byte, tracks []*movieTrack, movieScale uint32, offsets [][]int64, base int64) []byte {
+	var (
+		n        = 0
+		duration uint64
+	)
+	for _, t := range tracks {
+		if d := t.duration() * uint64(movieScale) / uint64(t.timescale); d > duration {
+			duration = d
+		}
+	}
+	return rebuildBox(moov, func(name string, body []byte) []byte {
+		switch name {
+		case "mvhd":
+			var b = cloneBox(body)
+			setDuration(b, 16, 24, duration)
+			return makeBox(name, b)
+		case "trak":
+			var t = tracks[n]
+			n++
+			return makeBox(name, t.rebuild(movieScale, offsets[n-1], base))
+		case "mvex":
+			return nil
+		}
+		return makeBox(name, body)
+	})
+}
+
+func (t *movieTrack) rebuild(movieScale uint32, offsets []int64, base int64) []byte {
+	var (
+		duration      = t.duration()
+		movieDuration = duration * uint64(movieScale) / uint64(t.timescale)
+	)
+	return rebuildBox(t.trak, func(name string, body []byte) []byte {
+		switch name {
+		case "tkhd":
+			var b = cloneBox(body)
+			setDuration(b, 20, 28, movieDuration)
+			return makeBox(name, b)
+		case "edts":
+			// 只保留单个条目的编辑列表,用于抵消ctts的偏移
+			var elst = cloneBox(findBox(body, "elst"))
+			if len(elst) < 20 || binary.BigEndian.Uint32(elst[4:]) != 1 {
+				return nil
+			}
+			setDuration(elst, 8, 8, movieDuration)
+			return makeBox(name, makeBox("elst", elst))
+		case "mdia":
+			return makeBox(name, rebuildBox(body, func(name string, body []byte) []byte {
+				switch name {
+				case "mdhd":
+					var b = cloneBox(body)
+					setDuration(b, 16, 24, duration)
+					return makeBox(name, b)
+				case "minf":
+					return makeBox(name, rebuildBox(body, func(name string, body []byte) []byte {
+						if name == "stbl" {
+							return makeBox(name, t.stbl(findBox(body, "stsd"), offsets, base))
+						}
+						return makeBox(name, body)
+					}))
+				}
+				return makeBox(name, body)
+			}))
+		}
+		return makeBox(name, body)
+	})
+}
+
+// stbl stsd + stts + ctts + stss + stsc(每个chunk一个sample) + stsz + co64
+func (t *movieTrack) stbl(stsd []byte, offsets []int64, base int64) []byte {
+	var (
+		samples = t.samples[t.first : t.last+1]
+		stts    = []uint32{}
+		ctts    = []uint32{}
+		stss    = []uint32{}
+		stsz    = []uint32{0, uint32(len(samples))}
+		co64    = make([]byte, 0, len(offsets)*8)
+	)
+	for i, s := range samples {
+		stts = appendRun(stts, s.dur)
+		ctts = appendRun(ctts, s.cto)
+		if s.sync {
+			stss = append(stss, uint32(i+1))
+		}
+		stsz = append(stsz, s.size)
+		co64 = append(co64, uint64Bytes(uint64(base+offsets[i]))...)
+	}
+	var res = append(makeBox("stsd", stsd), fullBox("stts", 0, uint32s(uint32(len(stts)/2)), uint32s(stts...))...)
+	if t.cttsVersion >= 0 {
+		res = append(res, fullBox("ctts", byte(t.cttsVersion), uint32s(uint32(len(ctts)/2)), uint32s(ctts...))...)
+	}
+	if t.stss {
+		res = append(res, fullBox("stss", 0, uint32s(uint32(len(stss))), uint32s(stss...))...)
+	}
+	res = append(res, fullBox("stsc", 0, uint32s(1, 1, 1, 1))...)
+	res = append(res, fullBox("stsz", 0, uint32s(stsz...))...)
+	return append(res, fullBox("co64", 0, uint32s(uint32(len(samples))), co64)...)
+}
+
+// appendRun 以(count,value)的形式追加,与上一个值相同时计数加一
+func appendRun(runs []uint32, v uint32) []uint32 {
+	if n := len(runs); n > 0 && runs[n-1] == v {
+		runs[n-2]++
+		return runs
+	}
+	return append(runs, 1, v)
+}
+
+func fullBox(name string, version byte, body ...[]byte) []byte {
+	return makeBox(name, append([][]byte{{version, 0, 0, 0}}, body...)...)
+}
+
+func uint32s(v ...uint32) []byte {
+	var b = make([]byte, len(v)*4)
+	for i, n := range v {
+		binary.BigEndian.PutUint32(b[i*4:], n)
+	}
+	return b
+}
+
+// setDuration version为0时在off0写入4字节,否则在off1写入8字节
+func setDuration(b []byte, off0 int, off1 int, v uint64) {
+	if b[0] == 1 {
+		if len(b) >= off1+8 {
+			binary.BigEndian.PutUint64(b[off1:], v)
+		}
+		return
+	}
+	if len(b) >= off0+4 {
+		binary.BigEndian.PutUint32(b[off0:], uint32(v))
+	}
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,75 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// makeBox 生成box, body依次拼接
+func makeBox(name string, body ...[]byte) []byte {
+	var size = 8
+	for _, b := range body {
+		size += len(b)
+	}
+	var res = make([]byte, 8, size)
+	binary.BigEndian.PutUint32(res, uint32(size))
+	copy(res[4:], name)
+	for _, b := range body {
+		res = append(res, b...)
+	}
+	return res
+}
+
+// cloneBox 复制box的内容,修改不影响原始数据
+func cloneBox(b []byte) []byte {
+	var res = make([]byte, len(b))
+	copy(res, b)
+	return res
+}
+
+// setTkhdID 修改trak中tkhd的track_ID
+func setTkhdID(trak []byte, id uint32) error {
+	var tkhd = findBox(trak, "tkhd")
+	if len(tkhd) < 24 {
+		return fmt.Errorf("tkhd not found")
+	}
+	if tkhd[0] == 1 {
+		binary.BigEndian.PutUint32(tkhd[20:], id)
+	} else {
+		binary.BigEndian.PutUint32(tkhd[12:], id)
+	}
+	return nil
+}
+
+// rewriteFragments 修改分段中每个moof的sequence_number与tfhd的track_ID,长度不变;track为0时不修改track_ID
+func rewriteFragments(b []byte, track uint32, seq uint32) error {
+	var n uint32
+	for pos := 0; pos+8 <= len(b); {
+		size, header := boxSize(b[pos:])
+		if size == 0 {
+			size = len(b) - pos
+		}
+		if size < header || pos+size > len(b) {
+			return fmt.Errorf("bad box size %d", size)
+		}
+		if string(b[pos+4:pos+8]) == "moof" {
+			var moof = b[pos+header : pos+size]
+			if mfhd := findBox(moof, "mfhd"); len(mfhd) >= 8 {
+				binary.BigEndian.PutUint32(mfhd[4:], seq+n)
+				n++
+			}
+			if track > 0 {
+				eachBox(moof, func(name string, traf []byte) bool {
+					if name == "traf" {
+						if tfhd := findBox(traf, "tfhd"); len(tfhd) >= 8 {
+							binary.BigEndian.PutUint32(tfhd[4:], track)
+						}
+					}
+					return true
+				})
+			}
+		}
+		pos += size
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// matroska element id used for muxing
+const (
+	idTrackNumber   = 0xD7
+	idTrackUID      = 0x73C5
+	idSimpleBlock   = 0xA3
+	idBlockGroup    = 0xA0
+	idBlock         = 0xA1
+	idCueTrack      = 0xF7
+	unknownSizeVint = 0x01FFFFFFFFFFFFFF
+)
+
+// muxPart 一个分段及其所属轨道
+type muxPart struct {
+	track int
+	seg   Segment
+	time  float64
+}
+
+// Mux 将独立的视频流与音频流交织为一个文件,输出的分段按时间排序,start为起始时间(秒)
+// Sources[0]为视频地址,Sources[1]为音频地址
+func Mux(video *Index, audio *Index, videoURL string, audioURL string, start float64) (*File, error) {
+	if video.WebM != audio.WebM {
+		return nil, fmt.Errorf("container mismatch")
+	}
+	var parts = interleave(video, audio, start)
+	if video.WebM {
+		return muxWebm(video, audio, videoURL, audioURL, parts)
+	}
+	return muxMp4(video, audio, videoURL, audioURL, parts)
+}
+
+// interleave 从start所在的分段开始,按时间交织两个轨道的分段
+func interleave(video *Index, audio *Index, start float64) []muxPart {
+	var (
+		parts = []muxPart{}
+		vi    = video.Find(start)
+		ai    = 0
+	)
+	if len(video.Segments) > 0 {
+		ai = audio.Find(video.Seconds(video.Segments[vi].Time))
+	}
+	for _, seg := range video.Segments[vi:] {
+		parts = append(parts, muxPart{0, seg, video.Seconds(seg.Time)})
+	}
+	for _, seg := range audio.Segments[ai:] {
+		parts = append(parts, muxPart{1, seg, audio.Seconds(seg.Time)})
+	}
+	sort.SliceStable(parts, func(i, j int) bool {
+		return parts[i].time < parts[j].time
+	})
+	return parts
+}
+
+// muxMp4 ftyp + moov(两个trak) + 交织的moof/mdat + mfra,track_ID视频为1,音频为2
+func muxMp4(video *Index, audio *Index, videoURL string, audioURL string, parts []muxPart) (*File, error) {
+	var (
+		ftyp = findBox(video.Init, "ftyp")
+		vmov = findBox(video.Init, "moov")
+		amov = findBox(audio.Init, "moov")
+	)
+	if ftyp == nil || vmov == nil || amov == nil {
+		return nil, fmt.Errorf("moov not found")
+	}
+	var (
+		mvhd  = cloneBox(findBox(vmov, "mvhd"))
+		vtrak = cloneBox(findBox(vmov, "trak"))
+		atrak = cloneBox(findBox(amov, "trak"))
+		vtrex = cloneBox(findBox(vmov, "mvex", "trex"))
+		atrex = cloneBox(findBox(amov, "mvex", "trex"))
+		mehd  = findBox(vmov, "mvex", "mehd")
+	)
+	if len(mvhd) < 4 || len(vtrex) < 8 || len(atrex) < 8 {
+		return nil, fmt.Errorf("bad moov")
+	}
+	binary.BigEndian.PutUint32(mvhd[len(mvhd)-4:], 3)
+	binary.BigEndian.PutUint32(vtrex[4:], 1)
+	binary.BigEndian.PutUint32(atrex[4:], 2)
+	if err := setTkhdID(vtrak, 1); err != nil {
+		return nil, err
+	}
+	if err := setTkhdID(atrak, 2); err != nil {
+		return nil, err
+	}
+	var mvex = [][]byte{}
+	if mehd != nil {
+		mvex = append(mvex, makeBox("mehd", mehd))
+	}
+	mvex = append(mvex, makeBox("trex", vtrex), makeBox("trex", atrex))
+	var (
+		init = append(makeBox("ftyp", ftyp), makeBox("moov", makeBox("mvhd", mvhd), makeBox("trak", vtrak), makeBox("trak", atrak), makeBox("mvex", mvex...))...)
+		file = &File{Sources: []string{videoURL, audioURL}, Mime: "video/mp4"}
+		// tfra entry: time(8) moof_offset(8) traf/trun/sample number(各1字节)
+		tfra   = [2][]byte{}
+		count  = [2]uint32{}
+		offset = int64(len(init))
+	)
+	file.Parts = append(file.Parts, Part{Data: init})
+	for i, p := range parts {
+		var (
+			track = uint32(p.track + 1)
+			seq   = uint32(i+1) << 8
+		)
+		file.Parts = append(file.Parts, Part{Src: p.track, Start: p.seg.Start, End: p.seg.End, Rewrite: func(b []byte) error {
+			return rewriteFragments(b, track, seq)
+		}})
+		var entry = make([]byte, 19)
+		binary.BigEndian.PutUint64(entry, p.seg.Time)
+		binary.BigEndian.PutUint64(entry[8:], uint64(offset))
+		entry[16], entry[17], entry[18] = 1, 1, 1
+		tfra[p.track] = append(tfra[p.track], entry...)
+		count[p.track]++
+		offset += p.seg.End - p.seg.Start + 1
+	}
+	var boxes = [][]byte{}
+	for i := range tfra {
+		var head = make([]byte, 16)
+		head[0] = 1
+		binary.BigEndian.PutUint32(head[4:], uint32(i+1))
+		binary.BigEndian.PutUint32(head[12:], count[i])
+		boxes = append(boxes, makeBox("tfra", head, tfra[i]))
+	}
+	var (
+		mfro = make([]byte, 8)
+		size = 8 + len(boxes[0]) + len(boxes[1]) + 16
+	)
+	binary.BigEndian.PutUint32(mfro[4:], uint32(size))
+	boxes = append(boxes, makeBox("mfro", mfro))
+	file.Parts = append(file.Parts, Part{Data: makeBox("mfra", boxes...)})
+	return file, nil
+}
+
+// muxWebm EBML头 + 未知长度的Segment(Info,Tracks,Cues) + 交织的Cluster,TrackNumber视频为1,音频为2
+func muxWebm(video *Index, audio *Index, videoURL string, audioURL string, parts []muxPart) (*File, error) {
+	if video.Timescale != audio.Timescale {
+		return nil, fmt.Errorf("timecode scale mismatch")
+	}
+	vhead, vinfo, ventry, err := webmParts(video.Init)
+	if err != nil {
+		return nil, err
+	}
+	_, _, aentry, err := webmParts(audio.Init)
+	if err != nil {
+		return nil, err
+	}
+	ventry, aentry = cloneBox(ventry), cloneBox(aentry)
+	setTrackEntry(ventry, 1)
+	setTrackEntry(aentry, 2)
+	var (
+		tracks = makeElement(idTracks, makeElement(idTrackEntry, ventry), makeElement(idTrackEntry, aentry))
+		// CuePoint的各字段均为定长,Cues的长度与位置无关,可先计算
+		cueSize  = len(makeCuePoint(0, 0))
+		count    = 0
+		file     = &File{Sources: []string{videoURL, audioURL}, Mime: "video/webm"}
+		segStart = append(makeID(idSegment), uint64Bytes(unknownSizeVint)...)
+	)
+	for _, p := range parts {
+		if p.track == 0 {
+			count++
+		}
+	}
+	var (
+		cuesSize = len(makeElement(idCues, make([]byte, cueSize*count)))
+		offset   = int64(len(vinfo) + len(tracks) + cuesSize)
+		cues     = []byte{}
+	)
+	for _, p := range parts {
+		var track = byte(p.track + 1)
+		if p.track == 0 {
+			cues = append(cues, makeCuePoint(p.seg.Time, uint64(offset))...)
+		}
+		file.Parts = append(file.Parts, Part{Src: p.track, Start: p.seg.Start, End: p.seg.End, Rewrite: func(b []byte) error {
+			return rewriteClusters(b, track)
+		}})
+		offset += p.seg.End - p.seg.Start + 1
+	}
+	var init = append(append(append(append(append([]byte{}, vhead...), segStart...), vinfo...), tracks...), makeElement(idCues, cues)...)
+	file.Parts = append([]Part{{Data: init}}, file.Parts...)
+	return file, nil
+}
+
+// webmParts 取初始化段中的EBML头,Info element与第一个TrackEntry的内容
+func webmParts(init []byte) ([]byte, []byte, []byte, error) {
+	var head, info, entry []byte
+	err := eachElement(init, func(e element, offset int, data []byte) bool {
+		if e.ID == idEBML {
+			head = init[offset : offset+e.Header+len(data)]
+			return true
+		}
+		if e.ID != idSegment {
+			return true
+		}
+		var base = offset + e.Header
+		eachElement(data, func(e element, offset int, data []byte) bool {
+			switch e.ID {
+			case idInfo:
+				info = init[base+offset : base+offset+e.Header+len(data)]
+			case idTracks:
+				eachElement(data, func(e element, _ int, data []byte) bool {
+					if e.ID == idTrackEntry {
+						entry = data
+						return false
+					}
+					return true
+				})
+			}
+			return e.ID != idCluster
+		})
+		return false
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if head == nil || info == nil || entry == nil {
+		return nil, nil, nil, fmt.Errorf("bad webm init")
+	}
+	return head, info, entry, nil
+}
+
+// setTrackEntry 原地修改TrackNumber与TrackUID
+func setTrackEntry(entry []byte, n byte) {
+	eachElement(entry, func(e element, _ int, data []byte) bool {
+		if (e.ID == idTrackNumber || e.ID == idTrackUID) && len(data) > 0 {
+			for i := range data {
+				data[i] = 0
+			}
+			data[len(data)-1] = n
+		}
+		return true
+	})
+}
+
+// rewriteClusters 修改Cluster中每个Block的轨道号
+func rewriteClusters(b []byte, track byte) error {
+	return eachElement(b, func(e element, _ int, data []byte) bool {
+		if e.ID == idCluster {
+			eachElement(data, func(e element, _ int, data []byte) bool {
+				switch e.ID {
+				case idSimpleBlock:
+					setBlockTrack(data, track)
+				case idBlockGroup:
+					eachElement(data, func(e element, _ int, data []byte) bool {
+						if e.ID == idBlock {
+							setBlockTrack(data, track)
+						}
+						return true
+					})
+				}
+				return true
+			})
+		}
+		return true
+	})
+}
+
+// setBlockTrack Block以轨道号的vint开头,只处理1字节的情况,长度不变
+func setBlockTrack(data []byte, track byte) {
+	if len(data) > 0 && data[0]&0x80 != 0 {
+		data[0] = 0x80 | track
+	}
+}
+
+func makeCuePoint(t uint64, pos uint64) []byte {
+	return makeElement(idCuePoint,
+		makeElement(idCueTime, uint64Bytes(t)),
+		makeElement(idCueTrackPos, makeElement(idCueTrack, []byte{1}), makeElement(idCueClusterPos, uint64Bytes(pos))),
+	)
+}
+
+// makeElement 生成element,长度统一使用8字节vint
+func makeElement(id uint64, body ...[]byte) []byte {
+	var size = 0
+	for _, b := range body {
+		size += len(b)
+	}
+	var res = append(makeID(id), uint64Bytes(uint64(size)|1<<56)...)
+	for _, b := range body {
+		res = append(res, b...)
+	}
+	return res
+}
+
+func makeID(id uint64) []byte {
+	var res = []byte{}
+	for ; id > 0; id >>= 8 {
+		res = append([]byte{byte(id)}, res...)
+	}
+	return res
+}
+
+func uint64Bytes(v uint64) []byte {
+	var b = make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
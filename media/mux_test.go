@@ -0,0 +1,252 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// mp4Streams 构造视频与音频各3个分段的文件与索引
+func mp4Streams() (*Index, *Index, []byte, []byte) {
+	vinit, ainit := mkInit(1), mkInit(1)
+	vfile := append([]byte{}, vinit...)
+	afile := append([]byte{}, ainit...)
+	vi := &Index{Timescale: 1000, Init: vinit}
+	ai := &Index{Timescale: 1000, Init: ainit}
+	for i := 0; i < 3; i++ {
+		f := mkFrag(1, strings.Repeat("V", 10+i))
+		vi.Segments = append(vi.Segments, Segment{Time: uint64(i * 5000), Duration: 5000, Start: int64(len(vfile)), End: int64(len(vfile) + len(f) - 1)})
+		vfile = append(vfile, f...)
+		f = mkFrag(1, strings.Repeat("A", 3+i))
+		ai.Segments = append(ai.Segments, Segment{Time: uint64(i * 5000), Duration: 5000, Start: int64(len(afile)), End: int64(len(afile) + len(f) - 1)})
+		afile = append(afile, f...)
+	}
+	return vi, ai, vfile, afile
+}
+
+func TestMuxMp4(t *testing.T) {
+	vi, ai, vfile, afile := mp4Streams()
+	srv := upstream(map[string][]byte{"v": vfile, "a": afile})
+	defer srv.Close()
+	file, err := Mux(vi, ai, srv.URL+"?f=v", srv.URL+"?f=a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	if err = file.Serve(rec, httptest.NewRequest("GET", "/", nil), http.Client{}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := rec.Body.Bytes()
+	if int64(len(out)) != file.Size() || rec.Header().Get("Content-Length") != strconv.Itoa(len(out)) {
+		t.Fatal(len(out), file.Size())
+	}
+	var (
+		ids   []uint32
+		seqs  []uint32
+		traks int
+	)
+	eachBox(out, func(name string, b []byte) bool {
+		switch name {
+		case "moof":
+			ids = append(ids, binary.BigEndian.Uint32(findBox(b, "traf", "tfhd")[4:]))
+			seqs = append(seqs, binary.BigEndian.Uint32(findBox(b, "mfhd")[4:]))
+		case "moov":
+			eachBox(b, func(nm string, bb []byte) bool {
+				if nm == "trak" {
+					traks++
+					if id := binary.BigEndian.Uint32(findBox(bb, "tkhd")[12:]); id != uint32(traks) {
+						t.Error("tkhd id", id)
+					}
+				}
+				return true
+			})
+		}
+		return true
+	})
+	if traks != 2 || fmt.Sprint(ids) != "[1 2 1 2 1 2]" {
+		t.Fatal(traks, ids)
+	}
+	for i := 1; i < len(seqs); i++ {
+		if seqs[i] <= seqs[i-1] {
+			t.Fatal("sequence", seqs)
+		}
+	}
+	// mfro记录mfra的长度
+	mfra := int(binary.BigEndian.Uint32(out[len(out)-4:]))
+	if string(out[len(out)-mfra+4:len(out)-mfra+8]) != "mfra" {
+		t.Fatal("mfro", mfra)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=100-250")
+	rec = httptest.NewRecorder()
+	file.Serve(rec, req, http.Client{}, nil, nil)
+	if rec.Code != http.StatusPartialContent || !bytes.Equal(rec.Body.Bytes(), out[100:251]) {
+		t.Fatal(rec.Code, rec.Header())
+	}
+}
+
+func TestMuxStart(t *testing.T) {
+	vi, ai, _, _ := mp4Streams()
+	parts := interleave(vi, ai, 6)
+	if len(parts) != 4 || parts[0].seg.Time != 5000 || parts[1].track != 1 || parts[1].seg.Time != 5000 {
+		t.Fatal(parts)
+	}
+	if parts = interleave(&Index{Timescale: 1000}, ai, 0); len(parts) != 3 {
+		t.Fatal("no video segments", parts)
+	}
+}
+
+func TestMuxMalformed(t *testing.T) {
+	vi, ai, _, _ := mp4Streams()
+	if _, err := Mux(vi, &Index{WebM: true}, "", "", 0); err == nil {
+		t.Fatal("container mismatch")
+	}
+	// 截断的初始化段返回错误而不是panic
+	var init = vi.Init
+	for i := 0; i < len(init); i++ {
+		vi.Init = init[:i]
+		if _, err := Mux(vi, ai, "", "", 0); err == nil {
+			t.Error("truncated init at", i)
+		}
+	}
+	webm := &Index{WebM: true, Timescale: 1000, Init: el(idEBML)}
+	if _, err := Mux(webm, &Index{WebM: true, Timescale: 1000, Init: el(idEBML)}, "", "", 0); err == nil {
+		t.Fatal("webm without segment")
+	}
+	if _, err := Mux(webm, &Index{WebM: true, Timescale: 1}, "", "", 0); err == nil {
+		t.Fatal("timescale mismatch")
+	}
+}
+
+func TestRewriteFragments(t *testing.T) {
+	b := append(mkFrag(7, "abc"), mkFrag(7, "de")...)
+	if err := rewriteFragments(b, 2, 100); err != nil {
+		t.Fatal(err)
+	}
+	var ids, seqs []uint32
+	eachBox(b, func(name string, body []byte) bool {
+		if name == "moof" {
+			ids = append(ids, binary.BigEndian.Uint32(findBox(body, "traf", "tfhd")[4:]))
+			seqs = append(seqs, binary.BigEndian.Uint32(findBox(body, "mfhd")[4:]))
+		}
+		return true
+	})
+	if fmt.Sprint(ids, seqs) != "[2 2] [100 101]" {
+		t.Fatal(ids, seqs)
+	}
+	// track为0时不修改track_ID
+	b = mkFrag(7, "x")
+	rewriteFragments(b, 0, 1)
+	if binary.BigEndian.Uint32(findBox(b, "moof", "traf", "tfhd")[4:]) != 7 {
+		t.Fatal("track changed")
+	}
+	var cases = []struct {
+		name string
+		data []byte
+	}{
+		{"size past end", mkFrag(1, "x")[:20]},
+		{"size smaller than header", []byte{0, 0, 0, 4, 'm', 'o', 'o', 'f'}},
+	}
+	for _, c := range cases {
+		if err := rewriteFragments(c.data, 1, 1); err == nil {
+			t.Error(c.name)
+		}
+	}
+}
+
+func TestSetTkhdID(t *testing.T) {
+	v0 := box("trak", box("tkhd", make([]byte, 84)))[8:]
+	v1 := box("trak", box("tkhd", append([]byte{1}, make([]byte, 95)...)))[8:]
+	if err := setTkhdID(v0, 5); err != nil || binary.BigEndian.Uint32(findBox(v0, "tkhd")[12:]) != 5 {
+		t.Fatal("v0", err)
+	}
+	if err := setTkhdID(v1, 5); err != nil || binary.BigEndian.Uint32(findBox(v1, "tkhd")[20:]) != 5 {
+		t.Fatal("v1", err)
+	}
+	if err := setTkhdID(box("tkhd", make([]byte, 10)), 5); err == nil {
+		t.Fatal("short tkhd")
+	}
+}
+
+func TestMuxWebm(t *testing.T) {
+	mk := func() []byte {
+		info := el(idInfo, el(idTimecodeScale, u(1000000)))
+		tr := el(idTracks, el(idTrackEntry, el(idTrackNumber, []byte{1}), el(idTrackUID, u(77))))
+		seg := []byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+		return append(append(append(el(idEBML, el(0x4282, []byte("webm"))), seg...), info...), tr...)
+	}
+	vinit, ainit := mk(), mk()
+	vfile, afile := append([]byte{}, vinit...), append([]byte{}, ainit...)
+	vi := &Index{WebM: true, Timescale: 1000, Init: vinit}
+	ai := &Index{WebM: true, Timescale: 1000, Init: ainit}
+	for i := 0; i < 2; i++ {
+		c := el(idCluster, el(0xE7, u(uint64(i*5000))), el(idSimpleBlock, []byte{0x81, 0, 0, 0x80, 'v'}))
+		vi.Segments = append(vi.Segments, Segment{Time: uint64(i * 5000), Start: int64(len(vfile)), End: int64(len(vfile) + len(c) - 1)})
+		vfile = append(vfile, c...)
+		c = el(idCluster, el(0xE7, u(uint64(i*5000))), el(idBlockGroup, el(idBlock, []byte{0x81, 0, 0, 0x80, 'a'})))
+		ai.Segments = append(ai.Segments, Segment{Time: uint64(i * 5000), Start: int64(len(afile)), End: int64(len(afile) + len(c) - 1)})
+		afile = append(afile, c...)
+	}
+	srv := upstream(map[string][]byte{"v": vfile, "a": afile})
+	defer srv.Close()
+	file, err := Mux(vi, ai, srv.URL+"?f=v", srv.URL+"?f=a", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	file.Serve(rec, httptest.NewRequest("GET", "/", nil), http.Client{}, nil, nil)
+	out := rec.Body.Bytes()
+	off, _, _, err := webmInfo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		blocks   []byte
+		clusters []int64
+		cues     []Segment
+		tracks   []uint64
+	)
+	eachElement(out[off:], func(e element, o int, d []byte) bool {
+		switch e.ID {
+		case idCluster:
+			clusters = append(clusters, off+int64(o))
+			eachElement(d, func(e element, _ int, d []byte) bool {
+				if e.ID == idSimpleBlock {
+					blocks = append(blocks, d[0], d[4])
+				}
+				if e.ID == idBlockGroup {
+					eachElement(d, func(e element, _ int, d []byte) bool {
+						blocks = append(blocks, d[0], d[4])
+						return true
+					})
+				}
+				return true
+			})
+		case idCues:
+			cues, _ = ParseCues(out[off+int64(o):], off, 0, 0)
+		case idTracks:
+			eachElement(d, func(e element, _ int, d []byte) bool {
+				eachElement(d, func(e element, _ int, d []byte) bool {
+					if e.ID == idTrackNumber {
+						tracks = append(tracks, readUint(d))
+					}
+					return true
+				})
+				return true
+			})
+		}
+		return true
+	})
+	if string(blocks) != "\x81v\x82a\x81v\x82a" || fmt.Sprint(tracks) != "[1 2]" {
+		t.Fatalf("%q %v", blocks, tracks)
+	}
+	// Cues指向视频的Cluster
+	if len(cues) != 2 || cues[0].Start != clusters[0] || cues[1].Start != clusters[2] {
+		t.Fatal(cues, clusters)
+	}
+}
@@ -0,0 +1,200 @@
+package media
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// sidx 构造sidx box,version为1时使用64位的earliest与first_offset
+func sidx(version byte, timescale uint32, first uint32, refs ...uint32) []byte {
+	body := []byte{version, 0, 0, 0}
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, timescale)
+	if version == 0 {
+		body = binary.BigEndian.AppendUint32(body, 0)
+		body = binary.BigEndian.AppendUint32(body, first)
+	} else {
+		body = binary.BigEndian.AppendUint64(body, 0)
+		body = binary.BigEndian.AppendUint64(body, uint64(first))
+	}
+	body = append(body, 0, 0, 0, byte(len(refs)))
+	for _, r := range refs {
+		body = binary.BigEndian.AppendUint32(body, r)
+		body = binary.BigEndian.AppendUint32(body, 5000)
+		body = binary.BigEndian.AppendUint32(body, 0x90000000)
+	}
+	return box("sidx", body)
+}
+
+func TestParseSidx(t *testing.T) {
+	for _, version := range []byte{0, 1} {
+		b := append(box("free", []byte("xx")), sidx(version, 1000, 10, 100, 200)...)
+		ts, segs, err := ParseSidx(b, 700)
+		if err != nil || ts != 1000 || len(segs) != 2 {
+			t.Fatal(version, ts, segs, err)
+		}
+		end := int64(700+len(b)) + 10
+		if segs[0].Start != end || segs[0].End != end+99 || segs[1].Start != end+100 || segs[1].End != end+299 || segs[1].Time != 5000 || segs[1].Duration != 5000 {
+			t.Fatal(version, segs)
+		}
+	}
+}
+
+func TestParseSidxMalformed(t *testing.T) {
+	var (
+		valid = sidx(0, 1000, 0, 100, 200)
+		hier  = sidx(0, 1000, 0, 0x80000064)
+		big   = append([]byte{}, valid...)
+		count = append([]byte{}, valid...)
+		large = append([]byte{0, 0, 0, 1}, "sidx"...)
+	)
+	binary.BigEndian.PutUint32(big, uint32(len(valid)+100))
+	binary.BigEndian.PutUint16(count[8+22:], 1000)
+	large = binary.BigEndian.AppendUint64(large, math.MaxUint64)
+	var cases = []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"no sidx", box("moof", make([]byte, 20))},
+		{"hierarchical", hier},
+		{"box size past end", big},
+		{"reference count past end", count},
+		{"64bit size overflow", large},
+		{"size smaller than header", []byte{0, 0, 0, 4, 's', 'i', 'd', 'x'}},
+	}
+	for _, c := range cases {
+		if _, _, err := ParseSidx(c.data, 0); err == nil {
+			t.Error(c.name, "no error")
+		}
+	}
+	// 任意位置截断都应返回错误而不是panic
+	for i := 0; i < len(valid); i++ {
+		if _, _, err := ParseSidx(valid[:i], 0); err == nil {
+			t.Error("truncated at", i)
+		}
+	}
+}
+
+func TestReadVint(t *testing.T) {
+	var cases = []struct {
+		data []byte
+		keep bool
+		v    uint64
+		n    int
+		ok   bool
+	}{
+		{[]byte{0x81}, false, 1, 1, true},
+		{[]byte{0x81}, true, 0x81, 1, true},
+		{[]byte{0x40, 0x02}, false, 2, 2, true},
+		{[]byte{0x1A, 0x45, 0xDF, 0xA3}, true, idEBML, 4, true},
+		{[]byte{0x01, 0, 0, 0, 0, 0, 0, 5}, false, 5, 8, true},
+		{[]byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false, 1<<56 - 1, 8, true},
+		{[]byte{0x40}, false, 0, 0, false},
+		{[]byte{0x01, 0, 0}, false, 0, 0, false},
+		{[]byte{0x00, 0x81}, false, 0, 0, false},
+		{nil, false, 0, 0, false},
+	}
+	for _, c := range cases {
+		v, n, err := readVint(c.data, c.keep)
+		if (err == nil) != c.ok || v != c.v || n != c.n {
+			t.Errorf("%x %v %v %v", c.data, v, n, err)
+		}
+	}
+}
+
+func TestReadElement(t *testing.T) {
+	e, err := readElement([]byte{0xEC, 0x85})
+	if err != nil || e.ID != idVoid || e.Size != 5 || e.Header != 2 {
+		t.Fatal(e, err)
+	}
+	// 全1的长度表示未知
+	e, err = readElement([]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	if err != nil || e.ID != idSegment || e.Size != -1 || e.Header != 12 {
+		t.Fatal(e, err)
+	}
+	if _, err = readElement([]byte{0x18, 0x53}); err == nil {
+		t.Fatal("truncated id")
+	}
+	if _, err = readElement([]byte{0xEC}); err == nil {
+		t.Fatal("missing size")
+	}
+}
+
+func TestEachElement(t *testing.T) {
+	var ids []uint64
+	// 第二个元素的长度超出数据,data截取到末尾
+	data := append(el(idVoid, []byte("ab")), 0xBB, 0x8A, 'x')
+	err := eachElement(data, func(e element, offset int, d []byte) bool {
+		ids = append(ids, e.ID)
+		if e.ID == idCuePoint && string(d) != "x" {
+			t.Fatal(d)
+		}
+		return true
+	})
+	if err != nil || len(ids) != 2 {
+		t.Fatal(ids, err)
+	}
+	if err = eachElement([]byte{0xEC, 0x81, 0, 0x00}, func(element, int, []byte) bool { return true }); err == nil {
+		t.Fatal("bad vint after first element")
+	}
+}
+
+// webmFixture 返回初始化段,Cues与Segment数据的起始偏移
+func webmFixture() ([]byte, []byte, int64) {
+	hdr := el(idEBML, el(0x4282, []byte("webm")))
+	info := el(idInfo, el(idTimecodeScale, u(1000000)), el(idDuration, binary.BigEndian.AppendUint64(nil, math.Float64bits(12000))))
+	segHead := []byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	init := append(append(append([]byte{}, hdr...), segHead...), info...)
+	cues := el(idCues,
+		el(idCuePoint, el(idCueTime, u(0)), el(idCueTrackPos, el(0xF7, u(1)), el(idCueClusterPos, u(500)))),
+		el(idCuePoint, el(idCueTime, u(5000)), el(idCueTrackPos, el(0xF7, u(1)), el(idCueClusterPos, u(900)))),
+	)
+	return init, cues, int64(len(hdr) + len(segHead))
+}
+
+func TestWebmInfo(t *testing.T) {
+	init, _, segOffset := webmFixture()
+	off, scale, dur, err := webmInfo(init)
+	if err != nil || off != segOffset || scale != 1000 || dur != 12000 {
+		t.Fatal(off, scale, dur, err)
+	}
+	if _, _, _, err = webmInfo(el(idEBML)); err == nil {
+		t.Fatal("segment not found")
+	}
+	zero := append(append([]byte{}, init[:segOffset]...), el(idInfo, el(idTimecodeScale, u(0)))...)
+	if _, _, _, err = webmInfo(zero); err == nil {
+		t.Fatal("zero timecode scale")
+	}
+	for i := 0; i < len(init); i++ {
+		webmInfo(init[:i])
+	}
+}
+
+func TestParseCues(t *testing.T) {
+	init, cues, _ := webmFixture()
+	off, _, dur, _ := webmInfo(init)
+	segs, err := ParseCues(cues, off, 5000, dur)
+	if err != nil || len(segs) != 2 {
+		t.Fatal(segs, err)
+	}
+	if segs[0].Start != off+500 || segs[0].End != off+899 || segs[0].Duration != 5000 || segs[1].End != 4999 || segs[1].Duration != 7000 {
+		t.Fatal(segs)
+	}
+	if _, err = ParseCues(el(idVoid), 0, 0, 0); err == nil {
+		t.Fatal("cues not found")
+	}
+	// 没有CueClusterPosition的CuePoint忽略,同一位置的CuePoint合并
+	dup := el(idCues,
+		el(idCuePoint, el(idCueTime, u(0)), el(idCueTrackPos, el(idCueClusterPos, u(10)))),
+		el(idCuePoint, el(idCueTime, u(100)), el(idCueTrackPos, el(idCueClusterPos, u(10)))),
+		el(idCuePoint, el(idCueTime, u(200))),
+	)
+	if segs, err = ParseCues(dup, 0, 100, 0); err != nil || len(segs) != 1 || segs[0].End != 99 {
+		t.Fatal(segs, err)
+	}
+	for i := 0; i < len(cues); i++ {
+		ParseCues(cues[:i], off, 5000, dur)
+	}
+}
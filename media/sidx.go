@@ -0,0 +1,101 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Segment 媒体分段,Time与Duration以Timescale为单位,Start与End为文件内的字节偏移(包含End)
+type Segment struct {
+	Time     uint64
+	Duration uint64
+	Start    int64
+	End      int64
+}
+
+// ParseSidx 解析ISO-BMFF的sidx box,offset为data在文件中的起始位置,返回timescale与分段列表
+func ParseSidx(data []byte, offset int64) (uint64, []Segment, error) {
+	for pos := 0; pos+8 <= len(data); {
+		size, header := boxSize(data[pos:])
+		if size == 0 {
+			size = len(data) - pos
+		}
+		if size < header || pos+size > len(data) {
+			return 0, nil, fmt.Errorf("bad box size %d at %d", size, offset+int64(pos))
+		}
+		if string(data[pos+4:pos+8]) == "sidx" {
+			return parseSidxBox(data[pos+header:pos+size], offset+int64(pos+size))
+		}
+		pos += size
+	}
+	return 0, nil, fmt.Errorf("sidx not found")
+}
+
+// end 为sidx box结束位置,first_offset以此为基准
+func parseSidxBox(b []byte, end int64) (uint64, []Segment, error) {
+	if len(b) < 12 {
+		return 0, nil, fmt.Errorf("sidx too short")
+	}
+	var (
+		version   = b[0]
+		timescale = uint64(binary.BigEndian.Uint32(b[8:12]))
+		earliest  uint64
+		first     uint64
+		pos       = 12
+	)
+	if version == 0 {
+		if len(b) < pos+8 {
+			return 0, nil, fmt.Errorf("sidx too short")
+		}
+		earliest = uint64(binary.BigEndian.Uint32(b[pos:]))
+		first = uint64(binary.BigEndian.Uint32(b[pos+4:]))
+		pos += 8
+	} else {
+		if len(b) < pos+16 {
+			return 0, nil, fmt.Errorf("sidx too short")
+		}
+		earliest = binary.BigEndian.Uint64(b[pos:])
+		first = binary.BigEndian.Uint64(b[pos+8:])
+		pos += 16
+	}
+	if len(b) < pos+4 {
+		return 0, nil, fmt.Errorf("sidx too short")
+	}
+	var count = int(binary.BigEndian.Uint16(b[pos+2:]))
+	pos += 4
+	if len(b) < pos+count*12 {
+		return 0, nil, fmt.Errorf("sidx reference count %d out of range", count)
+	}
+	var (
+		segments = make([]Segment, 0, count)
+		start    = end + int64(first)
+		t        = earliest
+	)
+	for i := 0; i < count; i++ {
+		var (
+			ref      = binary.BigEndian.Uint32(b[pos:])
+			duration = uint64(binary.BigEndian.Uint32(b[pos+4:]))
+			size     = int64(ref & 0x7fffffff)
+		)
+		if ref&0x80000000 != 0 {
+			return 0, nil, fmt.Errorf("hierarchical sidx not supported")
+		}
+		segments = append(segments, Segment{Time: t, Duration: duration, Start: start, End: start + size - 1})
+		start += size
+		t += duration
+		pos += 12
+	}
+	return timescale, segments, nil
+}
+
+// boxSize 返回box总长度与头部长度
+func boxSize(b []byte) (int, int) {
+	var size = uint64(binary.BigEndian.Uint32(b))
+	if size == 1 {
+		if len(b) < 16 {
+			return 0, 16
+		}
+		return int(binary.BigEndian.Uint64(b[8:])), 16
+	}
+	return int(size), 8
+}
@@ -0,0 +1,255 @@
+package media
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// matroska track element id
+const (
+	idTracks          = 0x1654AE6B
+	idTrackEntry      = 0xAE
+	idDefaultDuration = 0x23E383
+	idVideo           = 0xE0
+	idPixelWidth      = 0xB0
+	idPixelHeight     = 0xBA
+	idColour          = 0x55B0
+	idMatrix          = 0x55B1
+	idTransfer        = 0x55BA
+	idPrimaries       = 0x55BB
+	idAudio           = 0xE1
+	idSamplingFreq    = 0xB5
+	idChannels        = 0x9F
+)
+
+// Track 从初始化段中解析出的轨道信息,未知的字段为0
+type Track struct {
+	Width      int
+	Height     int
+	FrameRate  float64
+	SampleRate int
+	Channels   int
+	Primaries  int
+	Transfer   int
+	Matrix     int
+}
+
+// FrameRateString 输出mpd中frameRate的格式,如 60 或 30000/1001
+func (t Track) FrameRateString() string {
+	if t.FrameRate <= 0 {
+		return ""
+	}
+	if n := math.Round(t.FrameRate); math.Abs(t.FrameRate-n) < 0.01 {
+		return fmt.Sprintf("%d", int(n))
+	}
+	if n := math.Round(t.FrameRate * 1.001); math.Abs(t.FrameRate*1.001-n) < 0.01 {
+		return fmt.Sprintf("%d/1001", int(n)*1000)
+	}
+	return fmt.Sprintf("%.3f", t.FrameRate)
+}
+
+// ParseTrack 解析初始化段中的第一个轨道, mp4 为 moov/trak, webm 为 Tracks/TrackEntry
+func ParseTrack(webm bool, init []byte) (Track, error) {
+	if webm {
+		return parseWebmTrack(init)
+	}
+	return parseMp4Track(init)
+}
+
+// findBox 按路径查找box,返回box的内容(不含头部)
+func findBox(b []byte, path ...string) []byte {
+	for _, name := range path {
+		var found []byte
+		eachBox(b, func(t string, body []byte) bool {
+			if t == name {
+				found = body
+				return false
+			}
+			return true
+		})
+		if found == nil {
+			return nil
+		}
+		b = found
+	}
+	return b
+}
+
+// eachBox 遍历同级box,回调返回false时停止
+func eachBox(b []byte, fn func(t string, body []byte) bool) {
+	for pos := 0; pos+8 <= len(b); {
+		size, header := boxSize(b[pos:])
+		if size == 0 {
+			size = len(b) - pos
+		}
+		if size < header || pos+size > len(b) {
+			return
+		}
+		if !fn(string(b[pos+4:pos+8]), b[pos+header:pos+size]) {
+			return
+		}
+		pos += size
+	}
+}
+
+func parseMp4Track(init []byte) (Track, error) {
+	var (
+		t    Track
+		trak = findBox(init, "moov", "trak")
+	)
+	if trak == nil {
+		return t, fmt.Errorf("trak not found")
+	}
+	if tkhd := findBox(trak, "tkhd"); len(tkhd) >= 84 {
+		var off = 76
+		if tkhd[0] == 1 {
+			off = 88
+		}
+		if len(tkhd) >= off+8 {
+			t.Width = int(binary.BigEndian.Uint32(tkhd[off:]) >> 16)
+			t.Height = int(binary.BigEndian.Uint32(tkhd[off+4:]) >> 16)
+		}
+	}
+	var timescale uint32
+	if mdhd := findBox(trak, "mdia", "mdhd"); len(mdhd) >= 24 {
+		if mdhd[0] == 1 {
+			timescale = binary.BigEndian.Uint32(mdhd[20:])
+		} else {
+			timescale = binary.BigEndian.Uint32(mdhd[12:])
+		}
+	}
+	if trex := findBox(init, "moov", "mvex", "trex"); len(trex) >= 20 && timescale > 0 {
+		if d := binary.BigEndian.Uint32(trex[12:]); d > 0 {
+			t.FrameRate = float64(timescale) / float64(d)
+		}
+	}
+	var stsd = findBox(trak, "mdia", "minf", "stbl", "stsd")
+	if len(stsd) < 16 {
+		return t, fmt.Errorf("stsd not found")
+	}
+	var (
+		entry = stsd[8:]
+		kind  = string(entry[4:8])
+	)
+	size, header := boxSize(entry)
+	if size < header || size > len(entry) {
+		return t, fmt.Errorf("bad sample entry")
+	}
+	var body = entry[header:size]
+	switch kind {
+	case "mp4a", "Opus", "ac-3", "ec-3":
+		t.FrameRate = 0
+		if len(body) >= 28 {
+			t.Channels = int(binary.BigEndian.Uint16(body[16:]))
+			t.SampleRate = int(binary.BigEndian.Uint32(body[24:]) >> 16)
+		}
+	default:
+		if len(body) < 78 {
+			return t, fmt.Errorf("bad visual sample entry")
+		}
+		if t.Width == 0 {
+			t.Width = int(binary.BigEndian.Uint16(body[24:]))
+			t.Height = int(binary.BigEndian.Uint16(body[26:]))
+		}
+		eachBox(body[78:], func(name string, b []byte) bool {
+			switch name {
+			case "colr":
+				if len(b) >= 10 && string(b[:4]) == "nclx" {
+					t.Primaries = int(binary.BigEndian.Uint16(b[4:]))
+					t.Transfer = int(binary.BigEndian.Uint16(b[6:]))
+					t.Matrix = int(binary.BigEndian.Uint16(b[8:]))
+				}
+			case "vpcC":
+				if len(b) >= 10 && b[0] == 1 && t.Transfer == 0 {
+					t.Primaries = int(b[7])
+					t.Transfer = int(b[8])
+					t.Matrix = int(b[9])
+				}
+			}
+			return true
+		})
+	}
+	return t, nil
+}
+
+func parseWebmTrack(init []byte) (Track, error) {
+	var (
+		t     Track
+		found bool
+	)
+	err := eachElement(init, func(e element, _ int, data []byte) bool {
+		if e.ID != idSegment {
+			return true
+		}
+		eachElement(data, func(e element, _ int, data []byte) bool {
+			if e.ID != idTracks {
+				return e.ID != idCluster
+			}
+			eachElement(data, func(e element, _ int, data []byte) bool {
+				if e.ID != idTrackEntry {
+					return true
+				}
+				found = true
+				parseTrackEntry(data, &t)
+				return false
+			})
+			return false
+		})
+		return false
+	})
+	if err != nil {
+		return t, err
+	}
+	if !found {
+		return t, fmt.Errorf("track entry not found")
+	}
+	return t, nil
+}
+
+func parseTrackEntry(data []byte, t *Track) {
+	eachElement(data, func(e element, _ int, data []byte) bool {
+		switch e.ID {
+		case idDefaultDuration:
+			if d := readUint(data); d > 0 {
+				t.FrameRate = 1e9 / float64(d)
+			}
+		case idVideo:
+			eachElement(data, func(e element, _ int, data []byte) bool {
+				switch e.ID {
+				case idPixelWidth:
+					t.Width = int(readUint(data))
+				case idPixelHeight:
+					t.Height = int(readUint(data))
+				case idColour:
+					eachElement(data, func(e element, _ int, data []byte) bool {
+						switch e.ID {
+						case idPrimaries:
+							t.Primaries = int(readUint(data))
+						case idTransfer:
+							t.Transfer = int(readUint(data))
+						case idMatrix:
+							t.Matrix = int(readUint(data))
+						}
+						return true
+					})
+				}
+				return true
+			})
+		case idAudio:
+			eachElement(data, func(e element, _ int, data []byte) bool {
+				switch e.ID {
+				case idSamplingFreq:
+					t.SampleRate = int(readFloat(data))
+				case idChannels:
+					t.Channels = int(readUint(data))
+				}
+				return true
+			})
+		}
+		return true
+	})
+	if t.SampleRate > 0 {
+		t.FrameRate = 0
+	}
+}
@@ -0,0 +1,196 @@
+package request
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"time"
+)
+
+// googlevideo对大范围请求限速,按此大小分块请求
+const chunkSize int64 = 2 << 20
+
+type chunkResult struct {
+	data    *bytes.Buffer
+	headers http.Header
+	status  int
+	err     error
+}
+
+// streamSize 上游流地址中带有clen参数,据此判断是否可以分块请求
+func streamSize(url string) int64 {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.ParseInt(u.Query().Get("clen"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// pipeChunked 将请求的区间拆分为多个&range=子请求,当前块输出时预取下一块,拼接为一个连续的响应
+// 条件请求头只随第一块转发,上游返回304时直接响应304
+func pipeChunked(w http.ResponseWriter, r *http.Request, url string, client http.Client, rewriteHeader func(http.Header, http.Header), refresh func() (string, error), size int64) error {
+	var (
+		start, end = int64(0), size - 1
+		status     = http.StatusOK
+		to         = w.Header()
+		ok         bool
+	)
+	if rg := r.Header.Get("Range"); rg != "" {
+		if start, end, ok = ParseRange(rg, size); !ok {
+			to.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			http.Error(w, "range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+		status = http.StatusPartialContent
+		to.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+	var (
+		ctx     = r.Context()
+		headers = copyHeader(r.Header, http.Header{}, []string{"User-Agent", "Accept-Language"})
+		chunks  = &ChunkFetcher{URL: url, Client: client, Refresh: refresh}
+		fetch   = func(a int64, b int64, headers http.Header) chunkResult {
+			data, h, s, err := chunks.Fetch(ctx, a, b, headers)
+			return chunkResult{data, h, s, err}
+		}
+		first = fetch(start, min64(start+chunkSize-1, end), copyHeader(r.Header, headers.Clone(), []string{"If-None-Match", "If-Modified-Since"}))
+	)
+	if first.status == http.StatusNotModified {
+		copyHeader(first.headers, to, []string{"Last-Modified", "Etag"})
+		to.Set("Access-Control-Allow-Origin", "*")
+		to.Set("Cache-Control", "public, max-age=864000")
+		if rewriteHeader != nil {
+			rewriteHeader(first.headers, to)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if first.err != nil {
+		http.Error(w, first.err.Error(), http.StatusInternalServerError)
+		return first.err
+	}
+	copyHeader(first.headers, to, []string{"Content-Type", "Last-Modified", "Etag"})
+	to.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	to.Set("Accept-Ranges", "bytes")
+	to.Set("Access-Control-Allow-Origin", "*")
+	to.Set("Access-Control-Max-Age", "864000")
+	if rhead := r.Header.Get("Access-Control-Request-Headers"); rhead != "" {
+		to.Set("Access-Control-Allow-Headers", rhead)
+	}
+	to.Set("Cache-Control", "public, max-age=864000")
+	if rewriteHeader != nil {
+		rewriteHeader(first.headers, to)
+	}
+	w.WriteHeader(status)
+	var next = make(chan chunkResult, 1)
+	go func() {
+		defer close(next)
+		for a := start + chunkSize; a <= end; a += chunkSize {
+			var res = fetch(a, min64(a+chunkSize-1, end), headers)
+			select {
+			case next <- res:
+			case <-ctx.Done():
+				PutBuffer(res.data)
+				return
+			}
+			if res.err != nil {
+				return
+			}
+		}
+	}()
+	var res = first
+	for {
+		_, err := w.Write(res.data.Bytes())
+		PutBuffer(res.data)
+		if err != nil {
+			drain(next)
+			return err
+		}
+		var more bool
+		if res, more = <-next; !more {
+			return nil
+		}
+		if res.err != nil {
+			return res.err
+		}
+	}
+}
+
+// ChunkFetcher 分块请求同一个上游流地址,地址过期时调用一次Refresh,之后的块使用新地址,不能并发使用
+type ChunkFetcher struct {
+	URL     string
+	Client  http.Client
+	Refresh func() (string, error)
+}
+
+// Fetch 请求[start,end]区间,连接中断等错误退避后重试,返回的buffer需要PutBuffer归还
+func (f *ChunkFetcher) Fetch(ctx context.Context, start int64, end int64, headers http.Header) (*bytes.Buffer, http.Header, int, error) {
+	data, h, s, err := getChunk(ctx, f.URL, f.Client, headers, start, end)
+	if Expired(s) && f.Refresh != nil {
+		var url string
+		if url, err = f.Refresh(); err != nil {
+			return nil, nil, 0, err
+		}
+		f.URL, f.Refresh = url, nil
+		data, h, s, err = getChunk(ctx, f.URL, f.Client, headers, start, end)
+	}
+	for i := 1; err != nil && s == 0 && i <= resumeRetry && ctx.Err() == nil; i++ {
+		select {
+		case <-time.After(resumeBackoff * time.Duration(i)):
+		case <-ctx.Done():
+			return nil, nil, 0, ctx.Err()
+		}
+		data, h, s, err = getChunk(ctx, f.URL, f.Client, headers, start, end)
+	}
+	return data, h, s, err
+}
+
+// getChunk 请求[start,end]区间,返回的数据长度必须与区间一致,连接错误时状态码为0
+func getChunk(ctx context.Context, url string, client http.Client, reqHeaders http.Header, start int64, end int64) (*bytes.Buffer, http.Header, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s&range=%d-%d", url, start, end), nil)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	req.Header = reqHeaders
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, res.Header, res.StatusCode, fmt.Errorf("%d-%d : %s", start, end, res.Status)
+	}
+	var buffer = bufferPool.Get().(*bytes.Buffer)
+	buffer.Reset()
+	if _, err = buffer.ReadFrom(res.Body); err != nil {
+		PutBuffer(buffer)
+		return nil, res.Header, 0, err
+	}
+	if int64(buffer.Len()) != end-start+1 {
+		PutBuffer(buffer)
+		return nil, res.Header, 0, fmt.Errorf("%d-%d : got %d bytes", start, end, buffer.Len())
+	}
+	return buffer, res.Header, res.StatusCode, nil
+}
+
+// drain 释放已预取的块
+func drain(next chan chunkResult) {
+	go func() {
+		for res := range next {
+			PutBuffer(res.data)
+		}
+	}()
+}
+
+func min64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,63 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// etagServer 按range参数输出,If-None-Match与etag一致时返回304,同时记录每个请求是否带有条件请求头
+func etagServer(data []byte, etag string) (*httptest.Server, *[]bool) {
+	var (
+		mu    sync.Mutex
+		conds []bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conds = append(conds, r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "")
+		mu.Unlock()
+		w.Header().Set("Etag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		var a, b int
+		fmt.Sscanf(r.URL.Query().Get("range"), "%d-%d", &a, &b)
+		w.Write(data[a : b+1])
+	}))
+	return srv, &conds
+}
+
+func TestPipeChunkedConditional(t *testing.T) {
+	var data = testData(int(chunkSize) + 100)
+	srv, conds := etagServer(data, `"v1"`)
+	defer srv.Close()
+	var url = fmt.Sprintf("%s/?clen=%d", srv.URL, len(data))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rec := httptest.NewRecorder()
+	if err := Pipe(rec, req, url, *srv.Client(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("Etag") != `"v1"` || len(*conds) != 1 {
+		t.Fatal(rec.Code, rec.Body.Len(), rec.Header(), *conds)
+	}
+
+	// 不一致时正常输出,条件请求头只随第一块转发
+	*conds = nil
+	req.Header.Set("If-None-Match", `"v0"`)
+	rec = httptest.NewRecorder()
+	if err := Pipe(rec, req, url, *srv.Client(), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatal(rec.Code, rec.Body.Len())
+	}
+	if len(*conds) != 2 || !(*conds)[0] || (*conds)[1] {
+		t.Fatal(*conds)
+	}
+}
@@ -0,0 +1,376 @@
+package request
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/suconghou/videoproxy/store"
+	"github.com/suconghou/videoproxy/util"
+)
+
+// 清理过期缓存的最小间隔(秒)
+const cleanInterval = 5
+
+// 上游未给出缓存头时的默认缓存时间(秒)
+const defaultTTL = 86400
+
+// cacheItem done关闭之后data等字段只读,data为独立的副本,不会放回bufferPool
+// expire为软过期,hard为硬过期,两者之间返回旧数据并在后台刷新
+// expire,hard,refreshing,failed,size与el由LockGeter的锁保护
+type cacheItem struct {
+	url        string
+	expire     int64
+	hard       int64
+	refreshing bool
+	failed     bool
+	done       chan struct{}
+	data       []byte
+	headers    http.Header
+	status     int
+	err        error
+	size       int64
+	el         *list.Element
+}
+
+// CacheStats 缓存的命中,未命中,淘汰次数与占用的字节数,条目数
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Stale     int64 `json:"stale"`
+	Bytes     int64 `json:"bytes"`
+	Entries   int   `json:"entries"`
+}
+
+// storedItem 写入共享存储的200响应
+type storedItem struct {
+	Expire  int64       `json:"expire"`
+	Headers http.Header `json:"headers"`
+	Data    []byte      `json:"data"`
+}
+
+// LockGeter for http cache & lock get, concurrent gets of the same url share one upstream request
+// 超出maxBytes或maxEntries时按LRU淘汰;store不为nil时本地未命中先查共享存储,请求成功后写入
+type LockGeter struct {
+	mu         sync.Mutex
+	last       int64
+	items      map[string]*cacheItem
+	lru        *list.List
+	maxBytes   int64
+	maxEntries int
+	stats      CacheStats
+	store      store.Store
+}
+
+var (
+	HttpProvider = newHTTPProvider()
+	// 请求出错或非200响应的缓存时间(秒),HTTP_CACHE_ERROR_TTL默认30
+	errorTTL = envInt("HTTP_CACHE_ERROR_TTL", 30)
+	// 软过期后仍可返回旧数据并后台刷新的时间(秒),HTTP_CACHE_STALE默认3600
+	staleTTL = envInt("HTTP_CACHE_STALE", 3600)
+	// 后台刷新失败时,从软过期起继续返回旧数据的时间(秒),HTTP_CACHE_STALE_IF_ERROR默认86400
+	staleIfError = envInt("HTTP_CACHE_STALE_IF_ERROR", 86400)
+)
+
+func envInt(name string, def int64) int64 {
+	if n, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil && n >= 0 {
+		return n
+	}
+	return def
+}
+
+func newHTTPProvider() *LockGeter {
+	size, entries := httpCacheLimit()
+	return NewLockGeter(size, entries, store.Shared)
+}
+
+// httpCacheLimit HTTP_CACHE_SIZE单位MB,默认64;HTTP_CACHE_ENTRIES默认10000
+func httpCacheLimit() (int64, int) {
+	var (
+		size    int64 = 64
+		entries       = 10000
+	)
+	if n, err := strconv.ParseInt(os.Getenv("HTTP_CACHE_SIZE"), 10, 64); err == nil && n > 0 {
+		size = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("HTTP_CACHE_ENTRIES")); err == nil && n > 0 {
+		entries = n
+	}
+	return size << 20, entries
+}
+
+// NewLockGeter create new lockgeter, s可以为nil
+func NewLockGeter(maxBytes int64, maxEntries int, s store.Store) *LockGeter {
+	return &LockGeter{
+		items:      map[string]*cacheItem{},
+		lru:        list.New(),
+		maxBytes:   maxBytes,
+		maxEntries: maxEntries,
+		store:      s,
+	}
+}
+
+// Get 命中缓存或等待正在进行的请求,ctx取消时不再等待,上游请求不受影响,结果仍会缓存
+// ttl大于0时覆盖上游的缓存头,为0时根据上游Cache-Control/Expires计算;出错或非200响应只缓存errorTTL
+// 软过期后硬过期前直接返回旧数据,同时只有一个后台刷新
+func (l *LockGeter) Get(ctx context.Context, url string, client http.Client, reqHeaders http.Header, ttl int64) ([]byte, http.Header, int, error) {
+	var now = time.Now().Unix()
+	l.mu.Lock()
+	l.clean(now)
+	v, ok := l.items[url]
+	if ok && v.expire < now && v.hard >= now && v.loaded() {
+		l.lru.MoveToFront(v.el)
+		l.stats.Stale++
+		if !v.refreshing {
+			v.refreshing = true
+			go l.refresh(v, client, reqHeaders, ttl)
+		}
+		l.mu.Unlock()
+		return v.data, v.headers, v.status, v.err
+	}
+	if !ok || (v.hard < now && v.loaded()) {
+		if ok {
+			l.remove(v)
+		}
+		v = &cacheItem{url: url, done: make(chan struct{})}
+		v.el = l.lru.PushFront(v)
+		l.items[url] = v
+		l.stats.Misses++
+		l.evict()
+		go l.load(v, client, reqHeaders, ttl)
+	} else {
+		l.lru.MoveToFront(v.el)
+		l.stats.Hits++
+	}
+	l.mu.Unlock()
+	select {
+	case <-v.done:
+		return v.data, v.headers, v.status, v.err
+	case <-ctx.Done():
+		return nil, nil, 0, ctx.Err()
+	}
+}
+
+// load 请求完成后复制数据并归还buffer,计入占用后关闭done
+func (l *LockGeter) load(v *cacheItem, client http.Client, reqHeaders http.Header, ttl int64) {
+	defer close(v.done)
+	ttl = l.fetch(v, client, reqHeaders, ttl)
+	l.mu.Lock()
+	v.setExpire(time.Now().Unix(), ttl)
+	// 加载期间可能已被淘汰
+	if l.items[v.url] == v {
+		l.account(v)
+	}
+	l.mu.Unlock()
+}
+
+// refresh 后台刷新软过期的条目,成功时替换为新条目,失败时保留旧数据至软过期后staleIfError,期间每errorTTL重试一次
+func (l *LockGeter) refresh(v *cacheItem, client http.Client, reqHeaders http.Header, ttl int64) {
+	var n = &cacheItem{url: v.url, done: make(chan struct{})}
+	ttl = l.fetch(n, client, reqHeaders, ttl)
+	close(n.done)
+	var now = time.Now().Unix()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	v.refreshing = false
+	if l.items[v.url] != v {
+		return
+	}
+	if n.err != nil || n.status != http.StatusOK {
+		if !v.failed {
+			v.failed = true
+			if h := v.expire + staleIfError; h > v.hard {
+				v.hard = h
+			}
+		}
+		if v.expire = now + errorTTL; v.expire > v.hard {
+			v.expire = v.hard
+		}
+		return
+	}
+	l.remove(v)
+	n.setExpire(now, ttl)
+	n.el = l.lru.PushFront(n)
+	l.items[n.url] = n
+	l.account(n)
+}
+
+// fetch 优先使用共享存储中未过期的数据,否则请求上游,完成后复制数据并归还buffer,返回缓存时间
+func (l *LockGeter) fetch(v *cacheItem, client http.Client, reqHeaders http.Header, ttl int64) int64 {
+	var key = "http:" + v.url
+	if n := l.loadStored(v, key); n > 0 {
+		return n
+	}
+	buffer, headers, status, err := Get(v.url, client, reqHeaders)
+	v.headers, v.status, v.err = headers, status, err
+	if buffer != nil {
+		v.data = append([]byte{}, buffer.Bytes()...)
+		buffer.Reset()
+		bufferPool.Put(buffer)
+	}
+	if err != nil || status != http.StatusOK {
+		return errorTTL
+	}
+	var now = time.Now()
+	if ttl <= 0 {
+		ttl = cacheTTL(headers, now)
+	}
+	if l.store != nil && ttl > 0 {
+		data, err := json.Marshal(storedItem{now.Unix() + ttl, headers, v.data})
+		if err == nil {
+			err = l.store.Set(key, data, time.Duration(ttl)*time.Second)
+		}
+		if err != nil {
+			util.Log.Print(err)
+		}
+	}
+	return ttl
+}
+
+// loadStored 返回共享存储中数据的剩余缓存时间,不存在或已过期时为0
+func (l *LockGeter) loadStored(v *cacheItem, key string) int64 {
+	if l.store == nil {
+		return 0
+	}
+	data, ok, err := l.store.Get(key)
+	if err != nil {
+		util.Log.Print(err)
+		return 0
+	}
+	var item storedItem
+	if !ok || json.Unmarshal(data, &item) != nil {
+		return 0
+	}
+	var n = item.Expire - time.Now().Unix()
+	if n > 0 {
+		v.data, v.headers, v.status = item.Data, item.Headers, http.StatusOK
+	}
+	return n
+}
+
+// setExpire 需持有锁,只有可缓存的200响应才会在软过期后继续返回
+func (v *cacheItem) setExpire(now int64, ttl int64) {
+	v.expire = now + ttl
+	v.hard = v.expire
+	if v.err == nil && v.status == http.StatusOK && ttl > 0 {
+		v.hard += staleTTL
+	}
+}
+
+// account 需持有锁,计入占用并按需淘汰
+func (l *LockGeter) account(v *cacheItem) {
+	v.size = int64(len(v.data) + len(v.url))
+	l.stats.Bytes += v.size
+	if v.size > l.maxBytes {
+		l.remove(v)
+		l.stats.Evictions++
+	}
+	l.evict()
+}
+
+// cacheTTL 优先s-maxage,max-age,其次Expires与Date之差,no-store,no-cache,private不缓存,都没有时使用defaultTTL
+func cacheTTL(headers http.Header, now time.Time) int64 {
+	var maxAge, sMaxAge int64 = -1, -1
+	for _, d := range strings.Split(headers.Get("Cache-Control"), ",") {
+		var k, v = strings.TrimSpace(strings.ToLower(d)), ""
+		if i := strings.IndexByte(k, '='); i >= 0 {
+			k, v = strings.TrimSpace(k[:i]), strings.Trim(strings.TrimSpace(k[i+1:]), `"`)
+		}
+		switch k {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age", "s-maxage":
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				continue
+			}
+			if k == "max-age" {
+				maxAge = n
+			} else {
+				sMaxAge = n
+			}
+		}
+	}
+	if sMaxAge >= 0 {
+		return sMaxAge
+	}
+	if maxAge >= 0 {
+		return maxAge
+	}
+	if e := headers.Get("Expires"); e != "" {
+		expires, err := http.ParseTime(e)
+		if err != nil {
+			// 无效的Expires视为已过期
+			return 0
+		}
+		if d, err := http.ParseTime(headers.Get("Date")); err == nil {
+			now = d
+		}
+		if n := int64(expires.Sub(now) / time.Second); n > 0 {
+			return n
+		}
+		return 0
+	}
+	return defaultTTL
+}
+
+func (v *cacheItem) loaded() bool {
+	select {
+	case <-v.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// evict 需持有锁
+func (l *LockGeter) evict() {
+	for (l.stats.Bytes > l.maxBytes || l.lru.Len() > l.maxEntries) && l.lru.Len() > 0 {
+		l.remove(l.lru.Back().Value.(*cacheItem))
+		l.stats.Evictions++
+	}
+}
+
+// remove 需持有锁,等待中的调用方持有条目本身,不受影响
+func (l *LockGeter) remove(v *cacheItem) {
+	if l.items[v.url] != v {
+		return
+	}
+	l.lru.Remove(v.el)
+	delete(l.items, v.url)
+	l.stats.Bytes -= v.size
+}
+
+// clean 需持有锁,删除已硬过期且已完成的条目
+func (l *LockGeter) clean(now int64) {
+	if now-l.last < cleanInterval {
+		return
+	}
+	l.last = now
+	for _, v := range l.items {
+		if v.hard < now && v.loaded() {
+			l.remove(v)
+		}
+	}
+}
+
+// Stats 当前的缓存计数
+func (l *LockGeter) Stats() CacheStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var s = l.stats
+	s.Entries = l.lru.Len()
+	return s
+}
+
+// GetByCacher check cache and get from url, ttl为0时使用上游的缓存头
+func GetByCacher(ctx context.Context, url string, client http.Client, reqHeaders http.Header, ttl int64) ([]byte, http.Header, int, error) {
+	return HttpProvider.Get(ctx, url, client, reqHeaders, ttl)
+}
@@ -0,0 +1,363 @@
+package request
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockServer 每个请求等待release关闭后才响应,响应内容为请求路径
+func blockServer() (*httptest.Server, *int32, chan struct{}) {
+	var (
+		calls   int32
+		release = make(chan struct{})
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Write([]byte(r.URL.Path))
+	}))
+	return srv, &calls, release
+}
+
+func TestLockGeterCoalesce(t *testing.T) {
+	srv, calls, release := blockServer()
+	defer srv.Close()
+	l := NewLockGeter(1<<20, 100, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, _, s, err := l.Get(context.Background(), srv.URL+"/a", http.Client{}, http.Header{}, 10)
+			if string(b) != "/a" || s != http.StatusOK || err != nil {
+				t.Error(string(b), s, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(calls); n != 1 {
+		t.Fatal("upstream calls", n)
+	}
+	if s := l.Stats(); s.Misses != 1 || s.Hits != 19 {
+		t.Fatal(s)
+	}
+}
+
+func TestLockGeterCancel(t *testing.T) {
+	srv, calls, release := blockServer()
+	defer srv.Close()
+	l := NewLockGeter(1<<20, 100, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, _, err := l.Get(ctx, srv.URL+"/a", http.Client{}, http.Header{}, 10); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	// 取消的等待不影响上游请求,结果仍会缓存
+	close(release)
+	b, _, _, err := l.Get(context.Background(), srv.URL+"/a", http.Client{}, http.Header{}, 10)
+	if string(b) != "/a" || err != nil || atomic.LoadInt32(calls) != 1 {
+		t.Fatal(string(b), err, atomic.LoadInt32(calls))
+	}
+}
+
+func TestLockGeterEvictLoading(t *testing.T) {
+	srv, _, release := blockServer()
+	defer srv.Close()
+	l := NewLockGeter(1<<20, 1, nil)
+	var (
+		wg sync.WaitGroup
+		a  []byte
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a, _, _, _ = l.Get(context.Background(), srv.URL+"/a", http.Client{}, http.Header{}, 10)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// b加入时a仍在加载,a被淘汰,等待a的调用方仍能得到结果
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		l.Get(context.Background(), srv.URL+"/b", http.Client{}, http.Header{}, 10)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if string(a) != "/a" {
+		t.Fatal(string(a))
+	}
+	var s = l.Stats()
+	if s.Entries != 1 || s.Evictions != 1 || s.Bytes != int64(len("/b")+len(srv.URL+"/b")) {
+		t.Fatal(s)
+	}
+}
+
+func TestLockGeterSingleRefresh(t *testing.T) {
+	defer func(e, s, se int64) { errorTTL, staleTTL, staleIfError = e, s, se }(errorTTL, staleTTL, staleIfError)
+	errorTTL, staleTTL, staleIfError = 0, 60, 60
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte{byte('0' + n)})
+	}))
+	defer srv.Close()
+	l := NewLockGeter(1<<20, 100, nil)
+	get := func() string {
+		b, _, _, err := l.Get(context.Background(), srv.URL, http.Client{}, http.Header{}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	if get() != "1" {
+		t.Fatal("first")
+	}
+	expire(l, srv.URL)
+	// 软过期后并发请求都立即得到旧数据,只有一个后台刷新
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v := get(); v != "1" {
+				t.Error("stale", v)
+			}
+		}()
+	}
+	wg.Wait()
+	time.Sleep(300 * time.Millisecond)
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatal("upstream calls", n)
+	}
+	if v := get(); v != "2" {
+		t.Fatal("refreshed", v)
+	}
+	if s := l.Stats(); s.Stale != 20 {
+		t.Fatal(s)
+	}
+}
+
+// expire 将条目设为已软过期
+func expire(l *LockGeter, url string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var v = l.items[url]
+	v.hard -= v.expire - time.Now().Unix() + 1
+	v.expire = time.Now().Unix() - 1
+}
+
+func TestLockGeterLRU(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	var (
+		url  = func(c byte) string { return srv.URL + "/?" + string(c) }
+		size = int64(1000 + len(url('a')))
+		l    = NewLockGeter(3*size, 10, nil)
+	)
+	for _, c := range []byte("abc") {
+		l.Get(context.Background(), url(c), http.Client{}, http.Header{}, 10)
+	}
+	// 访问a之后b为最久未使用
+	l.Get(context.Background(), url('a'), http.Client{}, http.Header{}, 10)
+	l.Get(context.Background(), url('d'), http.Client{}, http.Header{}, 10)
+	var s = l.Stats()
+	if s.Entries != 3 || s.Bytes != 3*size || s.Evictions != 1 || s.Misses != 4 || s.Hits != 1 {
+		t.Fatal(s)
+	}
+	l.mu.Lock()
+	_, hasA := l.items[url('a')]
+	_, hasB := l.items[url('b')]
+	l.mu.Unlock()
+	if !hasA || hasB {
+		t.Fatal("lru order", hasA, hasB)
+	}
+	// 过期后重新加载,占用不重复计算
+	expire(l, url('a'))
+	l.mu.Lock()
+	l.items[url('a')].hard = time.Now().Unix() - 1
+	l.mu.Unlock()
+	l.Get(context.Background(), url('a'), http.Client{}, http.Header{}, 10)
+	if s = l.Stats(); s.Bytes != 3*size || s.Entries != 3 {
+		t.Fatal(s)
+	}
+}
+
+func TestLockGeterMaxEntries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+	l := NewLockGeter(1<<20, 2, nil)
+	for _, c := range "abcde" {
+		l.Get(context.Background(), srv.URL+"/"+string(c), http.Client{}, http.Header{}, 10)
+	}
+	if s := l.Stats(); s.Entries != 2 || s.Evictions != 3 || s.Bytes != int64(2*(1+len(srv.URL)+2)) {
+		t.Fatal(s)
+	}
+}
+
+func TestLockGeterOversize(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 1000))
+	}))
+	defer srv.Close()
+	l := NewLockGeter(100, 10, nil)
+	b, _, _, _ := l.Get(context.Background(), srv.URL, http.Client{}, http.Header{}, 10)
+	if s := l.Stats(); len(b) != 1000 || s.Entries != 0 || s.Bytes != 0 || s.Evictions != 1 {
+		t.Fatal(s)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	var (
+		now    = time.Unix(1700000000, 0)
+		format = func(d time.Duration) string { return now.Add(d).UTC().Format(http.TimeFormat) }
+	)
+	var cases = []struct {
+		name    string
+		headers map[string]string
+		ttl     int64
+	}{
+		{"none", nil, defaultTTL},
+		{"max-age", map[string]string{"Cache-Control": "public, max-age=100"}, 100},
+		{"s-maxage first", map[string]string{"Cache-Control": "max-age=100, s-maxage=50"}, 50},
+		{"quoted", map[string]string{"Cache-Control": `max-age="30"`}, 30},
+		{"upper", map[string]string{"Cache-Control": "Max-Age=30"}, 30},
+		{"bad max-age", map[string]string{"Cache-Control": "max-age=x"}, defaultTTL},
+		{"no-store", map[string]string{"Cache-Control": "no-store, max-age=100"}, 0},
+		{"no-cache", map[string]string{"Cache-Control": "no-cache"}, 0},
+		{"private", map[string]string{"Cache-Control": "private, max-age=100"}, 0},
+		{"max-age over expires", map[string]string{"Cache-Control": "max-age=10", "Expires": format(time.Hour)}, 10},
+		{"expires with date", map[string]string{"Date": format(-time.Hour), "Expires": format(time.Hour)}, 7200},
+		{"expires without date", map[string]string{"Expires": format(time.Hour)}, 3600},
+		{"expired", map[string]string{"Expires": format(-time.Hour)}, 0},
+		{"invalid expires", map[string]string{"Expires": "0"}, 0},
+	}
+	for _, c := range cases {
+		var h = http.Header{}
+		for k, v := range c.headers {
+			h.Set(k, v)
+		}
+		if ttl := cacheTTL(h, now); ttl != c.ttl {
+			t.Error(c.name, ttl, c.ttl)
+		}
+	}
+}
+
+func TestLockGeterTTL(t *testing.T) {
+	defer func(e int64) { errorTTL = e }(errorTTL)
+	errorTTL = 5
+	var status int32 = http.StatusInternalServerError
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+	l := NewLockGeter(1<<20, 100, nil)
+	ttl := func(url string) int64 {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.items[url].expire - time.Now().Unix()
+	}
+	// 非200只缓存errorTTL,即使指定了ttl
+	l.Get(context.Background(), srv.URL+"/a", http.Client{}, http.Header{}, 1000)
+	if n := ttl(srv.URL + "/a"); n > 5 || n < 4 {
+		t.Fatal("error ttl", n)
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	// ttl为0时使用上游的max-age,大于0时覆盖
+	l.Get(context.Background(), srv.URL+"/b", http.Client{}, http.Header{}, 0)
+	l.Get(context.Background(), srv.URL+"/c", http.Client{}, http.Header{}, 1000)
+	if n := ttl(srv.URL + "/b"); n > 300 || n < 299 {
+		t.Fatal("upstream ttl", n)
+	}
+	if n := ttl(srv.URL + "/c"); n > 1000 || n < 999 {
+		t.Fatal("override ttl", n)
+	}
+	// 连接错误同样只缓存errorTTL
+	l.Get(context.Background(), "http://127.0.0.1:1/", http.Client{}, http.Header{}, 1000)
+	if n := ttl("http://127.0.0.1:1/"); n > 5 {
+		t.Fatal("conn error ttl", n)
+	}
+}
+
+func TestLockGeterStaleIfError(t *testing.T) {
+	defer func(e, s, se int64) { errorTTL, staleTTL, staleIfError = e, s, se }(errorTTL, staleTTL, staleIfError)
+	errorTTL, staleTTL, staleIfError = 0, 10, 100
+	var (
+		calls int32
+		fail  int32
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	l := NewLockGeter(1<<20, 100, nil)
+	get := func() (string, int) {
+		b, _, s, _ := l.Get(context.Background(), srv.URL, http.Client{}, http.Header{}, 60)
+		return string(b), s
+	}
+	item := func() (expire, hard int64) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		var v = l.items[srv.URL]
+		for v.refreshing {
+			l.mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			l.mu.Lock()
+		}
+		return v.expire, v.hard
+	}
+	get()
+	atomic.StoreInt32(&fail, 1)
+	expire(l, srv.URL)
+	soft, _ := item()
+	if v, s := get(); v != "ok" || s != http.StatusOK {
+		t.Fatal("stale", v, s)
+	}
+	// 刷新失败后硬过期延长至软过期后staleIfError
+	if _, hard := item(); hard != soft+100 {
+		t.Fatal("hard", hard, soft+100)
+	}
+	// 超过原来的staleTTL,仍返回旧数据
+	l.mu.Lock()
+	l.items[srv.URL].expire = time.Now().Unix() - 50
+	l.items[srv.URL].hard = time.Now().Unix() + 50
+	l.mu.Unlock()
+	if v, _ := get(); v != "ok" {
+		t.Fatal("stale-if-error", v)
+	}
+	item()
+	// 超出staleIfError后阻塞请求上游,返回错误响应
+	l.mu.Lock()
+	l.items[srv.URL].expire = time.Now().Unix() - 200
+	l.items[srv.URL].hard = time.Now().Unix() - 100
+	l.mu.Unlock()
+	if _, s := get(); s != http.StatusInternalServerError {
+		t.Fatal("hard expired", s)
+	}
+	// 错误响应不会作为旧数据返回
+	expire(l, srv.URL)
+	l.mu.Lock()
+	l.items[srv.URL].hard = time.Now().Unix() - 1
+	l.mu.Unlock()
+	atomic.StoreInt32(&fail, 0)
+	if v, s := get(); v != "ok" || s != http.StatusOK {
+		t.Fatal("recovered", v, s)
+	}
+}
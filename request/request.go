@@ -3,10 +3,11 @@ package request
 import (
 	"bytes"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -50,98 +51,16 @@ var (
 			return bytes.NewBuffer(make([]byte, 32*1024))
 		},
 	}
-	errTimeout = errors.New("timeout")
 )
 
-type cacheItem struct {
-	time    int64
-	ctx     context.Context
-	cancel  context.CancelFunc
-	data    *bytes.Buffer
-	headers http.Header
-	status  int
-	err     error
-	loading bool
-}
-
-// LockGeter for http cache & lock get
-type LockGeter struct {
-	time   int64
-	caches sync.Map
-}
-
-var (
-	HttpProvider = NewLockGeter()
-)
-
-// NewLockGeter create new lockgeter
-func NewLockGeter() *LockGeter {
-	return &LockGeter{
-		time:   0,
-		caches: sync.Map{},
-	}
-}
-
-func (l *LockGeter) Get(url string, client http.Client, reqHeaders http.Header, ttl int64) ([]byte, http.Header, int, error) {
-	var now = time.Now().Unix()
-	l.clean(now)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	t, loaded := l.caches.LoadOrStore(url, &cacheItem{
-		time:    now + ttl,
-		ctx:     ctx,
-		cancel:  cancel,
-		err:     errTimeout,
-		loading: true,
-	})
-	v := t.(*cacheItem)
-	if loaded {
-		<-v.ctx.Done()
-		v.loading = false
-		if v.data == nil {
-			return nil, v.headers, v.status, v.err
-		}
-		return v.data.Bytes(), v.headers, v.status, v.err
-	}
-	data, headers, status, err := Get(url, client, reqHeaders)
-	v.data = data
-	v.headers = headers
-	v.status = status
-	v.err = err
-	v.loading = false
-	cancel()
-	if data == nil {
-		return nil, headers, status, err
-	}
-	return data.Bytes(), headers, status, err
-}
-
-func (l *LockGeter) clean(now int64) {
-	if now-l.time < 5 {
-		return
-	}
-	l.time = now
-	l.caches.Range(func(key, value interface{}) bool {
-		var v = value.(*cacheItem)
-		if v.time < now && !v.loading {
-			v.cancel()
-			if v.data != nil {
-				v.data.Reset()
-				bufferPool.Put(v.data)
-			}
-			l.caches.Delete(key)
-		}
-		return true
-	})
-}
-
-// GetByCacher check cache and get from url
-func GetByCacher(url string, client http.Client, reqHeaders http.Header) ([]byte, http.Header, int, error) {
-	return HttpProvider.Get(url, client, reqHeaders, 86400)
-}
-
 // Get http data, the return value should be readonly
 func Get(url string, client http.Client, reqHeaders http.Header) (*bytes.Buffer, http.Header, int, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	return GetContext(context.Background(), url, client, reqHeaders)
+}
+
+// GetContext 同Get,ctx取消时中断请求
+func GetContext(ctx context.Context, url string, client http.Client, reqHeaders http.Header) (*bytes.Buffer, http.Header, int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, nil, 0, err
 	}
@@ -165,20 +84,24 @@ func Get(url string, client http.Client, reqHeaders http.Header) (*bytes.Buffer,
 	return buffer, resp.Header, resp.StatusCode, nil
 }
 
-// ProxyData only do get request and pipe without range
-func ProxyData(w http.ResponseWriter, r *http.Request, url string, client http.Client) error {
-	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return err
+// PutBuffer 归还Get返回的buffer,之后不能再使用其中的数据
+func PutBuffer(b *bytes.Buffer) {
+	if b != nil {
+		b.Reset()
+		bufferPool.Put(b)
 	}
-	req.Header = copyHeader(r.Header, http.Header{}, fwdHeadersBasic)
-	res, err := client.Do(req)
+}
+
+// ProxyData only do get request and pipe without range, resume from the delivered offset when upstream connection drops, refresh is called once to get a new url when upstream url expired
+func ProxyData(w http.ResponseWriter, r *http.Request, url string, client http.Client, refresh func() (string, error)) error {
+	var reqHeaders = copyHeader(r.Header, http.Header{}, fwdHeadersBasic)
+	res, url, err := doRefresh(r, url, client, reqHeaders, refresh)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return err
 	}
-	defer res.Body.Close()
+	body := resumable(r.Context(), res, url, client, reqHeaders)
+	defer body.Close()
 	to := w.Header()
 	copyHeader(res.Header, to, exposeHeadersBasic)
 	to.Set("Access-Control-Allow-Origin", "*")
@@ -190,24 +113,23 @@ func ProxyData(w http.ResponseWriter, r *http.Request, url string, client http.C
 		to.Set("Cache-Control", "public, max-age=864000")
 	}
 	w.WriteHeader(res.StatusCode)
-	_, err = io.Copy(w, res.Body)
+	_, err = io.Copy(w, body)
 	return err
 }
 
-// Pipe Proxy get request full featured with cache-control & range
-func Pipe(w http.ResponseWriter, r *http.Request, url string, client http.Client, rewriteHeader func(http.Header, http.Header)) error {
-	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return err
+// Pipe Proxy get request full featured with cache-control & range, stream urls with clen are fetched in chunks, resume from the delivered offset when upstream connection drops, refresh is called once to get a new url when upstream url expired
+func Pipe(w http.ResponseWriter, r *http.Request, url string, client http.Client, rewriteHeader func(http.Header, http.Header), refresh func() (string, error)) error {
+	if size := streamSize(url); size > 0 && r.Header.Get("If-Range") == "" {
+		return pipeChunked(w, r, url, client, rewriteHeader, refresh, size)
 	}
-	req.Header = copyHeader(r.Header, http.Header{}, fwdHeaders)
-	resp, err := client.Do(req)
+	var reqHeaders = copyHeader(r.Header, http.Header{}, fwdHeaders)
+	resp, url, err := doRefresh(r, url, client, reqHeaders, refresh)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return err
 	}
-	defer resp.Body.Close()
+	body := resumable(r.Context(), resp, url, client, reqHeaders)
+	defer body.Close()
 	to := w.Header()
 	copyHeader(resp.Header, to, exposeHeaders)
 	to.Set("Access-Control-Allow-Origin", "*")
@@ -222,10 +144,76 @@ func Pipe(w http.ResponseWriter, r *http.Request, url string, client http.Client
 		rewriteHeader(resp.Header, to)
 	}
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+	_, err = io.Copy(w, body)
 	return err
 }
 
+// Expired 上游响应403或410说明地址已过期
+func Expired(status int) bool {
+	return status == http.StatusForbidden || status == http.StatusGone
+}
+
+// doRefresh 上游响应403或410说明地址已过期,调用refresh取得新地址后重试一次相同的请求,同时返回最终使用的地址
+func doRefresh(r *http.Request, url string, client http.Client, reqHeaders http.Header, refresh func() (string, error)) (*http.Response, string, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil, url, err
+	}
+	req.Header = reqHeaders
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, url, err
+	}
+	if refresh == nil || !Expired(res.StatusCode) {
+		return res, url, nil
+	}
+	res.Body.Close()
+	if url, err = refresh(); err != nil {
+		return nil, url, err
+	}
+	if req, err = http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil); err != nil {
+		return nil, url, err
+	}
+	req.Header = reqHeaders
+	res, err = client.Do(req)
+	return res, url, err
+}
+
+// ParseRange 解析Range请求头,只支持单个range, bytes=0-100 bytes=100- bytes=-100
+func ParseRange(s string, size int64) (int64, int64, bool) {
+	if !strings.HasPrefix(s, "bytes=") || strings.Contains(s, ",") {
+		return 0, 0, false
+	}
+	var arr = strings.SplitN(strings.TrimPrefix(s, "bytes="), "-", 2)
+	if len(arr) != 2 {
+		return 0, 0, false
+	}
+	if arr[0] == "" {
+		n, err := strconv.ParseInt(arr[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+	start, err := strconv.ParseInt(arr[0], 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	var end = size - 1
+	if arr[1] != "" {
+		if end, err = strconv.ParseInt(arr[1], 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
 func copyHeader(from http.Header, to http.Header, headers []string) http.Header {
 	for _, k := range headers {
 		if v := from.Get(k); v != "" {
@@ -235,9 +223,20 @@ func copyHeader(from http.Header, to http.Header, headers []string) http.Header
 	return to
 }
 
-// ProxyCall call api with long cache
-func ProxyCall(w http.ResponseWriter, url string, client http.Client, rh http.Header, hook func([]byte, int)) error {
-	bs, outHeaders, status, err := GetByCacher(url, client, copyHeader(rh, http.Header{}, fwdHeadersBasic))
+// callCacheControl ttl大于0时按ttl输出,否则透传上游的Cache-Control,上游没有时使用根据Expires等计算的缓存时间
+func callCacheControl(headers http.Header, ttl int64) string {
+	if ttl > 0 {
+		return fmt.Sprintf("public, max-age=%d", ttl)
+	}
+	if v := headers.Get("Cache-Control"); v != "" {
+		return v
+	}
+	return fmt.Sprintf("public, max-age=%d", cacheTTL(headers, time.Now()))
+}
+
+// ProxyCall call api with cache, ttl为0时使用上游的缓存头, waiting for the shared fetch stops when the request is canceled
+func ProxyCall(w http.ResponseWriter, r *http.Request, url string, client http.Client, ttl int64, hook func([]byte, int)) error {
+	bs, outHeaders, status, err := GetByCacher(r.Context(), url, client, copyHeader(r.Header, http.Header{}, fwdHeadersBasic), ttl)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return err
@@ -247,7 +246,7 @@ func ProxyCall(w http.ResponseWriter, url string, client http.Client, rh http.He
 	h.Set("Access-Control-Allow-Origin", "*")
 	h.Set("Access-Control-Max-Age", "864000")
 	if status == http.StatusOK {
-		h.Set("Cache-Control", "public,max-age=864000")
+		h.Set("Cache-Control", callCacheControl(outHeaders, ttl))
 	}
 	w.WriteHeader(status)
 	_, err = w.Write(bs)
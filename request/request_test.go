@@ -0,0 +1,55 @@
+package request
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		size       int64
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-99", 1000, 0, 99, true},
+		{"bytes=100-", 1000, 100, 999, true},
+		{"bytes=-100", 1000, 900, 999, true},
+		{"bytes=-2000", 1000, 0, 999, true},
+		{"bytes=900-2000", 1000, 900, 999, true},
+		{"bytes=999-999", 1000, 999, 999, true},
+		{"bytes=1000-", 1000, 0, 0, false},
+		{"bytes=100-99", 1000, 0, 0, false},
+		{"bytes=-0", 1000, 0, 0, false},
+		{"bytes=0-1,5-6", 1000, 0, 0, false},
+		{"bytes=a-b", 1000, 0, 0, false},
+		{"bytes=-1-2", 1000, 0, 0, false},
+		{"bytes=100", 1000, 0, 0, false},
+		{"items=0-1", 1000, 0, 0, false},
+		{"", 1000, 0, 0, false},
+	}
+	for _, tt := range tests {
+		start, end, ok := ParseRange(tt.header, tt.size)
+		if ok != tt.ok || (ok && (start != tt.start || end != tt.end)) {
+			t.Errorf("ParseRange(%q, %d) = %d, %d, %v, want %d, %d, %v", tt.header, tt.size, start, end, ok, tt.start, tt.end, tt.ok)
+		}
+	}
+}
+
+func TestCallCacheControl(t *testing.T) {
+	tests := []struct {
+		headers http.Header
+		ttl     int64
+		want    string
+	}{
+		{http.Header{"Cache-Control": {"private, max-age=60"}}, 3600, "public, max-age=3600"},
+		{http.Header{"Cache-Control": {"private, max-age=60"}}, 0, "private, max-age=60"},
+		{http.Header{"Expires": {"Thu, 01 Jan 1970 00:00:00 GMT"}}, 0, "public, max-age=0"},
+		{http.Header{}, 0, "public, max-age=86400"},
+	}
+	for _, tt := range tests {
+		if got := callCacheControl(tt.headers, tt.ttl); got != tt.want {
+			t.Errorf("callCacheControl(%v, %d) = %q, want %q", tt.headers, tt.ttl, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package request
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	resumeRetry   = 3
+	resumeBackoff = 500 * time.Millisecond
+)
+
+// resumer 上游连接中断时从已读取的位置重新请求,继续读取,对调用方透明
+type resumer struct {
+	ctx     context.Context
+	client  http.Client
+	url     string
+	headers http.Header
+	body    io.ReadCloser
+	start   int64 // 要读取的区间起点
+	end     int64 // 区间终点,-1表示直到结尾
+	n       int64 // 已读取的字节数
+	retry   int
+}
+
+// resumable 只对完整的200或206响应包装续传,返回的ReadCloser需由调用方关闭
+func resumable(ctx context.Context, res *http.Response, url string, client http.Client, reqHeaders http.Header) io.ReadCloser {
+	if res.Header.Get("Content-Encoding") != "" {
+		return res.Body
+	}
+	var r = &resumer{ctx: ctx, client: client, url: url, headers: reqHeaders, body: res.Body, end: -1}
+	switch res.StatusCode {
+	case http.StatusOK:
+		// 地址中带有range参数时,200响应的内容从range起点开始
+		if start, end, ok := urlRange(url); ok {
+			r.start, r.end = start, end
+		}
+		if r.end < 0 && res.ContentLength > 0 {
+			r.end = r.start + res.ContentLength - 1
+		}
+	case http.StatusPartialContent:
+		start, end, ok := parseContentRange(res.Header.Get("Content-Range"))
+		if !ok {
+			return res.Body
+		}
+		r.start, r.end = start, end
+	default:
+		return res.Body
+	}
+	return r
+}
+
+func (r *resumer) Read(p []byte) (int, error) {
+	for {
+		n, err := r.body.Read(p)
+		r.n += int64(n)
+		if err == nil || err == io.EOF || r.ctx.Err() != nil || r.retry >= resumeRetry {
+			return n, err
+		}
+		if r.end >= 0 && r.start+r.n > r.end {
+			return n, io.EOF
+		}
+		if e := r.reopen(err); e != nil {
+			return n, e
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// reopen 退避后从start+n处重新请求上游,请求失败也计入重试次数
+func (r *resumer) reopen(cause error) error {
+	r.body.Close()
+	r.body = io.NopCloser(strings.NewReader(""))
+	var err = cause
+	for r.retry < resumeRetry {
+		r.retry++
+		select {
+		case <-time.After(resumeBackoff * time.Duration(r.retry)):
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+		var body io.ReadCloser
+		if body, err = r.request(); err == nil {
+			r.body = body
+			return nil
+		}
+	}
+	return fmt.Errorf("resume at %d failed: %v", r.start+r.n, err)
+}
+
+func (r *resumer) request() (io.ReadCloser, error) {
+	var (
+		from    = r.start + r.n
+		url     = r.url
+		headers = r.headers.Clone()
+		ranged  = false
+	)
+	// 地址中已带有range参数的直接改写参数,否则使用Range请求头
+	if u, err := neturl.Parse(url); err == nil && u.Query().Get("range") != "" {
+		var q = u.Query()
+		q.Set("range", fmt.Sprintf("%d-%s", from, endString(r.end)))
+		u.RawQuery = q.Encode()
+		url = u.String()
+	} else {
+		ranged = true
+		headers.Set("Range", fmt.Sprintf("bytes=%d-%s", from, endString(r.end)))
+	}
+	headers.Del("If-Modified-Since")
+	headers.Del("If-None-Match")
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = headers
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if ranged {
+		if start, _, ok := parseContentRange(res.Header.Get("Content-Range")); res.StatusCode != http.StatusPartialContent || !ok || start != from {
+			res.Body.Close()
+			return nil, fmt.Errorf("resume at %d : %s", from, res.Status)
+		}
+	} else if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("resume at %d : %s", from, res.Status)
+	}
+	return res.Body, nil
+}
+
+func (r *resumer) Close() error {
+	return r.body.Close()
+}
+
+// urlRange 解析地址中的range=a-b参数,b可省略
+func urlRange(url string) (int64, int64, bool) {
+	u, err := neturl.Parse(url)
+	if err != nil {
+		return 0, 0, false
+	}
+	var se = strings.SplitN(u.Query().Get("range"), "-", 2)
+	if len(se) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(se[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	if se[1] == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(se[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+func endString(end int64) string {
+	if end < 0 {
+		return ""
+	}
+	return strconv.FormatInt(end, 10)
+}
+
+// parseContentRange 解析 bytes 0-100/1000
+func parseContentRange(s string) (int64, int64, bool) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, false
+	}
+	var arr = strings.SplitN(strings.TrimPrefix(s, "bytes "), "/", 2)
+	var se = strings.SplitN(arr[0], "-", 2)
+	if len(se) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(se[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	end, err := strconv.ParseInt(se[1], 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
@@ -0,0 +1,145 @@
+package request
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// dropServer 第一次请求只输出一部分就断开连接,range参数或Range请求头决定输出的区间
+func dropServer(data []byte, drop int) (*httptest.Server, *[]string) {
+	var (
+		mu    sync.Mutex
+		calls []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start, end = 0, len(data) - 1
+		var status = http.StatusOK
+		var rg = r.URL.Query().Get("range")
+		if h := r.Header.Get("Range"); h != "" {
+			rg = strings.TrimPrefix(h, "bytes=")
+			status = http.StatusPartialContent
+		}
+		if rg != "" {
+			se := strings.SplitN(rg, "-", 2)
+			start, _ = strconv.Atoi(se[0])
+			if se[1] != "" {
+				end, _ = strconv.Atoi(se[1])
+			}
+		}
+		mu.Lock()
+		calls = append(calls, fmt.Sprintf("%d-%d", start, end))
+		first := len(calls) == 1
+		mu.Unlock()
+		w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+		if status == http.StatusPartialContent {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		}
+		w.WriteHeader(status)
+		if first {
+			w.Write(data[start : start+drop])
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write(data[start : end+1])
+	}))
+	return srv, &calls
+}
+
+func testData(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; b.Len() < n; i++ {
+		b.WriteString(strconv.Itoa(i))
+	}
+	return b.Bytes()[:n]
+}
+
+func TestResumeHeader(t *testing.T) {
+	data := testData(1000000)
+	up, calls := dropServer(data, 300000)
+	defer up.Close()
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Pipe(w, r, up.URL+"/x?a=1", http.Client{}, nil, nil)
+	}))
+	defer front.Close()
+	res, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || !bytes.Equal(b, data) {
+		t.Fatal(err, len(b), *calls)
+	}
+}
+
+func TestResumeRangeParam(t *testing.T) {
+	data := testData(10000)
+	up, calls := dropServer(data, 100)
+	defer up.Close()
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ProxyData(w, r, up.URL+"/x?range=5000-5999", http.Client{}, nil)
+	}))
+	defer front.Close()
+	res, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || !bytes.Equal(b, data[5000:6000]) {
+		t.Fatal(err, len(b), *calls)
+	}
+	if fmt.Sprint(*calls) != "[5000-5999 5100-5999]" {
+		t.Fatal(*calls)
+	}
+}
+
+func TestURLRange(t *testing.T) {
+	var cases = []struct {
+		url        string
+		start, end int64
+		ok         bool
+	}{
+		{"http://a/b?range=10-20", 10, 20, true},
+		{"http://a/b?x=1&range=10-", 10, -1, true},
+		{"http://a/b?range=20-10", 0, 0, false},
+		{"http://a/b?range=x-10", 0, 0, false},
+		{"http://a/b", 0, 0, false},
+	}
+	for _, c := range cases {
+		start, end, ok := urlRange(c.url)
+		if start != c.start || end != c.end || ok != c.ok {
+			t.Error(c.url, start, end, ok)
+		}
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	var cases = []struct {
+		s          string
+		start, end int64
+		ok         bool
+	}{
+		{"bytes 0-99/1000", 0, 99, true},
+		{"bytes 5-5/*", 5, 5, true},
+		{"bytes 9-5/10", 0, 0, false},
+		{"bytes 5/10", 0, 0, false},
+		{"items 0-1/2", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, c := range cases {
+		start, end, ok := parseContentRange(c.s)
+		if start != c.start || end != c.end || ok != c.ok {
+			t.Error(c.s, start, end, ok)
+		}
+	}
+}
@@ -15,11 +15,18 @@ type routeInfo struct {
 
 // Route for all route
 var Route = []routeInfo{
-	{regexp.MustCompile(`^/video/([\w\-]{6,15})\.(json|xml|mpd)$`), video.AuthCode(video.GetInfo)},
+	{regexp.MustCompile(`^/video/([\w\-]{6,15})\.(json|xml|mpd|m3u8|vtt|srt)$`), video.AuthCode(video.GetInfo)},
 	{regexp.MustCompile(`^/video/([\w\-]{6,15})/(\d{1,3})\.(mp4|webm)$`), video.AuthCode(video.ProxyOne)},
 	{regexp.MustCompile(`^/video/([\w\-]{6,15})/(\d{1,3})/(\d+-\d+)\.ts$`), video.AuthCode(video.ProxyPart)},
+	{regexp.MustCompile(`^/video/([\w\-]{6,15})/(\d{1,3})/sq/init\.(mp4|webm)$`), video.AuthCode(video.ProxyLiveInit)},
+	{regexp.MustCompile(`^/video/([\w\-]{6,15})/(\d{1,3})/sq/(\d+)\.(mp4|webm)$`), video.AuthCode(video.ProxyLive)},
 	{regexp.MustCompile(`^/video/([\w\-]{6,15})\.(jpg|webp)$`), video.AuthCode(video.Image)},
+	{regexp.MustCompile(`^/video/([\w\-]{6,15})/storyboard\.vtt$`), video.AuthCode(video.Storyboard)},
+	{regexp.MustCompile(`^/video/([\w\-]{6,15})/sb/(\d)/(\w{1,16})\.jpg$`), video.AuthCode(video.StoryboardSprite)},
 	{regexp.MustCompile(`^/video/([\w\-]{6,15})\.(mp4|webm)$`), video.AuthCode(video.ProxyAuto)},
+	{regexp.MustCompile(`^/video/([\w\-]{6,15})\.(m4a|weba)$`), video.AuthCode(video.ProxyAudio)},
+
+	{regexp.MustCompile(`^/video/stats\.json$`), video.Stats},
 
 	{regexp.MustCompile(`^/video/api/(v3/videos)$`), video.Videos},
 	{regexp.MustCompile(`^/video/api/(v3/search)$`), video.Search},
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/suconghou/videoproxy/util"
+)
+
+// 扫描删除过期文件的间隔
+const diskCleanInterval = 10 * time.Minute
+
+// Disk 以文件树存储,文件名为key的sha1,前两位作为子目录,文件内容为8字节的过期时间加数据
+type Disk struct {
+	dir string
+}
+
+// NewDisk 删除上次残留的临时文件,并定期清理过期文件
+func NewDisk(dir string) (*Disk, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "videoproxy")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	var d = &Disk{dir: dir}
+	if err := d.clean(time.Now(), true); err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			time.Sleep(diskCleanInterval)
+			if err := d.clean(time.Now(), false); err != nil {
+				util.Log.Print(err)
+			}
+		}
+	}()
+	return d, nil
+}
+
+func (d *Disk) path(key string) string {
+	var sum = sha1.Sum([]byte(key))
+	var name = hex.EncodeToString(sum[:])
+	return filepath.Join(d.dir, name[:2], name[2:])
+}
+
+func (d *Disk) Get(key string) ([]byte, bool, error) {
+	var p = d.path(key)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if len(data) < 8 || int64(binary.BigEndian.Uint64(data)) < time.Now().Unix() {
+		os.Remove(p)
+		return nil, false, nil
+	}
+	return data[8:], true, nil
+}
+
+// Set 先写入临时文件再重命名,并发读取不会读到不完整的文件
+func (d *Disk) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return d.Delete(key)
+	}
+	var p = d.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	var head = make([]byte, 8)
+	binary.BigEndian.PutUint64(head, uint64(time.Now().Add(ttl).Unix()))
+	if _, err = f.Write(head); err == nil {
+		_, err = f.Write(value)
+	}
+	if er := f.Close(); err == nil {
+		err = er
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (d *Disk) Delete(key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// clean 删除过期的文件,tmp为true时同时删除临时文件
+// 只处理path()生成的<2位hex>/<38位hex>文件与Set创建的<38位hex>.*.tmp,目录中的其他文件不受影响
+func (d *Disk) clean(now time.Time, tmp bool) error {
+	dirs, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || !isHex(dir.Name(), 2) {
+			continue
+		}
+		var sub = filepath.Join(d.dir, dir.Name())
+		files, err := os.ReadDir(sub)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, f := range files {
+			var name, path = f.Name(), filepath.Join(sub, f.Name())
+			if f.IsDir() {
+				continue
+			}
+			if isHex(name, 38) {
+				if expired(path, now) {
+					os.Remove(path)
+				}
+			} else if tmp && isTemp(name) {
+				os.Remove(path)
+			}
+		}
+	}
+	return nil
+}
+
+// expired 文件头部的过期时间早于now,或读取不到完整的头部
+func expired(path string, now time.Time) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	var head = make([]byte, 8)
+	if _, err = io.ReadFull(file, head); err != nil {
+		return true
+	}
+	return int64(binary.BigEndian.Uint64(head)) < now.Unix()
+}
+
+// isTemp Set创建的临时文件名为<38位hex>.<随机数>.tmp
+func isTemp(name string) bool {
+	return len(name) > 43 && isHex(name[:38], 38) && name[38] == '.' && strings.HasSuffix(name, ".tmp")
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		if c := s[i]; !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// 清理过期条目的间隔
+const memoryCleanInterval = time.Minute
+
+type memoryItem struct {
+	expire time.Time
+	value  []byte
+}
+
+// Memory 进程内存储,过期条目在读取时或定期清理时删除
+type Memory struct {
+	mu    sync.Mutex
+	last  time.Time
+	items map[string]memoryItem
+}
+
+// NewMemory create memory store
+func NewMemory() *Memory {
+	return &Memory{items: map[string]memoryItem{}}
+}
+
+// Get 返回的数据不可修改
+func (m *Memory) Get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.items[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if v.expire.Before(time.Now()) {
+		delete(m.items, key)
+		return nil, false, nil
+	}
+	return v.value, true, nil
+}
+
+func (m *Memory) Set(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return m.Delete(key)
+	}
+	var now = time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clean(now)
+	m.items[key] = memoryItem{now.Add(ttl), value}
+	return nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	delete(m.items, key)
+	m.mu.Unlock()
+	return nil
+}
+
+// clean 需持有锁
+func (m *Memory) clean(now time.Time) {
+	if now.Sub(m.last) < memoryCleanInterval {
+		return
+	}
+	m.last = now
+	for k, v := range m.items {
+		if v.expire.Before(now) {
+			delete(m.items, k)
+		}
+	}
+}
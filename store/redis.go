@@ -0,0 +1,220 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// 空闲连接的最大数量
+	redisPoolSize = 16
+	// 建立连接及每个命令的超时时间
+	redisTimeout = 5 * time.Second
+)
+
+var errRedisReply = errors.New("invalid redis reply")
+
+// RedisError redis返回的错误回复
+type RedisError string
+
+func (e RedisError) Error() string {
+	return string(e)
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// Redis 使用RESP协议的简单客户端,只用到AUTH SELECT GET SET DEL
+type Redis struct {
+	addr     string
+	password string
+	db       int
+	pool     chan *redisConn
+}
+
+// NewRedis 地址格式 redis://[:password@]host:port[/db],连接在首次使用时建立
+func NewRedis(u *url.URL) (*Redis, error) {
+	var r = &Redis{addr: u.Host, pool: make(chan *redisConn, redisPoolSize)}
+	if r.addr == "" {
+		return nil, fmt.Errorf("invalid redis address %s", u)
+	}
+	if !strings.Contains(r.addr, ":") {
+		r.addr += ":6379"
+	}
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis db %s", p)
+		}
+		r.db = n
+	}
+	return r, nil
+}
+
+func (r *Redis) Get(key string) ([]byte, bool, error) {
+	v, err := r.do("GET", key)
+	if err != nil {
+		return nil, false, err
+	}
+	if v == nil {
+		return nil, false, nil
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, false, errRedisReply
+	}
+	return b, true, nil
+}
+
+// Set 过期时间精确到毫秒
+func (r *Redis) Set(key string, value []byte, ttl time.Duration) error {
+	if ms := int64(ttl / time.Millisecond); ms > 0 {
+		_, err := r.do("SET", key, value, "PX", strconv.FormatInt(ms, 10))
+		return err
+	}
+	return r.Delete(key)
+}
+
+func (r *Redis) Delete(key string) error {
+	_, err := r.do("DEL", key)
+	return err
+}
+
+// do 执行一个命令,出错的连接不再放回连接池,redis返回的错误回复不影响连接
+func (r *Redis) do(args ...interface{}) (interface{}, error) {
+	c, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	v, err := c.do(args...)
+	if _, ok := err.(RedisError); err != nil && !ok {
+		c.conn.Close()
+		return nil, err
+	}
+	r.put(c)
+	return v, err
+}
+
+func (r *Redis) get() (*redisConn, error) {
+	select {
+	case c := <-r.pool:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", r.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	var c = &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if r.password != "" {
+		if _, err = c.do("AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.db != 0 {
+		if _, err = c.do("SELECT", strconv.Itoa(r.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (r *Redis) put(c *redisConn) {
+	select {
+	case r.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+// do 参数为string或[]byte,以bulk string数组发送,参数类型在写入前检查,不会在缓冲中留下不完整的命令
+func (c *redisConn) do(args ...interface{}) (interface{}, error) {
+	var items = make([][]byte, len(args))
+	for i, a := range args {
+		switch v := a.(type) {
+		case string:
+			items[i] = []byte(v)
+		case []byte:
+			items[i] = v
+		default:
+			return nil, fmt.Errorf("unsupported redis arg %T", a)
+		}
+	}
+	if err := c.conn.SetDeadline(time.Now().Add(redisTimeout)); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(c.w, "*%d\r\n", len(items))
+	for _, b := range items {
+		fmt.Fprintf(c.w, "$%d\r\n", len(b))
+		c.w.Write(b)
+		c.w.WriteString("\r\n")
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read 解析一个回复,nil bulk string为nil,bulk string为[]byte,整数为int64,数组为[]interface{}
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRedisReply
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, errRedisReply
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		var b = make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, errRedisReply
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		var items = make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errRedisReply
+}
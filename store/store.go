@@ -0,0 +1,56 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/suconghou/videoproxy/util"
+)
+
+// Store 带过期时间的键值存储,多个实例可通过磁盘或redis共享缓存
+type Store interface {
+	// Get 不存在或已过期时ok为false
+	Get(key string) (value []byte, ok bool, err error)
+	// Set ttl小于等于0时不写入
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+var (
+	// Default 由环境变量CACHE_STORE选择,默认内存
+	Default Store = fromEnv()
+	// Shared 跨实例共享的后端,内存后端时为nil,此时http缓存与解析缓存只使用自身的内存缓存
+	Shared Store
+)
+
+func fromEnv() Store {
+	s, err := New(os.Getenv("CACHE_STORE"))
+	if err != nil {
+		util.Log.Print(err)
+		return NewMemory()
+	}
+	if _, ok := s.(*Memory); !ok {
+		Shared = s
+	}
+	return s
+}
+
+// New 根据地址创建存储,空或memory为内存,file:///path为磁盘,redis://[:password@]host:port[/db]为redis
+func New(addr string) (Store, error) {
+	if addr == "" || addr == "memory" {
+		return NewMemory(), nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return NewDisk(u.Path)
+	case "redis":
+		return NewRedis(u)
+	}
+	return nil, fmt.Errorf("unsupported cache store %s", addr)
+}
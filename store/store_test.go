@@ -0,0 +1,331 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis 本地的RESP服务,实现AUTH SELECT GET SET PX DEL,password为空时不校验
+func fakeRedis(t *testing.T, password string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var (
+		mu     sync.Mutex
+		data   = map[string]string{}
+		expire = map[string]time.Time{}
+	)
+	handle := func(args []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[1] != password {
+				return "-WRONGPASS invalid password\r\n"
+			}
+			return "+OK\r\n"
+		case "SELECT":
+			return "+OK\r\n"
+		case "GET":
+			v, ok := data[args[1]]
+			if !ok || time.Now().After(expire[args[1]]) {
+				return "$-1\r\n"
+			}
+			return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+		case "SET":
+			if len(args) != 5 || strings.ToUpper(args[3]) != "PX" {
+				return "-ERR syntax error\r\n"
+			}
+			ms, _ := strconv.Atoi(args[4])
+			data[args[1]] = args[2]
+			expire[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			return "+OK\r\n"
+		case "DEL":
+			_, ok := data[args[1]]
+			delete(data, args[1])
+			if ok {
+				return ":1\r\n"
+			}
+			return ":0\r\n"
+		}
+		return "-ERR unknown command\r\n"
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line[0] != '*' {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					args := make([]string, n)
+					for i := range args {
+						line, err = r.ReadString('\n')
+						if err != nil || line[0] != '$' {
+							return
+						}
+						m, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+						b := make([]byte, m+2)
+						if _, err = io.ReadFull(r, b); err != nil {
+							return
+						}
+						args[i] = string(b[:m])
+					}
+					if _, err = io.WriteString(c, handle(args)); err != nil {
+						return
+					}
+				}
+			}(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// testStore Get/Set/Delete/TTL的通用测试
+func testStore(t *testing.T, s Store) {
+	if _, ok, err := s.Get("a"); ok || err != nil {
+		t.Fatal("empty", ok, err)
+	}
+	var bin = []byte("x\r\n\x00y")
+	if err := s.Set("a", bin, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	v, ok, err := s.Get("a")
+	if !ok || err != nil || string(v) != string(bin) {
+		t.Fatal("get", v, ok, err)
+	}
+	if err = s.Set("a", []byte("2"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ = s.Get("a"); string(v) != "2" {
+		t.Fatal("overwrite", v)
+	}
+	if err = s.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ = s.Get("a"); ok {
+		t.Fatal("deleted")
+	}
+	if err = s.Delete("missing"); err != nil {
+		t.Fatal(err)
+	}
+	// ttl小于等于0不写入,并删除已有的值
+	s.Set("b", []byte("1"), time.Minute)
+	if err = s.Set("b", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ = s.Get("b"); ok {
+		t.Fatal("zero ttl")
+	}
+	if err = s.Set("c", []byte("1"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ = s.Get("c"); !ok {
+		t.Fatal("ttl not reached")
+	}
+	time.Sleep(2100 * time.Millisecond)
+	if _, ok, _ = s.Get("c"); ok {
+		t.Fatal("expired")
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestMemoryClean(t *testing.T) {
+	m := NewMemory()
+	m.Set("a", []byte("1"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	m.last = time.Time{}
+	m.Set("b", []byte("1"), time.Minute)
+	if _, ok := m.items["a"]; ok || len(m.items) != 1 {
+		t.Fatal(m.items)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	d, err := NewDisk(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, d)
+}
+
+func TestDiskClean(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Set("old", []byte("1"), time.Second)
+	d.Set("new", []byte("1"), time.Hour)
+	if err = d.clean(time.Now().Add(time.Minute), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := d.Get("new"); !ok {
+		t.Fatal("new removed")
+	}
+	if _, ok, _ := d.Get("old"); ok {
+		t.Fatal("old kept")
+	}
+	// 重新打开时删除残留的临时文件,已有数据仍可读取
+	var tmp = d.path("x") + ".123456.tmp"
+	if err = d.Set("x", []byte("1"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = NewDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(tmp); err == nil {
+		t.Fatal("tmp kept")
+	}
+	if _, ok, _ := d.Get("x"); !ok {
+		t.Fatal("reopen")
+	}
+}
+
+func TestRedis(t *testing.T) {
+	addr := fakeRedis(t, "pw")
+	u, _ := url.Parse("redis://:pw@" + addr + "/2")
+	r, err := NewRedis(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, r)
+	// 并发使用连接池
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			k := "k" + strconv.Itoa(i)
+			if err := r.Set(k, []byte(k), time.Minute); err != nil {
+				t.Error(err)
+				return
+			}
+			v, ok, err := r.Get(k)
+			if !ok || err != nil || string(v) != k {
+				t.Error(k, v, ok, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	// 参数类型错误不写入连接,连接仍可继续使用
+	c, err := r.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.do("GET", 1); err == nil {
+		t.Fatal("bad arg accepted")
+	}
+	if c.w.Buffered() != 0 {
+		t.Fatal("partial command buffered")
+	}
+	if v, err := c.do("GET", "k1"); err != nil || string(v.([]byte)) != "k1" {
+		t.Fatal(v, err)
+	}
+	r.put(c)
+}
+
+func TestRedisAuth(t *testing.T) {
+	addr := fakeRedis(t, "pw")
+	u, _ := url.Parse("redis://:wrong@" + addr)
+	r, err := NewRedis(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = r.Get("x"); err == nil {
+		t.Fatal("auth not checked")
+	}
+	if _, ok := err.(RedisError); !ok {
+		t.Fatal(err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	var cases = []struct {
+		addr string
+		kind string
+	}{
+		{"", "*store.Memory"},
+		{"memory", "*store.Memory"},
+		{"file://" + t.TempDir(), "*store.Disk"},
+		{"redis://127.0.0.1", "*store.Redis"},
+		{"redis://127.0.0.1:6380/1", "*store.Redis"},
+		{"redis://127.0.0.1/x", ""},
+		{"ftp://x", ""},
+	}
+	for _, c := range cases {
+		s, err := New(c.addr)
+		if c.kind == "" {
+			if err == nil {
+				t.Error(c.addr, "no error")
+			}
+			continue
+		}
+		if err != nil || fmt.Sprintf("%T", s) != c.kind {
+			t.Error(c.addr, err, fmt.Sprintf("%T", s))
+		}
+	}
+}
+
+func TestDiskCleanForeign(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDisk(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Set("a", []byte("1"), time.Hour)
+	var sub = filepath.Dir(d.path("a"))
+	// 与存储布局不符的文件,即使是tmp或没有过期时间头部也不删除
+	var foreign = []string{
+		filepath.Join(dir, "foo.tmp"),
+		filepath.Join(dir, "data.bin"),
+		filepath.Join(dir, "slice", "ab", "0123456789012345678901234567890123456789"),
+		filepath.Join(sub, "notes.txt"),
+		filepath.Join(sub, "x.tmp"),
+	}
+	for _, f := range foreign {
+		os.MkdirAll(filepath.Dir(f), 0755)
+		if err = os.WriteFile(f, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = NewDisk(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.clean(time.Now().Add(48*time.Hour), true); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range foreign {
+		if _, err = os.Stat(f); err != nil {
+			t.Fatal(f, err)
+		}
+	}
+	if _, err = os.Stat(d.path("a")); err == nil {
+		t.Fatal("expired entry kept")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
@@ -53,6 +54,16 @@ func GzipEncode(data []byte) ([]byte, error) {
 	return in.Bytes(), nil
 }
 
+// GzipDecode ungzip data
+func GzipDecode(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
 // DecodeVid video id
 func DecodeVid(str string, r1 int, r2 int) (string, error) {
 	if len(str) < 1 {
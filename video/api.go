@@ -18,6 +18,8 @@ var (
 
 const (
 	baseURL = "https://www.googleapis.com/youtube/%s"
+	// data api 数据缓存48h,不使用上游的缓存头
+	apiTTL = 48 * 3600
 )
 
 // Videos proxy api to get video info , ?id=.. / ?chart=mostPopular&maxResults=20
@@ -67,5 +69,5 @@ func call(w http.ResponseWriter, r *http.Request, t string, q url.Values) error
 		q.Set("key", key)
 	}
 	var url = fmt.Sprintf(baseURL, t) + "?" + q.Encode()
-	return request.ProxyCall(w, url, apiClient, r.Header, nil)
+	return request.ProxyCall(w, r, url, apiClient, apiTTL, nil)
 }
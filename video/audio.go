@@ -0,0 +1,66 @@
+package video
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/suconghou/videoproxy/media"
+	"github.com/suconghou/videoproxy/request"
+	"github.com/suconghou/videoproxy/util"
+)
+
+// audioContainer 音频接口的扩展名对应的容器格式
+var audioContainer = map[string]string{
+	"m4a":  "mp4",
+	"weba": "webm",
+}
+
+// ProxyAudio 按prefer与默认的音频偏好顺序选取音频流,m4a可使用flat=1转换为非分段的文件
+func ProxyAudio(w http.ResponseWriter, r *http.Request, match []string) error {
+	var (
+		query     = r.URL.Query()
+		ext       = match[2]
+		info, err = getinfo(match[1])
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	filter, err := parseCodecFilter(query)
+	if err != nil {
+		util.JSONPut(w, resp{-1, err.Error()}, http.StatusBadRequest, 1)
+		return err
+	}
+	var s = pickContainer(findStreams(info, streamQuery{prefers: query.Get("prefer") + "," + alist, mime: "audio", filter: filter}), audioContainer[ext])
+	if s == nil {
+		if filter != nil {
+			putCodecError(w, filter.incompatible(info))
+			return nil
+		}
+		http.NotFound(w, r)
+		return nil
+	}
+	var disposition = func(h http.Header) {
+		if query.Get("download") == "1" {
+			name := url.PathEscape(fmt.Sprintf("%s.%s", info.Title, ext))
+			h.Set("Content-Disposition", fmt.Sprintf("attachment;filename* = UTF-8''%s", name))
+		}
+	}
+	if query.Get("flat") == "1" && ext == "m4a" {
+		index, err := getIndex(info.ID, s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+		file, err := media.Flatten(r.Context(), info.ID+"/"+s.Itag, index, s.URL, videoClient)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+		return file.Serve(w, r, videoClient, disposition, []func() (string, error){refresher(info.ID, s.Itag, "")})
+	}
+	return request.Pipe(w, r, s.URL, videoClient, func(res, to http.Header) {
+		disposition(to)
+	}, refresher(info.ID, s.Itag, ""))
+}
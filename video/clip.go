@@ -0,0 +1,69 @@
+package video
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/suconghou/videoproxy/media"
+	"github.com/suconghou/videoproxy/util"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+// clipParams 解析start与end参数(秒),均未设置时ok为false
+func clipParams(query url.Values) (float64, float64, bool, error) {
+	var (
+		start, end float64
+		err        error
+	)
+	if query.Get("start") == "" && query.Get("end") == "" {
+		return 0, 0, false, nil
+	}
+	if v := query.Get("start"); v != "" {
+		if start, err = strconv.ParseFloat(v, 64); err != nil || start < 0 {
+			return 0, 0, true, fmt.Errorf("bad start %s", v)
+		}
+	}
+	if v := query.Get("end"); v != "" {
+		if end, err = strconv.ParseFloat(v, 64); err != nil || end <= start {
+			return 0, 0, true, fmt.Errorf("bad end %s", v)
+		}
+	}
+	return start, end, true, nil
+}
+
+// clipStream 截取流中[start,end]秒的部分,分段的流使用索引,渐进式的mp4重建sample表,filename不为空时作为附件下载
+func clipStream(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.VideoInfo, s *youtubevideoparser.StreamItem, filename string) error {
+	start, end, _, err := clipParams(r.URL.Query())
+	if err != nil {
+		util.JSONPut(w, resp{-1, err.Error()}, http.StatusBadRequest, 1)
+		return nil
+	}
+	var file *media.File
+	if usable(s) {
+		var index *media.Index
+		if index, err = getIndex(info.ID, s); err == nil {
+			file, err = media.Clip(index, s.URL, start, end)
+		}
+	} else if strings.Contains(s.Type, "mp4") && contentLength(s) > 0 {
+		var movie *media.Movie
+		if movie, err = media.LoadMovie(info.ID+"/"+s.Itag, s.URL, atoi64(s.ContentLength), videoClient); err == nil {
+			file, err = media.ClipMovie(movie, s.URL, start, end)
+		}
+	} else {
+		util.JSONPut(w, resp{-1, "clip not supported for itag " + s.Itag}, http.StatusBadRequest, 1)
+		return nil
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	return file.Serve(w, r, videoClient, func(h http.Header) {
+		if filename != "" {
+			name := url.PathEscape(filename)
+			h.Set("Content-Disposition", fmt.Sprintf("attachment;filename* = UTF-8''%s", name))
+		}
+	}, []func() (string, error){refresher(info.ID, s.Itag, "")})
+}
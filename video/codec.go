@@ -0,0 +1,148 @@
+package video
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/suconghou/videoproxy/util"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+// 设备能力配置,值为可解码的编码族
+var codecProfiles = map[string]string{
+	"tv-h264":    "avc1,mp4a",
+	"tv-vp9":     "avc1,vp9,mp4a,opus",
+	"ios-legacy": "avc1,mp4a",
+	"ios":        "avc1,av01,mp4a",
+	"web":        "avc1,vp9,av01,mp4a,opus",
+}
+
+// codecFilter 允许的编码族,为nil时不过滤
+type codecFilter map[string]bool
+
+// errIncompatible 没有客户端可以解码的流
+type errIncompatible struct {
+	allowed   []string
+	available []string
+}
+
+type codecResp struct {
+	Code      int      `json:"code"`
+	Msg       string   `json:"msg"`
+	Codecs    []string `json:"codecs"`
+	Available []string `json:"available"`
+}
+
+func (e *errIncompatible) Error() string {
+	return fmt.Sprintf("no stream compatible with codecs %s", strings.Join(e.allowed, ","))
+}
+
+// parseCodecFilter 解析query中的codecs与profile参数,同时存在时取二者的交集
+func parseCodecFilter(query url.Values) (codecFilter, error) {
+	var (
+		codecs  = query.Get("codecs")
+		profile = query.Get("profile")
+		filter  codecFilter
+	)
+	if profile != "" {
+		list, ok := codecProfiles[profile]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %s", profile)
+		}
+		filter = newCodecFilter(list)
+	}
+	if codecs != "" {
+		var f = newCodecFilter(codecs)
+		if filter == nil {
+			return f, nil
+		}
+		for k := range filter {
+			if !f[k] {
+				delete(filter, k)
+			}
+		}
+	}
+	return filter, nil
+}
+
+func newCodecFilter(list string) codecFilter {
+	var f = codecFilter{}
+	for _, c := range strings.Split(list, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			f[codecFamily(c)] = true
+		}
+	}
+	return f
+}
+
+// allow 流中的每一种编码都要可以解码,例如itag 18同时含有avc1与mp4a
+func (f codecFilter) allow(s *youtubevideoparser.StreamItem) bool {
+	if f == nil {
+		return true
+	}
+	var _, codecs = parseType(s.Type)
+	for _, c := range codecList(codecs) {
+		if !f[c] {
+			return false
+		}
+	}
+	return true
+}
+
+// String 排序后的编码族列表,用于缓存变体与错误说明
+func (f codecFilter) String() string {
+	return strings.Join(f.list(), ",")
+}
+
+func (f codecFilter) list() []string {
+	var res = []string{}
+	for k := range f {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func (f codecFilter) incompatible(info *youtubevideoparser.VideoInfo) error {
+	var (
+		seen      = map[string]bool{}
+		available = []string{}
+	)
+	for _, s := range info.Streams {
+		if s.URL == "" {
+			continue
+		}
+		var _, codecs = parseType(s.Type)
+		for _, c := range codecList(codecs) {
+			if !seen[c] {
+				seen[c] = true
+				available = append(available, c)
+			}
+		}
+	}
+	sort.Strings(available)
+	return &errIncompatible{f.list(), available}
+}
+
+// codecList avc1.42001E, mp4a.40.2 => [avc1 mp4a]
+func codecList(codecs string) []string {
+	var res = []string{}
+	for _, c := range strings.Split(codecs, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			res = append(res, codecFamily(c))
+		}
+	}
+	return res
+}
+
+// putCodecError 无可用编码时响应406,其他错误响应500
+func putCodecError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*errIncompatible); ok {
+		util.JSONPut(w, codecResp{-1, e.Error(), e.allowed, e.available}, http.StatusNotAcceptable, 1)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
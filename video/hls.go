@@ -0,0 +1,145 @@
+package video
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/suconghou/youtubevideoparser"
+)
+
+// outPutM3u8 无itag参数时输出master playlist,否则输出对应itag的media playlist
+func outPutM3u8(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.VideoInfo) error {
+	if isLive(info) {
+		return outPutLiveM3u8(w, r, info)
+	}
+	var (
+		itag     = r.URL.Query().Get("itag")
+		ID       = pathID(r, ".m3u8")
+		text     string
+		err      error
+		duration int
+	)
+	if duration, err = strconv.Atoi(info.Duration); err != nil || duration <= 0 {
+		http.Error(w, "bad duration", http.StatusInternalServerError)
+		return err
+	}
+	if itag == "" {
+		var (
+			audio = mp4Streams(findStreams(info, streamQuery{mime: "audio", ladder: true}))
+			video = mp4Streams(findStreams(info, streamQuery{mime: "video", ladder: true}))
+		)
+		text, err = buildMaster(ID, audio, video, func(s *youtubevideoparser.StreamItem) int {
+			return 8 * (contentLength(s) / duration)
+		})
+	} else {
+		s := info.Streams[itag]
+		// 媒体播放列表按fmp4输出,webm的流HLS无法播放
+		if s == nil || !usable(s) || len(mp4Streams([]*youtubevideoparser.StreamItem{s})) == 0 {
+			http.NotFound(w, r)
+			return nil
+		}
+		text, err = buildMedia(info.ID, s, ID)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/vnd.apple.mpegurl")
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Max-Age", "864000")
+	h.Set("Cache-Control", "public,max-age=864000")
+	_, err = w.Write([]byte(text))
+	return err
+}
+
+// buildMaster HLS只支持fmp4,webm的流不输出;每个视频itag一个variant,音频作为一组rendition
+func buildMaster(ID string, audio []*youtubevideoparser.StreamItem, video []*youtubevideoparser.StreamItem, rate func(*youtubevideoparser.StreamItem) int) (string, error) {
+	var (
+		b           = strings.Builder{}
+		group       = ""
+		audioCodecs = ""
+		audioRate   = 0
+	)
+	if len(video) == 0 {
+		return "", fmt.Errorf("no mp4 video stream")
+	}
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if len(audio) > 0 {
+		group = ",AUDIO=\"audio\""
+		// 默认选择码率最高的音频,变体码率也按它计算
+		var best = audio[0]
+		for _, s := range audio {
+			if rate(s) > rate(best) {
+				best = s
+			}
+		}
+		_, audioCodecs = parseType(best.Type)
+		audioRate = rate(best)
+		for _, s := range audio {
+			var def = "NO"
+			if s == best {
+				def = "YES"
+			}
+			b.WriteString(fmt.Sprintf("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"%s\",DEFAULT=%s,AUTOSELECT=%s,URI=\"%s\"\n", s.Itag, def, def, playlistURL(ID, s.Itag)))
+		}
+	}
+	for _, s := range video {
+		var (
+			_, codecs = parseType(s.Type)
+			bandwidth = rate(s) + audioRate
+		)
+		if audioCodecs != "" {
+			codecs += "," + audioCodecs
+		}
+		b.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"%s\n%s\n", bandwidth, codecs, group, playlistURL(ID, s.Itag)))
+	}
+	return b.String(), nil
+}
+
+// buildMedia 使用sidx中的分段信息生成byterange形式的media playlist,分段地址指向单流代理
+func buildMedia(vid string, s *youtubevideoparser.StreamItem, ID string) (string, error) {
+	index, err := getIndex(vid, s)
+	if err != nil {
+		return "", err
+	}
+	var (
+		uri    = fmt.Sprintf("%s/%s.mp4", ID, s.Itag)
+		b      = strings.Builder{}
+		target = 0.0
+	)
+	for _, seg := range index.Segments {
+		target = math.Max(target, index.Seconds(seg.Duration))
+	}
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n", int(math.Ceil(target))))
+	b.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@%d\"\n", uri, index.InitEnd-index.InitStart+1, index.InitStart))
+	for _, seg := range index.Segments {
+		b.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n#EXT-X-BYTERANGE:%d@%d\n%s\n", index.Seconds(seg.Duration), seg.End-seg.Start+1, seg.Start, uri))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String(), nil
+}
+
+func mp4Streams(items []*youtubevideoparser.StreamItem) []*youtubevideoparser.StreamItem {
+	var res = []*youtubevideoparser.StreamItem{}
+	for _, s := range items {
+		if mime, _ := parseType(s.Type); strings.HasSuffix(mime, "/mp4") {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+func playlistURL(ID string, itag string) string {
+	return fmt.Sprintf("%s.m3u8?itag=%s", url.PathEscape(ID), itag)
+}
+
+func atoi64(s string) int64 {
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
@@ -0,0 +1,25 @@
+package video
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/suconghou/youtubevideoparser"
+)
+
+func TestM3u8RejectWebm(t *testing.T) {
+	s := &youtubevideoparser.StreamItem{Itag: "247", Type: `video/webm; codecs="vp9"`, ContentLength: "1000", URL: "https://example.com/?itag=247"}
+	s.InitRange.Start, s.InitRange.End = "0", "99"
+	s.IndexRange.Start, s.IndexRange.End = "100", "199"
+	info := &youtubevideoparser.VideoInfo{ID: "abcdefghijk", Duration: "60", Streams: map[string]*youtubevideoparser.StreamItem{"247": s}}
+	for _, itag := range []string{"247", "999"} {
+		rec := httptest.NewRecorder()
+		if err := outPutM3u8(rec, httptest.NewRequest("GET", "/video/abcdefghijk.m3u8?itag="+itag, nil), info); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusNotFound {
+			t.Fatal(itag, rec.Code, rec.Body.String())
+		}
+	}
+}
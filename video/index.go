@@ -0,0 +1,26 @@
+package video
+
+import (
+	"strings"
+
+	"github.com/suconghou/videoproxy/media"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+// cachedIndex 已缓存的分段索引
+func cachedIndex(id string, s *youtubevideoparser.StreamItem) (*media.Index, bool) {
+	return media.Cached(id + "/" + s.Itag)
+}
+
+// getIndex 获取流的分段索引,按 ID/itag 缓存
+func getIndex(id string, s *youtubevideoparser.StreamItem) (*media.Index, error) {
+	return media.Load(id+"/"+s.Itag, media.Source{
+		URL:        s.URL,
+		Size:       atoi64(s.ContentLength),
+		WebM:       strings.Contains(s.Type, "webm"),
+		InitStart:  atoi64(s.InitRange.Start),
+		InitEnd:    atoi64(s.InitRange.End),
+		IndexStart: atoi64(s.IndexRange.Start),
+		IndexEnd:   atoi64(s.IndexRange.End),
+	}, videoClient)
+}
@@ -0,0 +1,194 @@
+package video
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/suconghou/videoproxy/store"
+	"github.com/suconghou/videoproxy/util"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+const (
+	// 地址过期前预留的时间
+	infoSafeMargin = 10 * 60
+	// 地址中没有expire参数时的缓存时间
+	infoDefaultTTL = 3600
+	// 刚解析过的不再强制刷新,避免大量分段请求同时过期时重复解析
+	infoRefreshGap = 10
+	// 直播的解析结果只缓存较短时间,直播结束后尽快切换为点播
+	infoLiveTTL = 60
+)
+
+type infoEntry struct {
+	id      string
+	info    *youtubevideoparser.VideoInfo
+	created int64
+	expire  int64
+}
+
+// infoCall 正在进行的解析,同一ID的并发请求合并为一次
+type infoCall struct {
+	wg   sync.WaitGroup
+	info *youtubevideoparser.VideoInfo
+	err  error
+}
+
+// infoCache 解析结果缓存,按LRU淘汰
+type infoCache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	lru   *list.List
+	calls map[string]*infoCall
+}
+
+var infos = newInfoCache(infoCacheSize())
+
+func infoCacheSize() int {
+	if n, err := strconv.Atoi(os.Getenv("INFO_CACHE_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return 1000
+}
+
+func newInfoCache(size int) *infoCache {
+	return &infoCache{
+		size:  size,
+		items: map[string]*list.Element{},
+		lru:   list.New(),
+		calls: map[string]*infoCall{},
+	}
+}
+
+// get fresh为true时忽略缓存重新解析
+func (c *infoCache) get(id string, fresh bool) (*youtubevideoparser.VideoInfo, error) {
+	var now = time.Now().Unix()
+	c.mu.Lock()
+	if el, ok := c.items[id]; ok {
+		var e = el.Value.(*infoEntry)
+		if e.expire > now && (!fresh || now-e.created < infoRefreshGap) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			atomic.AddInt64(&counter.InfoHit, 1)
+			return e.info, nil
+		}
+	}
+	if call, ok := c.calls[id]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.info, call.err
+	}
+	var call = &infoCall{}
+	call.wg.Add(1)
+	c.calls[id] = call
+	c.mu.Unlock()
+	atomic.AddInt64(&counter.InfoMiss, 1)
+
+	if !fresh {
+		call.info = loadSharedInfo(id, now)
+	}
+	if call.info == nil {
+		call.info, call.err = youtubevideoparser.Parse(id, videoClient)
+		if call.err == nil {
+			saveSharedInfo(id, call.info, now)
+		}
+	}
+
+	c.mu.Lock()
+	delete(c.calls, id)
+	if call.err == nil {
+		c.set(id, call.info, now)
+	}
+	c.mu.Unlock()
+	call.wg.Done()
+	return call.info, call.err
+}
+
+// set 需持有锁
+func (c *infoCache) set(id string, info *youtubevideoparser.VideoInfo, now int64) {
+	var ttl = infoTTL(info, now)
+	if el, ok := c.items[id]; ok {
+		c.lru.Remove(el)
+		delete(c.items, id)
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.items[id] = c.lru.PushFront(&infoEntry{id, info, now, now + ttl})
+	for c.lru.Len() > c.size {
+		var el = c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.items, el.Value.(*infoEntry).id)
+	}
+}
+
+// loadSharedInfo 本地未命中时查找其他实例写入共享存储的解析结果
+func loadSharedInfo(id string, now int64) *youtubevideoparser.VideoInfo {
+	if store.Shared == nil {
+		return nil
+	}
+	data, ok, err := store.Shared.Get("info:" + id)
+	if err != nil {
+		util.Log.Print(err)
+	}
+	if !ok {
+		return nil
+	}
+	var info = &youtubevideoparser.VideoInfo{}
+	if err = json.Unmarshal(data, info); err != nil || infoTTL(info, now) <= 0 {
+		return nil
+	}
+	return info
+}
+
+func saveSharedInfo(id string, info *youtubevideoparser.VideoInfo, now int64) {
+	if store.Shared == nil {
+		return
+	}
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = store.Shared.Set("info:"+id, data, time.Duration(infoTTL(info, now))*time.Second)
+	}
+	if err != nil {
+		util.Log.Print(err)
+	}
+}
+
+func (c *infoCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// infoTTL 取各个流地址中最早的expire,减去预留时间,直播不超过infoLiveTTL
+func infoTTL(info *youtubevideoparser.VideoInfo, now int64) int64 {
+	var ttl = streamTTL(info, now)
+	if ttl > infoLiveTTL && isLive(info) {
+		return infoLiveTTL
+	}
+	return ttl
+}
+
+func streamTTL(info *youtubevideoparser.VideoInfo, now int64) int64 {
+	var expire int64
+	for _, s := range info.Streams {
+		u, err := url.Parse(s.URL)
+		if err != nil {
+			continue
+		}
+		if t, err := strconv.ParseInt(u.Query().Get("expire"), 10, 64); err == nil && (expire == 0 || t < expire) {
+			expire = t
+		}
+	}
+	if expire == 0 {
+		return infoDefaultTTL
+	}
+	return expire - now - infoSafeMargin
+}
@@ -0,0 +1,267 @@
+package video
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/suconghou/videoproxy/media"
+	"github.com/suconghou/videoproxy/request"
+	"github.com/suconghou/videoproxy/util"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+var (
+	// 直播时移窗口包含的分段数
+	liveWindow int64 = 30
+	// 无法推算时使用的直播分段时长(秒)
+	liveSegment = 5.0
+	// 初始化段取自最新的分段,缓存时间(秒)
+	liveInitTTL int64 = 600
+	// 直播流没有文件大小,码率按常见itag估算
+	liveBandwidth = map[string]int{
+		"140": 128000,
+		"160": 100000,
+		"133": 250000,
+		"134": 700000,
+		"135": 1200000,
+		"136": 2500000,
+		"137": 5000000,
+		"298": 4000000,
+		"299": 7500000,
+	}
+)
+
+// isLive 没有可用的点播流,并且时长无效或地址中带有直播标记;直播结束后会有点播流,自动切换为点播形式
+func isLive(info *youtubevideoparser.VideoInfo) bool {
+	var live = false
+	if d, err := strconv.Atoi(info.Duration); err != nil || d <= 0 {
+		live = true
+	}
+	for _, s := range info.Streams {
+		if usable(s) {
+			return false
+		}
+		if u, err := url.Parse(s.URL); err == nil {
+			var q = u.Query()
+			if q.Get("live") == "1" || q.Get("source") == "yt_live_broadcast" {
+				live = true
+			}
+		}
+	}
+	return live
+}
+
+func liveUsable(v *youtubevideoparser.StreamItem) bool {
+	return v.URL != ""
+}
+
+func liveRate(s *youtubevideoparser.StreamItem) int {
+	if n, ok := liveBandwidth[s.Itag]; ok {
+		return n
+	}
+	return 1000000
+}
+
+// liveHead 请求直播流的最新分段,从响应头中取得最新的分段序号,分段时长使用媒体时间与序号推算
+func liveHead(s *youtubevideoparser.StreamItem) (int64, float64, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	res, err := videoClient.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("%s live head : %s", s.Itag, res.Status)
+	}
+	head, err := strconv.ParseInt(res.Header.Get("X-Head-Seqnum"), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s live head not found", s.Itag)
+	}
+	var duration = liveSegment
+	if ms, err := strconv.ParseInt(res.Header.Get("X-Head-Time-Millis"), 10, 64); err == nil && ms > 0 && head > 0 {
+		duration = math.Round(float64(ms)/float64(head)) / 1000
+	}
+	return head, duration, nil
+}
+
+// liveStreams 直播的音视频流及当前窗口
+func liveStreams(info *youtubevideoparser.VideoInfo, q mpdQuery) ([]*youtubevideoparser.StreamItem, []*youtubevideoparser.StreamItem, int64, int64, float64, error) {
+	var (
+		audio = findStreams(info, streamQuery{prefers: q.a, mime: "audio", ladder: q.ladder, live: true, filter: q.filter})
+		video = findStreams(info, streamQuery{prefers: q.v, mime: "video", ladder: q.ladder, live: true, filter: q.filter})
+	)
+	if len(audio) == 0 || len(video) == 0 {
+		if q.filter != nil {
+			return nil, nil, 0, 0, 0, q.filter.incompatible(info)
+		}
+		return nil, nil, 0, 0, 0, fmt.Errorf("failed to get live video or audio")
+	}
+	head, duration, err := liveHead(video[0])
+	if err != nil {
+		return nil, nil, 0, 0, 0, err
+	}
+	var first = head - liveWindow + 1
+	if first < 0 {
+		first = 0
+	}
+	return audio, video, first, head, duration, nil
+}
+
+func outPutLiveMpd(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.VideoInfo) error {
+	q, err := parseMpdQuery(r)
+	if err != nil {
+		util.JSONPut(w, resp{-1, err.Error()}, http.StatusBadRequest, 1)
+		return err
+	}
+	var ID = pathID(r, ".mpd")
+	audio, video, _, head, duration, err := liveStreams(info, q)
+	if err != nil {
+		if vod, ok := endedLive(info.ID); ok {
+			return outPutMpd(w, r, vod)
+		}
+		putCodecError(w, err)
+		return err
+	}
+	var (
+		now   = time.Now().UTC()
+		start = now.Add(-time.Duration(float64(head+1) * duration * float64(time.Second)))
+		b     = strings.Builder{}
+	)
+	b.WriteString(fmt.Sprintf("<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-live:2011\" type=\"dynamic\" availabilityStartTime=\"%s\" publishTime=\"%s\" minimumUpdatePeriod=\"PT%.3fS\" timeShiftBufferDepth=\"PT%.3fS\" minBufferTime=\"PT%.3fS\" suggestedPresentationDelay=\"PT%.3fS\"><Period id=\"0\" start=\"PT0S\">",
+		start.Format(time.RFC3339), now.Format(time.RFC3339), duration, float64(liveWindow)*duration, 2*duration, 3*duration))
+	for _, items := range [][]*youtubevideoparser.StreamItem{video, audio} {
+		for _, g := range groupStreams(items) {
+			var ext = "mp4"
+			if strings.Contains(g.mime, "webm") {
+				ext = "webm"
+			}
+			b.WriteString(fmt.Sprintf("<AdaptationSet mimeType=\"%s\" segmentAlignment=\"true\" startWithSAP=\"1\">", g.mime))
+			b.WriteString(fmt.Sprintf("<SegmentTemplate timescale=\"1000\" duration=\"%d\" startNumber=\"0\" initialization=\"%s/$RepresentationID$/sq/init.%s\" media=\"%s/$RepresentationID$/sq/$Number$.%s\"/>", int(duration*1000), ID, ext, ID, ext))
+			for _, item := range g.items {
+				b.WriteString(representation(item, liveRate(item), media.Track{}))
+				b.WriteString("</Representation>")
+			}
+			b.WriteString("</AdaptationSet>")
+		}
+	}
+	b.WriteString("</Period></MPD>")
+	return putLive(w, "application/dash+xml", duration, b.String())
+}
+
+func outPutLiveM3u8(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.VideoInfo) error {
+	var (
+		itag                                     = r.URL.Query().Get("itag")
+		ID                                       = pathID(r, ".m3u8")
+		audio, video, first, head, duration, err = liveStreams(info, mpdQuery{ladder: true})
+		text                                     string
+	)
+	if err != nil {
+		if vod, ok := endedLive(info.ID); ok {
+			return outPutM3u8(w, r, vod)
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	if itag == "" {
+		if text, err = buildMaster(ID, mp4Streams(audio), mp4Streams(video), liveRate); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return err
+		}
+		return putLive(w, "application/vnd.apple.mpegurl", duration, text)
+	}
+	if s := info.Streams[itag]; s == nil || !liveUsable(s) {
+		http.NotFound(w, r)
+		return nil
+	}
+	var b = strings.Builder{}
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	b.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n", int(math.Ceil(duration)), first))
+	b.WriteString(fmt.Sprintf("#EXT-X-MAP:URI=\"%s/%s/sq/init.mp4\"\n", ID, itag))
+	for n := first; n <= head; n++ {
+		b.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n%s/%s/sq/%d.mp4\n", duration, ID, itag, n))
+	}
+	return putLive(w, "application/vnd.apple.mpegurl", duration, b.String())
+}
+
+// endedLive 直播清单获取失败时重新解析,直播已结束并且有点播流时返回新的解析结果,不必等待解析缓存过期
+func endedLive(id string) (*youtubevideoparser.VideoInfo, bool) {
+	info, err := refreshinfo(id)
+	if err != nil || info == nil || isLive(info) {
+		return nil, false
+	}
+	return info, true
+}
+
+// putLive 直播清单需要播放器定时刷新,只缓存一个分段时长,也不存储数据库
+func putLive(w http.ResponseWriter, mime string, duration float64, text string) error {
+	h := w.Header()
+	h.Set("Content-Type", mime)
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Max-Age", "864000")
+	h.Set("Cache-Control", fmt.Sprintf("public,max-age=%d", int(duration)))
+	_, err := w.Write([]byte(text))
+	return err
+}
+
+// ProxyLive proxy a live segment by sequence number
+func ProxyLive(w http.ResponseWriter, r *http.Request, match []string) error {
+	info, err := getinfo(match[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	s := info.Streams[match[2]]
+	if s == nil || !liveUsable(s) {
+		http.NotFound(w, r)
+		return nil
+	}
+	return request.ProxyData(w, r, s.URL+"&sq="+match[3], videoClient, refresher(info.ID, s.Itag, "&sq="+match[3]))
+}
+
+// ProxyLiveInit 直播分段自带初始化信息,从最新的分段中取出初始化段,不包含媒体数据
+func ProxyLiveInit(w http.ResponseWriter, r *http.Request, match []string) error {
+	info, err := getinfo(match[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	s := info.Streams[match[2]]
+	if s == nil || !liveUsable(s) {
+		http.NotFound(w, r)
+		return nil
+	}
+	var webm = match[3] == "webm"
+	// 只缓存取出的初始化段,不缓存整个分段;合并的请求不随某个客户端取消
+	init, err := media.LoadInitSegment(info.ID+"/"+s.Itag+"/"+match[3], liveInitTTL, func() ([]byte, error) {
+		data, _, _, err := request.Get(s.URL, videoClient, http.Header{})
+		if err != nil {
+			return nil, err
+		}
+		defer request.PutBuffer(data)
+		return media.InitSegment(data.Bytes(), webm)
+	})
+	var mime = "video/mp4"
+	if webm {
+		mime = "video/webm"
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	h := w.Header()
+	h.Set("Content-Type", mime)
+	h.Set("Content-Length", strconv.Itoa(len(init)))
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Max-Age", "864000")
+	h.Set("Cache-Control", fmt.Sprintf("public,max-age=%d", liveInitTTL))
+	_, err = w.Write(init)
+	return err
+}
@@ -0,0 +1,163 @@
+package video
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/suconghou/youtubevideoparser"
+)
+
+// liveInfo 直播的解析结果,上游返回最新分段序号100,分段时长5秒
+func liveInfo(t *testing.T) *youtubevideoparser.VideoInfo {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Head-Seqnum", "100")
+		w.Header().Set("X-Head-Time-Millis", "500000")
+	}))
+	t.Cleanup(srv.Close)
+	return &youtubevideoparser.VideoInfo{
+		ID:       "abcdefghijk",
+		Duration: "0",
+		Streams: map[string]*youtubevideoparser.StreamItem{
+			"140": {Itag: "140", Type: `audio/mp4; codecs="mp4a.40.2"`, URL: srv.URL + "/?itag=140&live=1"},
+			"136": {Itag: "136", Type: `video/mp4; codecs="avc1.4d401f"`, URL: srv.URL + "/?itag=136&live=1"},
+		},
+	}
+}
+
+func TestLiveMpd(t *testing.T) {
+	info := liveInfo(t)
+	rec := httptest.NewRecorder()
+	if err := outPutMpd(rec, httptest.NewRequest("GET", "/video/abcdefghijk.mpd", nil), info); err != nil {
+		t.Fatal(err)
+	}
+	body := rec.Body.String()
+	for _, s := range []string{`type="dynamic"`, `initialization="abcdefghijk/$RepresentationID$/sq/init.mp4"`, `media="abcdefghijk/$RepresentationID$/sq/$Number$.mp4"`, `duration="5000"`} {
+		if !strings.Contains(body, s) {
+			t.Fatal(s, body)
+		}
+	}
+}
+
+func TestLiveM3u8(t *testing.T) {
+	info := liveInfo(t)
+	rec := httptest.NewRecorder()
+	if err := outPutM3u8(rec, httptest.NewRequest("GET", "/video/abcdefghijk.m3u8?itag=136", nil), info); err != nil {
+		t.Fatal(err)
+	}
+	body := rec.Body.String()
+	// 初始化段不再指向窗口内的媒体分段
+	for _, s := range []string{"#EXT-X-MEDIA-SEQUENCE:71\n", "#EXT-X-MAP:URI=\"abcdefghijk/136/sq/init.mp4\"\n", "abcdefghijk/136/sq/100.mp4\n"} {
+		if !strings.Contains(body, s) {
+			t.Fatal(s, body)
+		}
+	}
+	if strings.Contains(body, "EXT-X-MAP:URI=\"abcdefghijk/136/sq/71.mp4\"") {
+		t.Fatal(body)
+	}
+}
+
+func TestInfoTTLLive(t *testing.T) {
+	var (
+		now    = time.Now().Unix()
+		expire = func(d int64) string { return "&expire=" + strconv.FormatInt(now+d, 10) }
+		vod    = &youtubevideoparser.StreamItem{ContentLength: "1", URL: "https://example.com/?a=1" + expire(6*3600)}
+		live   = &youtubevideoparser.StreamItem{URL: "https://example.com/?live=1" + expire(6*3600)}
+	)
+	vod.InitRange.Start, vod.IndexRange.Start = "0", "100"
+	if ttl := infoTTL(&youtubevideoparser.VideoInfo{Duration: "60", Streams: map[string]*youtubevideoparser.StreamItem{"136": vod}}, now); ttl != 6*3600-infoSafeMargin {
+		t.Fatal("vod", ttl)
+	}
+	var info = &youtubevideoparser.VideoInfo{Duration: "0", Streams: map[string]*youtubevideoparser.StreamItem{"136": live}}
+	if ttl := infoTTL(info, now); ttl != infoLiveTTL {
+		t.Fatal("live", ttl)
+	}
+	// 地址的过期时间更早时仍以地址为准
+	live.URL = "https://example.com/?live=1" + expire(infoSafeMargin+10)
+	if ttl := infoTTL(info, now); ttl != 10 {
+		t.Fatal("live expire", ttl)
+	}
+}
+
+func TestFindStreams(t *testing.T) {
+	item := func(itag, typ string) *youtubevideoparser.StreamItem {
+		s := &youtubevideoparser.StreamItem{Itag: itag, Type: typ, ContentLength: "1", URL: "u"}
+		s.InitRange.Start, s.IndexRange.Start = "0", "1"
+		return s
+	}
+	info := &youtubevideoparser.VideoInfo{Streams: map[string]*youtubevideoparser.StreamItem{
+		"140": item("140", `audio/mp4; codecs="mp4a.40.2"`),
+		"251": item("251", `audio/webm; codecs="opus"`),
+		"136": item("136", `video/mp4; codecs="avc1.4d401f"`),
+		"247": item("247", `video/webm; codecs="vp9"`),
+		"18":  {Itag: "18", Type: `video/mp4; codecs="avc1.42001E, mp4a.40.2"`, URL: "u"},
+	}}
+	tests := []struct {
+		name string
+		q    streamQuery
+		want string
+	}{
+		{"default audio", streamQuery{mime: "audio"}, "251,140"},
+		{"default video", streamQuery{mime: "video"}, "247,136"},
+		{"prefer", streamQuery{prefers: "136, 999", mime: "video"}, "136"},
+		{"prefer unavailable", streamQuery{prefers: "999", mime: "video"}, "136,247"},
+		{"ladder ignores prefer", streamQuery{prefers: "136", mime: "video", ladder: true}, "247,136"},
+		{"filter", streamQuery{mime: "video", filter: codecFilter{"avc1": true}}, "136"},
+		{"live", streamQuery{mime: "video", ladder: true, live: true}, "247,136,18"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, s := range findStreams(info, tt.q) {
+				got = append(got, s.Itag)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Fatalf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyLiveInit(t *testing.T) {
+	box := func(name string, body []byte) []byte {
+		b := make([]byte, 8, 8+len(body))
+		binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+		copy(b[4:], name)
+		return append(b, body...)
+	}
+	var (
+		calls int32
+		head  = append(box("ftyp", []byte("iso5")), box("moov", make([]byte, 100))...)
+		seg   = append(append(append([]byte{}, head...), box("moof", make([]byte, 16))...), box("mdat", make([]byte, 4096))...)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Write(seg)
+	}))
+	defer srv.Close()
+	var info = &youtubevideoparser.VideoInfo{ID: "liveinitabc", Duration: "0", Streams: map[string]*youtubevideoparser.StreamItem{
+		"136": {Itag: "136", Type: `video/mp4; codecs="avc1.4d401f"`, URL: srv.URL + "/?itag=136&live=1"},
+	}}
+	infos.mu.Lock()
+	infos.set(info.ID, info, time.Now().Unix())
+	infos.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		if err := ProxyLiveInit(rec, httptest.NewRequest("GET", "/video/liveinitabc/136/sq/init.mp4", nil), []string{"", info.ID, "136", "mp4"}); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), head) {
+			t.Fatal(rec.Code, rec.Body.Len())
+		}
+	}
+	// 第二次使用缓存的初始化段
+	if calls != 1 {
+		t.Fatal(calls)
+	}
+}
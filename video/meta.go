@@ -0,0 +1,120 @@
+package video
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/suconghou/videoproxy/media"
+	"github.com/suconghou/videoproxy/request"
+	"github.com/suconghou/videoproxy/util"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+// chapterReg 描述中的章节行,如 0:00 Intro , 1:02:03 - Title
+var chapterReg = regexp.MustCompile(`^\s*(?:(\d{1,2}):)?(\d{1,2}):(\d{2})\s*(?:[-–—:|]\s*)?(.+?)\s*$`)
+
+// parseChapters 与youtube的规则一致: 第一个章节从0:00开始,至少3个,时间递增
+func parseChapters(desc string) []media.Chapter {
+	var chapters = []media.Chapter{}
+	for _, line := range strings.Split(desc, "\n") {
+		var m = chapterReg.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		h, _ := strconv.Atoi(m[1])
+		minute, _ := strconv.Atoi(m[2])
+		sec, _ := strconv.Atoi(m[3])
+		var start = float64(h*3600 + minute*60 + sec)
+		if n := len(chapters); (n == 0 && start != 0) || (n > 0 && start <= chapters[n-1].Start) {
+			return nil
+		}
+		chapters = append(chapters, media.Chapter{Start: start, Title: m[4]})
+	}
+	if len(chapters) < 3 {
+		return nil
+	}
+	return chapters
+}
+
+// loadMetadata 标题来自解析结果,作者,日期,描述来自player response,封面为hqdefault,获取失败的部分忽略并返回false
+// 结果按ID缓存,同一文件的多次range请求布局一致
+func loadMetadata(info *youtubevideoparser.VideoInfo) media.Metadata {
+	return media.LoadMetadata(info.ID, func() (media.Metadata, bool) {
+		return fetchMetadata(info)
+	})
+}
+
+func fetchMetadata(info *youtubevideoparser.VideoInfo) (media.Metadata, bool) {
+	var (
+		meta     = media.Metadata{Title: info.Title}
+		complete = true
+	)
+	meta.Duration, _ = strconv.ParseFloat(info.Duration, 64)
+	if p, err := getPlayer(info.ID); err == nil {
+		var (
+			mf   = p.Microformat.PlayerMicroformatRenderer
+			date = mf.UploadDate
+		)
+		if date == "" {
+			date = mf.PublishDate
+		}
+		if len(date) > 10 {
+			date = date[:10]
+		}
+		meta.Author = p.VideoDetails.Author
+		meta.Date = date
+		meta.Description = p.VideoDetails.ShortDescription
+		meta.Chapters = parseChapters(meta.Description)
+	} else {
+		complete = false
+		util.Log.Print(err)
+	}
+	if data, _, status, err := request.Get(youtubeImageHostMap["jpg"]+info.ID+"/hqdefault.jpg", imageClient, http.Header{}); err != nil {
+		complete = false
+		util.Log.Print(err)
+	} else if status != http.StatusOK {
+		complete = false
+		util.Log.Print(info.ID, " cover ", status)
+	} else {
+		meta.Cover = append([]byte{}, data.Bytes()...)
+		request.PutBuffer(data)
+	}
+	return meta, complete
+}
+
+// downloadTagged 下载时写入元数据,封面与章节,无法写入时返回false,由调用方直接代理原文件
+func downloadTagged(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.VideoInfo, s *youtubevideoparser.StreamItem, filename string) (bool, error) {
+	var (
+		file *media.File
+		err  error
+		size = atoi64(s.ContentLength)
+	)
+	if size <= 0 {
+		return false, nil
+	}
+	if strings.Contains(s.Type, "mp4") {
+		var movie *media.Movie
+		if movie, err = media.LoadMovie(info.ID+"/"+s.Itag, s.URL, size, videoClient); err == nil {
+			file, err = media.TagMp4(movie, s.URL, loadMetadata(info))
+		}
+	} else if usable(s) {
+		var index *media.Index
+		if index, err = getIndex(info.ID, s); err == nil {
+			file, err = media.TagWebm(index, s.URL, loadMetadata(info))
+		}
+	} else {
+		return false, nil
+	}
+	if err != nil {
+		util.Log.Print(info.ID, " ", s.Itag, " ", err)
+		return false, nil
+	}
+	return true, file.Serve(w, r, videoClient, func(h http.Header) {
+		name := url.PathEscape(filename)
+		h.Set("Content-Disposition", fmt.Sprintf("attachment;filename* = UTF-8''%s", name))
+	}, []func() (string, error){refresher(info.ID, s.Itag, "")})
+}
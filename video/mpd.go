@@ -1,12 +1,20 @@
 package video
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
+	"html"
+	"math"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/suconghou/videoproxy/db"
+	"github.com/suconghou/videoproxy/media"
 	"github.com/suconghou/videoproxy/util"
 	"github.com/suconghou/youtubevideoparser"
 )
@@ -14,8 +22,44 @@ import (
 var (
 	alist = "250,249,251,600,140,599"
 	vlist = "247,136,302,398,244,135,397,243,134,396,242,133,395,278,598,160,597"
+	// 60帧的itag,mp4的初始化段中通常取不到帧率
+	hfrItags = map[string]bool{
+		"298": true, "299": true, "302": true, "303": true, "308": true, "315": true,
+		"334": true, "335": true, "336": true, "337": true,
+		"398": true, "399": true, "400": true, "401": true,
+		"694": true, "695": true, "696": true, "697": true, "698": true, "699": true, "700": true, "701": true, "702": true,
+	}
+	// 视频itag的标称分辨率(短边),同一视频各流的宽高比相同,可由一路流的宽高推算其余的
+	itagHeights = map[string]int{
+		"160": 144, "278": 144, "330": 144, "394": 144, "597": 144, "598": 144, "694": 144,
+		"133": 240, "242": 240, "331": 240, "395": 240, "695": 240,
+		"134": 360, "243": 360, "332": 360, "396": 360, "696": 360,
+		"135": 480, "244": 480, "333": 480, "397": 480, "697": 480,
+		"136": 720, "247": 720, "298": 720, "302": 720, "334": 720, "398": 720, "698": 720,
+		"137": 1080, "248": 1080, "299": 1080, "303": 1080, "335": 1080, "399": 1080, "699": 1080,
+		"264": 1440, "271": 1440, "308": 1440, "336": 1440, "400": 1440, "700": 1440,
+		"266": 2160, "313": 2160, "315": 2160, "337": 2160, "401": 2160, "701": 2160,
+		"272": 4320, "402": 4320, "571": 4320, "702": 4320,
+	}
+	// opus的采样率固定为48000
+	opusItags = map[string]bool{"249": true, "250": true, "251": true, "600": true}
 )
 
+// mpdQuery 生成mpd的参数,mode为list时输出SegmentList
+type mpdQuery struct {
+	a      string
+	v      string
+	ladder bool
+	mode   string
+	filter codecFilter
+}
+
+// 同一编码族的流放在同一个AdaptationSet中,播放器才能无缝切换
+type streamGroup struct {
+	mime  string
+	items []*youtubevideoparser.StreamItem
+}
+
 func formatDuration(t int) string {
 	var text = "PT"
 	var hour = t / 3600
@@ -32,9 +76,17 @@ func formatDuration(t int) string {
 }
 
 func outPutMpd(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.VideoInfo) error {
-	xml, err := buildXML(r, info)
+	if isLive(info) {
+		return outPutLiveMpd(w, r, info)
+	}
+	q, err := parseMpdQuery(r)
+	if err != nil {
+		util.JSONPut(w, resp{-1, err.Error()}, http.StatusBadRequest, 1)
+		return err
+	}
+	xml, err := buildXML(r, info, q)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		putCodecError(w, err)
 		return err
 	}
 	h := w.Header()
@@ -43,95 +95,493 @@ func outPutMpd(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.
 	h.Set("Access-Control-Max-Age", "864000")
 	h.Set("Cache-Control", "public,max-age=864000")
 	_, err = w.Write([]byte(xml))
-	if er := db.SaveCacheItem(info.ID, xml, db.TABLE_CACHEMPD); er != nil {
+	if er := db.SaveCacheVariant(info.ID, q.variant(), xml, db.TABLE_CACHEMPD); er != nil {
 		util.Log.Print(er)
 	}
 	return err
 }
 
-func buildXML(r *http.Request, info *youtubevideoparser.VideoInfo) (string, error) {
+func buildXML(r *http.Request, info *youtubevideoparser.VideoInfo, q mpdQuery) (string, error) {
 	duration, err := strconv.Atoi(info.Duration)
 	if err != nil {
 		return "", err
 	}
+	if duration <= 0 {
+		return "", fmt.Errorf("bad duration %s", info.Duration)
+	}
 	var (
-		query   = r.URL.Query()
 		t       = formatDuration(duration)
 		b       = strings.Builder{}
-		header  = fmt.Sprintf("<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"urn:mpeg:dash:profile:isoff-on-demand:2011\" minBufferTime=\"PT2S\" mediaPresentationDuration=\"%s\" type=\"static\"><Period>", t)
+		profile = "urn:mpeg:dash:profile:isoff-on-demand:2011"
 		video   string
 		audio   string
-		patharr = strings.Split(strings.ReplaceAll(r.URL.Path, ".mpd", ""), "/")
+		ID      = pathID(r, ".mpd")
 	)
-	var ID = patharr[len(patharr)-1]
-	audio, video, err = buildItem(info, ID, duration, query.Get("a"), query.Get("v"))
+	if q.mode == "list" {
+		profile = "urn:mpeg:dash:profile:full:2011"
+	}
+	var header = fmt.Sprintf("<MPD xmlns=\"urn:mpeg:dash:schema:mpd:2011\" profiles=\"%s\" minBufferTime=\"PT2S\" mediaPresentationDuration=\"%s\" type=\"static\"><Period>", profile, t)
+	audio, video, err = buildItem(info, ID, duration, q)
 	if err != nil {
 		return "", err
 	}
 	b.WriteString(header)
-	b.WriteString("<AdaptationSet segmentAlignment=\"true\">")
 	b.WriteString(video)
-	b.WriteString("</AdaptationSet>")
-	b.WriteString("<AdaptationSet segmentAlignment=\"true\">")
 	b.WriteString(audio)
-	b.WriteString("</AdaptationSet>")
+	b.WriteString(formatCaptions(info, ID))
 	b.WriteString("</Period></MPD>")
 	return b.String(), nil
 }
 
-func buildItem(info *youtubevideoparser.VideoInfo, ID string, duration int, a string, v string) (string, string, error) {
-	audio := findStream(info, a+","+alist, "audio")
-	video := findStream(info, v+","+vlist, "video")
-	if audio == nil || video == nil {
+func parseMpdQuery(r *http.Request) (mpdQuery, error) {
+	var (
+		query       = r.URL.Query()
+		filter, err = parseCodecFilter(query)
+	)
+	return mpdQuery{
+		a:      query.Get("a"),
+		v:      query.Get("v"),
+		ladder: query.Get("ladder") == "1",
+		mode:   query.Get("mode"),
+		filter: filter,
+	}, err
+}
+
+// variant 规范化后的参数摘要,作为mpd缓存的变体标识
+func (q mpdQuery) variant() string {
+	var (
+		a = normalizeList(q.a, alist)
+		v = normalizeList(q.v, vlist)
+	)
+	if q.ladder {
+		a, v = "ladder", "ladder"
+	}
+	var sum = sha1.Sum([]byte(strings.Join([]string{a, v, q.mode, q.filter.String()}, "|")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// normalizeList 去除空项与空白,未指定时使用默认列表
+func normalizeList(list string, defaults string) string {
+	var items = []string{}
+	for _, itag := range strings.Split(list, ",") {
+		if itag = strings.TrimSpace(itag); itag != "" {
+			items = append(items, itag)
+		}
+	}
+	if len(items) == 0 {
+		return defaults
+	}
+	return strings.Join(items, ",")
+}
+
+func buildItem(info *youtubevideoparser.VideoInfo, ID string, duration int, q mpdQuery) (string, string, error) {
+	audio := findStreams(info, streamQuery{prefers: q.a, mime: "audio", ladder: q.ladder, filter: q.filter})
+	video := findStreams(info, streamQuery{prefers: q.v, mime: "video", ladder: q.ladder, filter: q.filter})
+	if len(audio) == 0 || len(video) == 0 {
+		if q.filter != nil {
+			return "", "", q.filter.incompatible(info)
+		}
 		return "", "", fmt.Errorf("failed to get video or audio")
 	}
-	astr, err := formatItem(ID, duration, audio)
+	var format func(item *youtubevideoparser.StreamItem) (string, error)
+	if q.mode == "list" {
+		// SegmentList需要每个流完整的分段索引
+		indexes, err := loadIndexes(info.ID, append(audio, video...))
+		if err != nil {
+			return "", "", err
+		}
+		format = func(item *youtubevideoparser.StreamItem) (string, error) {
+			return formatListItem(ID, duration, item, indexes[item.Itag])
+		}
+	} else {
+		var tracks = streamTracks(info.ID, audio, video)
+		format = func(item *youtubevideoparser.StreamItem) (string, error) {
+			return formatItem(ID, duration, item, tracks[item.Itag])
+		}
+	}
+	astr, err := formatGroups(groupStreams(audio), format)
 	if err != nil {
 		return "", "", err
 	}
-	vstr, err := formatItem(ID, duration, video)
+	vstr, err := formatGroups(groupStreams(video), format)
 	if err != nil {
 		return "", "", err
 	}
 	return astr, vstr, nil
 }
 
-func formatItem(ID string, duration int, item *youtubevideoparser.StreamItem) (string, error) {
+func formatGroups(groups []*streamGroup, format func(item *youtubevideoparser.StreamItem) (string, error)) (string, error) {
+	var b = strings.Builder{}
+	for _, g := range groups {
+		b.WriteString(fmt.Sprintf("<AdaptationSet mimeType=\"%s\" segmentAlignment=\"true\">", g.mime))
+		for _, item := range g.items {
+			record, err := format(item)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(record)
+		}
+		b.WriteString("</AdaptationSet>")
+	}
+	return b.String(), nil
+}
+
+// streamTracks 普通模式下各流的宽高采样率等属性,优先使用已缓存的索引,opus的采样率取自itag,
+// 其余视频流只读取码率最低的一路,按宽高比推算,读取失败时记录日志并省略这些属性
+func streamTracks(vid string, audio []*youtubevideoparser.StreamItem, video []*youtubevideoparser.StreamItem) map[string]media.Track {
+	var (
+		tracks  = map[string]media.Track{}
+		missing = []*youtubevideoparser.StreamItem{}
+		pending = []*youtubevideoparser.StreamItem{}
+		ref     *youtubevideoparser.StreamItem
+	)
+	for _, item := range audio {
+		if index, ok := cachedIndex(vid, item); ok {
+			tracks[item.Itag] = index.Track
+		} else if opusItags[item.Itag] {
+			tracks[item.Itag] = media.Track{SampleRate: 48000}
+		} else {
+			missing = append(missing, item)
+		}
+	}
+	for _, item := range video {
+		if index, ok := cachedIndex(vid, item); ok {
+			tracks[item.Itag] = index.Track
+			if ref == nil && index.Track.Width > 0 {
+				ref = item
+			}
+		} else {
+			pending = append(pending, item)
+		}
+	}
+	if ref == nil && len(pending) > 0 {
+		var lowest = pending[0]
+		for _, item := range pending[1:] {
+			if contentLength(item) < contentLength(lowest) {
+				lowest = item
+			}
+		}
+		missing = append(missing, lowest)
+	}
+	indexes, err := loadIndexes(vid, missing)
+	if err != nil {
+		util.Log.Print(err)
+	}
+	for _, item := range missing {
+		if index, ok := indexes[item.Itag]; ok {
+			tracks[item.Itag] = index.Track
+			if ref == nil && index.Track.Width > 0 && strings.Contains(item.Type, "video") {
+				ref = item
+			}
+		}
+	}
+	if ref == nil {
+		return tracks
+	}
+	for _, item := range pending {
+		if _, ok := tracks[item.Itag]; !ok {
+			tracks[item.Itag] = scaleTrack(tracks[ref.Itag], hfrItags[ref.Itag], itagHeights[item.Itag])
+		}
+	}
+	return tracks
+}
+
+// scaleTrack 按参考流的宽高比推算标称分辨率为label的宽高,标称分辨率为16:9(竖屏为9:16)的框,参考流不是60帧时帧率相同
+func scaleTrack(ref media.Track, hfr bool, label int) media.Track {
+	if ref.Width <= 0 || ref.Height <= 0 || label <= 0 {
+		return media.Track{}
+	}
+	var boxW, boxH = float64(label) * 16 / 9, float64(label)
+	if ref.Width < ref.Height {
+		boxW, boxH = boxH, boxW
+	}
+	var (
+		scale = math.Min(boxW/float64(ref.Width), boxH/float64(ref.Height))
+		track = media.Track{
+			Width:  int(math.Round(float64(ref.Width)*scale/2)) * 2,
+			Height: int(math.Round(float64(ref.Height)*scale/2)) * 2,
+		}
+	)
+	if !hfr {
+		track.FrameRate = ref.FrameRate
+	}
+	return track
+}
+
+func formatItem(ID string, duration int, item *youtubevideoparser.StreamItem, track media.Track) (string, error) {
 	len, err := strconv.Atoi(item.ContentLength)
 	if err != nil {
 		return "", err
 	}
 	var (
 		ext        = "mp4"
-		typeinfo   = strings.Split(item.Type, ";")
-		mime       = typeinfo[0]
-		codecs     = typeinfo[1]
 		indexRange = fmt.Sprintf("%s-%s", item.IndexRange.Start, item.IndexRange.End)
 		initRange  = fmt.Sprintf("%s-%s", item.InitRange.Start, item.InitRange.End)
 		bandwidth  = 8 * (len / duration)
 	)
-	if strings.Contains(mime, "webm") {
+	if strings.Contains(item.Type, "webm") {
 		ext = "webm"
 	}
 	var (
 		baseurl = fmt.Sprintf("%s/%s.%s", ID, item.Itag, ext)
-		record  = fmt.Sprintf("<Representation id=\"%s\" bandwidth=\"%d\" %s mimeType=\"%s\"><BaseURL>%s</BaseURL><SegmentBase indexRange=\"%s\"><Initialization range=\"%s\"/></SegmentBase></Representation>", item.Itag, bandwidth, codecs, mime, baseurl, indexRange, initRange)
+		record  = fmt.Sprintf("%s<BaseURL>%s</BaseURL><SegmentBase indexRange=\"%s\"><Initialization range=\"%s\"/></SegmentBase></Representation>", representation(item, bandwidth, track), baseurl, indexRange, initRange)
 	)
 	return record, nil
 }
 
-func findStream(info *youtubevideoparser.VideoInfo, prefers string, mime string) *youtubevideoparser.StreamItem {
-	for _, itag := range strings.Split(prefers, ",") {
-		if v, ok := info.Streams[itag]; ok {
-			if v.ContentLength != "" && v.InitRange.Start != "" && v.IndexRange.Start != "" {
-				return v
+// representation 输出Representation开始标签与描述子元素,宽高采样率等取自初始化段,缺失时参考itag与codecs
+func representation(item *youtubevideoparser.StreamItem, bandwidth int, track media.Track) string {
+	var (
+		mime, codecs = parseType(item.Type)
+		b            = strings.Builder{}
+	)
+	if track.FrameRate == 0 && hfrItags[item.Itag] {
+		track.FrameRate = 60
+	}
+	if primaries, transfer, matrix, ok := codecColour(codecs); ok {
+		track.Primaries, track.Transfer, track.Matrix = primaries, transfer, matrix
+	}
+	b.WriteString(fmt.Sprintf("<Representation id=\"%s\" bandwidth=\"%d\" codecs=\"%s\" mimeType=\"%s\"", item.Itag, bandwidth, codecs, mime))
+	if track.Width > 0 && track.Height > 0 {
+		b.WriteString(fmt.Sprintf(" width=\"%d\" height=\"%d\"", track.Width, track.Height))
+	}
+	if rate := track.FrameRateString(); rate != "" && strings.HasPrefix(mime, "video") {
+		b.WriteString(fmt.Sprintf(" frameRate=\"%s\"", rate))
+	}
+	if track.SampleRate > 0 {
+		b.WriteString(fmt.Sprintf(" audioSamplingRate=\"%d\"", track.SampleRate))
+	}
+	b.WriteString(">")
+	if track.Channels > 0 {
+		b.WriteString(fmt.Sprintf("<AudioChannelConfiguration schemeIdUri=\"urn:mpeg:dash:23003:3:audio_channel_configuration:2011\" value=\"%d\"/>", track.Channels))
+	}
+	// PQ(16) 与 HLG(18) 为HDR,不支持的播放器据此过滤
+	if track.Transfer == 16 || track.Transfer == 18 {
+		b.WriteString(fmt.Sprintf("<EssentialProperty schemeIdUri=\"urn:mpeg:mpegB:cicp:ColourPrimaries\" value=\"%d\"/>", track.Primaries))
+		b.WriteString(fmt.Sprintf("<EssentialProperty schemeIdUri=\"urn:mpeg:mpegB:cicp:TransferCharacteristics\" value=\"%d\"/>", track.Transfer))
+		b.WriteString(fmt.Sprintf("<EssentialProperty schemeIdUri=\"urn:mpeg:mpegB:cicp:MatrixCoefficients\" value=\"%d\"/>", track.Matrix))
+	}
+	return b.String()
+}
+
+// codecColour 从完整的codecs中取色彩信息, vp09.PP.LL.DD.CC.cp.tc.mc.FF 与 av01.P.LLT.DD.M.CCC.cp.tc.mc.F
+func codecColour(codecs string) (int, int, int, bool) {
+	var (
+		parts = strings.Split(codecs, ".")
+		pos   = 0
+	)
+	switch parts[0] {
+	case "vp09":
+		pos = 5
+	case "av01":
+		pos = 6
+	default:
+		return 0, 0, 0, false
+	}
+	if len(parts) < pos+3 {
+		return 0, 0, 0, false
+	}
+	primaries, err1 := strconv.Atoi(parts[pos])
+	transfer, err2 := strconv.Atoi(parts[pos+1])
+	matrix, err3 := strconv.Atoi(parts[pos+2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, 0, 0, false
+	}
+	return primaries, transfer, matrix, true
+}
+
+// formatCaptions 每种字幕语言输出一个AdaptationSet,地址指向vtt转换接口
+func formatCaptions(info *youtubevideoparser.VideoInfo, ID string) string {
+	var (
+		b    = strings.Builder{}
+		seen = map[string]bool{}
+	)
+	for _, item := range info.Captions {
+		var lang = item.Language
+		if lang == "" || seen[lang] {
+			continue
+		}
+		seen[lang] = true
+		var baseurl = fmt.Sprintf("%s.vtt?lang=%s", ID, url.QueryEscape(lang))
+		b.WriteString(fmt.Sprintf("<AdaptationSet mimeType=\"text/vtt\" lang=\"%s\"><Role schemeIdUri=\"urn:mpeg:dash:role:2011\" value=\"subtitle\"/>", html.EscapeString(lang)))
+		b.WriteString(fmt.Sprintf("<Representation id=\"caption_%s\" bandwidth=\"256\"><BaseURL>%s</BaseURL></Representation></AdaptationSet>", html.EscapeString(lang), html.EscapeString(baseurl)))
+	}
+	return b.String()
+}
+
+// formatListItem 使用分段索引输出SegmentList,每个分段都是ProxyPart路由的一个普通GET请求,无需range请求头
+func formatListItem(ID string, duration int, item *youtubevideoparser.StreamItem, index *media.Index) (string, error) {
+	if index == nil {
+		return "", fmt.Errorf("%s no index", item.Itag)
+	}
+	var (
+		bandwidth = 8 * (contentLength(item) / duration)
+		prefix    = fmt.Sprintf("%s/%s", ID, item.Itag)
+		b         = strings.Builder{}
+	)
+	b.WriteString(representation(item, bandwidth, index.Track))
+	b.WriteString(fmt.Sprintf("<SegmentList timescale=\"%d\"><Initialization sourceURL=\"%s/%d-%d.ts\"/><SegmentTimeline>", index.Timescale, prefix, index.InitStart, index.InitEnd))
+	for i, seg := range index.Segments {
+		if i == 0 {
+			b.WriteString(fmt.Sprintf("<S t=\"%d\" d=\"%d\"/>", seg.Time, seg.Duration))
+		} else {
+			b.WriteString(fmt.Sprintf("<S d=\"%d\"/>", seg.Duration))
+		}
+	}
+	b.WriteString("</SegmentTimeline>")
+	for _, seg := range index.Segments {
+		b.WriteString(fmt.Sprintf("<SegmentURL media=\"%s/%d-%d.ts\"/>", prefix, seg.Start, seg.End))
+	}
+	b.WriteString("</SegmentList></Representation>")
+	return b.String(), nil
+}
+
+// loadIndexes 并发获取各个流的分段索引,返回获取成功的部分与遇到的第一个错误
+func loadIndexes(vid string, items []*youtubevideoparser.StreamItem) (map[string]*media.Index, error) {
+	var (
+		wg      sync.WaitGroup
+		res     = make([]*media.Index, len(items))
+		errs    = make([]error, len(items))
+		indexes = map[string]*media.Index{}
+		err     error
+	)
+	for i, item := range items {
+		wg.Add(1)
+		go func(i int, item *youtubevideoparser.StreamItem) {
+			defer wg.Done()
+			res[i], errs[i] = getIndex(vid, item)
+		}(i, item)
+	}
+	wg.Wait()
+	for i, item := range items {
+		if errs[i] != nil {
+			if err == nil {
+				err = errs[i]
 			}
+			continue
+		}
+		indexes[item.Itag] = res[i]
+	}
+	return indexes, err
+}
+
+// pathID 取请求路径中的ID,若ID是混淆过的,输出的相对地址也应继续使用混淆后的ID
+func pathID(r *http.Request, ext string) string {
+	var patharr = strings.Split(strings.ReplaceAll(r.URL.Path, ext, ""), "/")
+	return patharr[len(patharr)-1]
+}
+
+// streamQuery findStreams的选择条件
+type streamQuery struct {
+	// 偏好的itag列表,逗号分隔,为空时使用mime对应的默认列表
+	prefers string
+	// audio 或 video
+	mime   string
+	ladder bool
+	live   bool
+	filter codecFilter
+}
+
+// findStreams 按偏好列表找出所有可用并且客户端可解码的流,未指定时使用默认列表;ladder模式或偏好列表均不可用时输出全部可用的流
+func findStreams(info *youtubevideoparser.VideoInfo, q streamQuery) []*youtubevideoparser.StreamItem {
+	var (
+		items   = []*youtubevideoparser.StreamItem{}
+		seen    = map[string]bool{}
+		check   = usable
+		prefers = q.prefers
+	)
+	if q.live {
+		check = liveUsable
+	}
+	var add = func(itag string) {
+		if v, ok := info.Streams[itag]; ok && !seen[itag] && check(v) && strings.Contains(v.Type, q.mime) && q.filter.allow(v) {
+			seen[itag] = true
+			items = append(items, v)
+		}
+	}
+	if prefers == "" || q.ladder {
+		prefers = vlist
+		if q.mime == "audio" {
+			prefers = alist
 		}
 	}
-	for _, v := range info.Streams {
-		if v.ContentLength != "" && v.InitRange.Start != "" && v.IndexRange.Start != "" && strings.Contains(v.Type, mime) {
-			return v
+	for _, itag := range strings.Split(prefers, ",") {
+		add(strings.TrimSpace(itag))
+	}
+	if len(items) > 0 && !q.ladder {
+		return items
+	}
+	// 其余的按itag排序,保证每次输出一致
+	var rest = []string{}
+	for itag := range info.Streams {
+		rest = append(rest, itag)
+	}
+	sort.Slice(rest, func(i, j int) bool {
+		a, _ := strconv.Atoi(rest[i])
+		b, _ := strconv.Atoi(rest[j])
+		return a < b
+	})
+	for _, itag := range rest {
+		add(itag)
+	}
+	return items
+}
+
+// groupStreams 按编码族分组,组的顺序保持偏好顺序,组内按码率从低到高排列
+func groupStreams(items []*youtubevideoparser.StreamItem) []*streamGroup {
+	var (
+		groups = []*streamGroup{}
+		index  = map[string]*streamGroup{}
+	)
+	for _, item := range items {
+		var (
+			mime, codecs = parseType(item.Type)
+			key          = mime + ";" + codecFamily(codecs)
+		)
+		g, ok := index[key]
+		if !ok {
+			g = &streamGroup{mime: mime}
+			index[key] = g
+			groups = append(groups, g)
 		}
+		g.items = append(g.items, item)
+	}
+	for _, g := range groups {
+		var items = g.items
+		sort.SliceStable(items, func(i, j int) bool {
+			return contentLength(items[i]) < contentLength(items[j])
+		})
+	}
+	return groups
+}
+
+func usable(v *youtubevideoparser.StreamItem) bool {
+	return v.ContentLength != "" && v.InitRange.Start != "" && v.IndexRange.Start != ""
+}
+
+func contentLength(v *youtubevideoparser.StreamItem) int {
+	n, _ := strconv.Atoi(v.ContentLength)
+	return n
+}
+
+// parseType 解析 video/webm; codecs="vp9" 为 video/webm 与 vp9
+func parseType(t string) (string, string) {
+	var (
+		typeinfo = strings.SplitN(t, ";", 2)
+		mime     = strings.TrimSpace(typeinfo[0])
+	)
+	if len(typeinfo) < 2 {
+		return mime, ""
+	}
+	var codecs = strings.TrimPrefix(strings.TrimSpace(typeinfo[1]), "codecs=")
+	return mime, strings.Trim(codecs, "\"")
+}
+
+// codecFamily avc1.4d401f => avc1 , vp09.00.40.08 => vp9
+func codecFamily(codecs string) string {
+	var family = strings.Split(strings.Split(codecs, ",")[0], ".")[0]
+	if family == "vp09" {
+		return "vp9"
 	}
-	return nil
+	return family
 }
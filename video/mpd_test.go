@@ -0,0 +1,70 @@
+package video
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/suconghou/videoproxy/media"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+func TestScaleTrack(t *testing.T) {
+	tests := []struct {
+		name  string
+		ref   media.Track
+		hfr   bool
+		label int
+		want  media.Track
+	}{
+		{"16:9", media.Track{Width: 256, Height: 144, FrameRate: 25}, false, 1080, media.Track{Width: 1920, Height: 1080, FrameRate: 25}},
+		{"4:3", media.Track{Width: 192, Height: 144}, false, 720, media.Track{Width: 960, Height: 720}},
+		{"21:9", media.Track{Width: 1920, Height: 804}, false, 720, media.Track{Width: 1280, Height: 536}},
+		{"portrait", media.Track{Width: 144, Height: 256}, false, 720, media.Track{Width: 720, Height: 1280}},
+		{"hfr ref", media.Track{Width: 1280, Height: 720, FrameRate: 60}, true, 360, media.Track{Width: 640, Height: 360}},
+		{"no ref", media.Track{}, false, 720, media.Track{}},
+		{"unknown itag", media.Track{Width: 256, Height: 144}, false, 0, media.Track{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scaleTrack(tt.ref, tt.hfr, tt.label); got != tt.want {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamTracks(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		itags []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		itags = append(itags, r.URL.Query().Get("itag"))
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	item := func(itag string, typ string, size string) *youtubevideoparser.StreamItem {
+		s := &youtubevideoparser.StreamItem{Itag: itag, Type: typ, ContentLength: size, URL: srv.URL + "/?itag=" + itag}
+		s.InitRange.Start, s.InitRange.End = "0", "99"
+		s.IndexRange.Start, s.IndexRange.End = "100", "199"
+		return s
+	}
+	var (
+		audio = []*youtubevideoparser.StreamItem{item("251", `audio/webm; codecs="opus"`, "1000"), item("140", `audio/mp4; codecs="mp4a.40.2"`, "1000")}
+		video = []*youtubevideoparser.StreamItem{item("136", `video/mp4; codecs="avc1.4d401f"`, "5000"), item("160", `video/mp4; codecs="avc1.4d400c"`, "500"), item("247", `video/webm; codecs="vp9"`, "4000")}
+	)
+	tracks := streamTracks("mpdtracks", audio, video)
+	// opus不需要读取,视频只读取码率最低的一路
+	sort.Strings(itags)
+	if len(itags) != 2 || itags[0] != "140" || itags[1] != "160" {
+		t.Fatal(itags)
+	}
+	if tracks["251"].SampleRate != 48000 || len(tracks) != 1 {
+		t.Fatal(tracks)
+	}
+}
@@ -0,0 +1,77 @@
+package video
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/suconghou/videoproxy/media"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+// muxStream 将独立的音频流与视频流在服务端交织为一个文件输出,ext为mp4或webm,start为起始秒数
+func muxStream(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.VideoInfo, ext string, filter codecFilter) error {
+	var (
+		query = r.URL.Query()
+		video = pickStream(info, query.Get("v"), "video", ext, filter)
+		audio = pickStream(info, query.Get("a"), "audio", ext, filter)
+	)
+	if video == nil || audio == nil {
+		if filter != nil {
+			putCodecError(w, filter.incompatible(info))
+			return nil
+		}
+		http.NotFound(w, r)
+		return nil
+	}
+	indexes, err := loadIndexes(info.ID, []*youtubevideoparser.StreamItem{video, audio})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	start, _ := strconv.ParseFloat(query.Get("start"), 64)
+	file, err := media.Mux(indexes[video.Itag], indexes[audio.Itag], video.URL, audio.URL, start)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	return file.Serve(w, r, videoClient, func(h http.Header) {
+		if query.Get("download") == "1" {
+			name := url.PathEscape(fmt.Sprintf("%s.%s", info.Title, ext))
+			h.Set("Content-Disposition", fmt.Sprintf("attachment;filename* = UTF-8''%s", name))
+		}
+	}, []func() (string, error){refresher(info.ID, video.Itag, ""), refresher(info.ID, audio.Itag, "")})
+}
+
+// pickContainer 按偏好顺序取第一个指定容器格式的流
+// pickStream 优先使用参数指定的itag,都不可用或容器不符时按默认列表选择
+func pickStream(info *youtubevideoparser.VideoInfo, prefers string, mime string, ext string, filter codecFilter) *youtubevideoparser.StreamItem {
+	if prefers != "" {
+		var want = map[string]bool{}
+		for _, itag := range strings.Split(prefers, ",") {
+			want[strings.TrimSpace(itag)] = true
+		}
+		// 偏好均不可用时findStreams返回全部可用的流,只取偏好列表中的
+		var items = []*youtubevideoparser.StreamItem{}
+		for _, s := range findStreams(info, streamQuery{prefers: prefers, mime: mime, filter: filter}) {
+			if want[s.Itag] {
+				items = append(items, s)
+			}
+		}
+		if s := pickContainer(items, ext); s != nil {
+			return s
+		}
+	}
+	return pickContainer(findStreams(info, streamQuery{mime: mime, ladder: true, filter: filter}), ext)
+}
+
+func pickContainer(items []*youtubevideoparser.StreamItem, ext string) *youtubevideoparser.StreamItem {
+	for _, s := range items {
+		if mime, _ := parseType(s.Type); strings.HasSuffix(mime, "/"+ext) {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package video
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/suconghou/youtubevideoparser"
+)
+
+func TestMuxStreamPrefer(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		itags []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		itags = append(itags, r.URL.Query().Get("itag"))
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+	item := func(itag string, typ string) *youtubevideoparser.StreamItem {
+		s := &youtubevideoparser.StreamItem{Itag: itag, Type: typ, ContentLength: "1000", URL: srv.URL + "/?itag=" + itag}
+		s.InitRange.Start, s.InitRange.End = "0", "99"
+		s.IndexRange.Start, s.IndexRange.End = "100", "199"
+		return s
+	}
+	tests := []struct {
+		name, query, ext, want string
+	}{
+		{"prefer", "v=137", "mp4", "137,140"},
+		{"prefer audio", "v=137&a=139", "mp4", "137,139"},
+		{"unavailable", "v=999", "mp4", "136,140"},
+		{"container mismatch", "v=137", "webm", "247,251"},
+		{"default", "", "mp4", "136,140"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			itags = nil
+			info := &youtubevideoparser.VideoInfo{ID: "muxprefer" + string(rune('a'+i)), Streams: map[string]*youtubevideoparser.StreamItem{
+				"137": item("137", `video/mp4; codecs="avc1.640028"`),
+				"136": item("136", `video/mp4; codecs="avc1.4d401f"`),
+				"247": item("247", `video/webm; codecs="vp9"`),
+				"140": item("140", `audio/mp4; codecs="mp4a.40.2"`),
+				"139": item("139", `audio/mp4; codecs="mp4a.40.5"`),
+				"251": item("251", `audio/webm; codecs="opus"`),
+			}}
+			muxStream(httptest.NewRecorder(), httptest.NewRequest("GET", "/video/x.mp4?mux=1&"+tt.query, nil), info, tt.ext, nil)
+			want := strings.Split(tt.want, ",")
+			sort.Strings(itags)
+			sort.Strings(want)
+			if strings.Join(itags, ",") != strings.Join(want, ",") {
+				t.Fatalf("got %v, want %v", itags, want)
+			}
+		})
+	}
+}
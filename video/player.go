@@ -0,0 +1,149 @@
+package video
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/suconghou/videoproxy/request"
+)
+
+// playerResponse watch页面中ytInitialPlayerResponse里解析器没有提供的部分
+type playerResponse struct {
+	VideoDetails struct {
+		Title            string `json:"title"`
+		Author           string `json:"author"`
+		ShortDescription string `json:"shortDescription"`
+		LengthSeconds    string `json:"lengthSeconds"`
+	} `json:"videoDetails"`
+	Microformat struct {
+		PlayerMicroformatRenderer struct {
+			PublishDate string `json:"publishDate"`
+			UploadDate  string `json:"uploadDate"`
+		} `json:"playerMicroformatRenderer"`
+	} `json:"microformat"`
+	Storyboards struct {
+		PlayerStoryboardSpecRenderer struct {
+			Spec string `json:"spec"`
+		} `json:"playerStoryboardSpecRenderer"`
+	} `json:"storyboards"`
+}
+
+type playerItem struct {
+	t   int64
+	p   *playerResponse
+	err error
+}
+
+const (
+	playerTTL int64 = 3600
+	// 失败也缓存一小段时间,避免每次请求都去抓取页面
+	playerErrorTTL  int64 = 60
+	defaultPlayerUA       = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+)
+
+var (
+	playerURL = "https://www.youtube.com/watch"
+	// 请求watch页面使用的User-Agent,PLAYER_UA未配置时使用默认值
+	playerUA = envOr("PLAYER_UA", defaultPlayerUA)
+	// 页面中player response的赋值有多种写法
+	playerMarks = []string{"ytInitialPlayerResponse = ", "ytInitialPlayerResponse="}
+)
+
+// playerCall 正在进行的请求,同一ID的并发请求合并为一次
+type playerCall struct {
+	wg  sync.WaitGroup
+	p   *playerResponse
+	err error
+}
+
+var (
+	// id : playerItem
+	players     = sync.Map{}
+	playerMu    sync.Mutex
+	playerCalls = map[string]*playerCall{}
+)
+
+func init() {
+	go func() {
+		for {
+			var now = time.Now().Unix()
+			players.Range(func(k interface{}, v interface{}) bool {
+				if v.(*playerItem).t < now {
+					players.Delete(k)
+				}
+				return true
+			})
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// getPlayer 请求watch页面取得player response,成功缓存一小时,失败缓存一分钟
+func getPlayer(id string) (*playerResponse, error) {
+	if v, ok := players.Load(id); ok && v.(*playerItem).t > time.Now().Unix() {
+		return v.(*playerItem).p, v.(*playerItem).err
+	}
+	playerMu.Lock()
+	if call, ok := playerCalls[id]; ok {
+		playerMu.Unlock()
+		call.wg.Wait()
+		return call.p, call.err
+	}
+	var call = &playerCall{}
+	call.wg.Add(1)
+	playerCalls[id] = call
+	playerMu.Unlock()
+
+	call.p, call.err = loadPlayer(id)
+	var ttl = playerTTL
+	if call.err != nil {
+		ttl = playerErrorTTL
+	}
+	players.Store(id, &playerItem{time.Now().Unix() + ttl, call.p, call.err})
+
+	playerMu.Lock()
+	delete(playerCalls, id)
+	playerMu.Unlock()
+	call.wg.Done()
+	return call.p, call.err
+}
+
+func loadPlayer(id string) (*playerResponse, error) {
+	var h = http.Header{}
+	h.Set("User-Agent", playerUA)
+	h.Set("Accept-Language", "en-US,en;q=0.9")
+	data, _, _, err := request.Get(playerURL+"?v="+id+"&hl=en", videoClient, h)
+	if err != nil {
+		return nil, err
+	}
+	defer request.PutBuffer(data)
+	return parsePlayer(id, data.String())
+}
+
+// parsePlayer 从页面中找到player response,Decode只读取第一个json值,忽略之后的脚本
+func parsePlayer(id string, page string) (*playerResponse, error) {
+	for _, mark := range playerMarks {
+		var i = strings.Index(page, mark)
+		if i < 0 {
+			continue
+		}
+		var p = &playerResponse{}
+		if err := json.NewDecoder(strings.NewReader(page[i+len(mark):])).Decode(p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("%s player response not found", id)
+}
+
+func envOr(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,93 @@
+package video
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParsePlayer(t *testing.T) {
+	for _, page := range []string{
+		`<script>var ytInitialPlayerResponse = {"videoDetails":{"title":"a"}};var meta = {};</script>`,
+		`<script>window.ytInitialPlayerResponse={"videoDetails":{"title":"a"}};</script>`,
+	} {
+		if p, err := parsePlayer("x", page); err != nil || p.VideoDetails.Title != "a" {
+			t.Fatal(page, err)
+		}
+	}
+	if _, err := parsePlayer("x", "<html></html>"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestGetPlayerCache(t *testing.T) {
+	var (
+		calls int32
+		ua    string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		ua = r.Header.Get("User-Agent")
+		if r.URL.Query().Get("v") == "bad" {
+			w.Write([]byte("<html></html>"))
+			return
+		}
+		w.Write([]byte(`ytInitialPlayerResponse = {"videoDetails":{"title":"ok"}};`))
+	}))
+	defer srv.Close()
+	defer func(u string) { playerURL = u }(playerURL)
+	playerURL = srv.URL
+	defer players.Delete("good")
+	defer players.Delete("bad")
+	for i := 0; i < 2; i++ {
+		if p, err := getPlayer("good"); err != nil || p.VideoDetails.Title != "ok" {
+			t.Fatal(err)
+		}
+		// 失败的结果同样缓存
+		if _, err := getPlayer("bad"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if calls != 2 || ua != playerUA {
+		t.Fatal(calls, ua)
+	}
+	v, _ := players.Load("bad")
+	if ttl := v.(*playerItem).t - time.Now().Unix(); ttl > playerErrorTTL {
+		t.Fatal(ttl)
+	}
+}
+
+func TestGetPlayerCoalesce(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`ytInitialPlayerResponse = {"videoDetails":{"title":"ok"}};`))
+	}))
+	defer srv.Close()
+	defer func(u string) { playerURL = u }(playerURL)
+	playerURL = srv.URL
+	defer players.Delete("coalesce")
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if p, err := getPlayer("coalesce"); err != nil || p.VideoDetails.Title != "ok" {
+				t.Error(err)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatal(calls)
+	}
+}
@@ -0,0 +1,37 @@
+package video
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPurgeCache(t *testing.T) {
+	defer func(v string) { purgeToken = v }(purgeToken)
+	var cases = []struct {
+		token  string
+		auth   string
+		query  string
+		ext    string
+		status int
+	}{
+		{"", "", "", "json", http.StatusForbidden},
+		{"", "Bearer ", "", "json", http.StatusForbidden},
+		{"secret", "Bearer wrong", "", "json", http.StatusForbidden},
+		{"secret", "", "token=wrong", "json", http.StatusForbidden},
+		{"secret", "Bearer secret", "", "m3u8", http.StatusBadRequest},
+		{"secret", "", "token=secret", "m3u8", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		purgeToken = c.token
+		req := httptest.NewRequest(http.MethodDelete, "/video/abcdefghijk."+c.ext+"?"+c.query, nil)
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		rec := httptest.NewRecorder()
+		purgeCache(rec, req, "abcdefghijk", c.ext)
+		if rec.Code != c.status {
+			t.Error(c, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package video
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/suconghou/videoproxy/diskcache"
+	"github.com/suconghou/videoproxy/request"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+// proxyCached 从磁盘分片缓存输出,ts不为空时输出指定的片段
+func proxyCached(w http.ResponseWriter, r *http.Request, id string, s *youtubevideoparser.StreamItem, ts string) error {
+	var (
+		key     = diskcache.Key{ID: id, Itag: s.Itag, Size: int64(contentLength(s))}
+		mime, _ = parseType(s.Type)
+		fetch   = sliceFetcher(r.Context(), id, s)
+	)
+	if ts == "" {
+		return diskcache.Default.Serve(w, r, key, mime, fetch)
+	}
+	var arr = strings.SplitN(ts, "-", 2)
+	start, err := strconv.ParseInt(arr[0], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	end, err := strconv.ParseInt(arr[1], 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	return diskcache.Default.ServeRange(w, r, key, mime, start, end, http.StatusOK, fetch)
+}
+
+// sliceFetcher 上游地址过期时刷新一次,之后的分片使用新地址,ctx取消时中断请求
+func sliceFetcher(ctx context.Context, id string, s *youtubevideoparser.StreamItem) diskcache.Fetcher {
+	var chunks = &request.ChunkFetcher{URL: s.URL, Client: videoClient, Refresh: refresher(id, s.Itag, "")}
+	return func(start int64, end int64) ([]byte, error) {
+		buf, _, _, err := chunks.Fetch(ctx, start, end, http.Header{})
+		if err != nil {
+			return nil, err
+		}
+		defer request.PutBuffer(buf)
+		return append([]byte{}, buf.Bytes()...), nil
+	}
+}
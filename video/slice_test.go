@@ -0,0 +1,44 @@
+package video
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/suconghou/youtubevideoparser"
+)
+
+func TestSliceFetcher(t *testing.T) {
+	var data = []byte("0123456789abcdefghij")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a, b int
+		fmt.Sscanf(r.URL.Query().Get("range"), "%d-%d", &a, &b)
+		if b >= len(data) {
+			// 上游返回的长度与请求的区间不一致
+			w.Write(data[a:])
+			return
+		}
+		w.Write(data[a : b+1])
+	}))
+	defer srv.Close()
+	fetch := sliceFetcher(context.Background(), "slicefetch", &youtubevideoparser.StreamItem{Itag: "140", URL: srv.URL + "/?itag=140"})
+	a, err := fetch(0, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 返回的数据是副本,不受之后的请求复用buffer影响
+	if _, err = fetch(10, 19); err != nil || !bytes.Equal(a, data[:10]) {
+		t.Fatal(string(a), err)
+	}
+	if _, err = fetch(15, 29); err == nil {
+		t.Fatal("expected length error")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = sliceFetcher(ctx, "slicefetch", &youtubevideoparser.StreamItem{Itag: "140", URL: srv.URL + "/?itag=140"})(0, 9); err == nil {
+		t.Fatal("expected context error")
+	}
+}
@@ -0,0 +1,34 @@
+package video
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/suconghou/videoproxy/request"
+	"github.com/suconghou/videoproxy/util"
+)
+
+// 各项计数,使用atomic读写
+type stats struct {
+	Refresh     int64 `json:"refresh"`
+	InfoHit     int64 `json:"infoHit"`
+	InfoMiss    int64 `json:"infoMiss"`
+	InfoEntries int   `json:"infoEntries"`
+	// data api与字幕的http缓存
+	HTTPCache request.CacheStats `json:"httpCache"`
+}
+
+var counter = &stats{}
+
+// Stats output counters
+func Stats(w http.ResponseWriter, r *http.Request, match []string) error {
+	var s = stats{
+		Refresh:     atomic.LoadInt64(&counter.Refresh),
+		InfoHit:     atomic.LoadInt64(&counter.InfoHit),
+		InfoMiss:    atomic.LoadInt64(&counter.InfoMiss),
+		InfoEntries: infos.len(),
+		HTTPCache:   request.HttpProvider.Stats(),
+	}
+	_, err := util.JSONPut(w, s, http.StatusOK, 0)
+	return err
+}
@@ -0,0 +1,144 @@
+package video
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/suconghou/videoproxy/request"
+)
+
+// storyboardLevel spec中的一级预览图 width#height#count#cols#rows#interval#name#sigh
+type storyboardLevel struct {
+	url      string
+	width    int
+	height   int
+	count    int
+	cols     int
+	rows     int
+	interval int64 // 毫秒
+	name     string
+	sigh     string
+}
+
+// parseStoryboard 第一段为地址模板,$L为级别,$N为图片名,之后每段为一级,duration为视频秒数
+func parseStoryboard(spec string, duration float64) []storyboardLevel {
+	var (
+		parts  = strings.Split(spec, "|")
+		levels = []storyboardLevel{}
+	)
+	for i, p := range parts[1:] {
+		var f = strings.Split(p, "#")
+		if len(f) < 8 {
+			continue
+		}
+		var (
+			l   = storyboardLevel{url: strings.Replace(parts[0], "$L", strconv.Itoa(i), -1), name: f[6], sigh: f[7]}
+			err error
+		)
+		for k, v := range []*int{&l.width, &l.height, &l.count, &l.cols, &l.rows} {
+			if *v, err = strconv.Atoi(f[k]); err != nil {
+				break
+			}
+		}
+		if err != nil || l.width <= 0 || l.height <= 0 || l.count <= 0 || l.cols <= 0 || l.rows <= 0 {
+			continue
+		}
+		l.interval, _ = strconv.ParseInt(f[5], 10, 64)
+		if l.interval <= 0 {
+			l.interval = int64(duration * 1000 / float64(l.count))
+		}
+		if l.interval <= 0 {
+			continue
+		}
+		levels = append(levels, l)
+	}
+	return levels
+}
+
+// sheet 第n张缩略图所在的图片名
+func (l storyboardLevel) sheet(n int) string {
+	return strings.Replace(l.name, "$M", strconv.Itoa(n/(l.cols*l.rows)), -1)
+}
+
+// sheetURL 上游图片地址,name为sheet返回的图片名
+func (l storyboardLevel) sheetURL(name string) string {
+	var url = strings.Replace(l.url, "$N", name, -1)
+	if l.sigh == "" {
+		return url
+	}
+	if strings.Contains(url, "?") {
+		return url + "&sigh=" + l.sigh
+	}
+	return url + "?sigh=" + l.sigh
+}
+
+// storyboardLevels 返回各级预览图与视频秒数,没有预览图时levels为空
+func storyboardLevels(id string) ([]storyboardLevel, float64, error) {
+	p, err := getPlayer(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	duration, _ := strconv.ParseFloat(p.VideoDetails.LengthSeconds, 64)
+	return parseStoryboard(p.Storyboards.PlayerStoryboardSpecRenderer.Spec, duration), duration, nil
+}
+
+// Storyboard 输出预览缩略图的WebVTT,每条cue指向 sb/{L}/{N}.jpg#xywh=x,y,w,h ,query参数level选择级别,默认最清晰的一级
+func Storyboard(w http.ResponseWriter, r *http.Request, match []string) error {
+	levels, duration, err := storyboardLevels(match[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	if len(levels) == 0 {
+		http.NotFound(w, r)
+		return nil
+	}
+	var level = len(levels) - 1
+	if v := r.URL.Query().Get("level"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < len(levels) {
+			level = n
+		}
+	}
+	var (
+		l        = levels[level]
+		total    = int64(duration * 1000)
+		b        = strings.Builder{}
+		perSheet = l.cols * l.rows
+	)
+	b.WriteString("WEBVTT\n\n")
+	for i := 0; i < l.count; i++ {
+		var start, end = int64(i) * l.interval, int64(i+1) * l.interval
+		if total > 0 && start >= total {
+			break
+		}
+		if total > 0 && end > total {
+			end = total
+		}
+		var pos = i % perSheet
+		fmt.Fprintf(&b, "%s --> %s\nsb/%d/%s.jpg#xywh=%d,%d,%d,%d\n\n", formatTime(start, "."), formatTime(end, "."), level, l.sheet(i), pos%l.cols*l.width, pos/l.cols*l.height, l.width, l.height)
+	}
+	h := w.Header()
+	h.Set("Content-Type", captionMime["vtt"])
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Max-Age", "864000")
+	h.Set("Cache-Control", "public,max-age=864000")
+	_, err = w.Write([]byte(b.String()))
+	return err
+}
+
+// StoryboardSprite proxy预览缩略图的拼图
+func StoryboardSprite(w http.ResponseWriter, r *http.Request, match []string) error {
+	levels, _, err := storyboardLevels(match[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	level, _ := strconv.Atoi(match[2])
+	if level >= len(levels) {
+		http.NotFound(w, r)
+		return nil
+	}
+	return request.Pipe(w, r, levels[level].sheetURL(match[3]), imageClient, nil, nil)
+}
@@ -0,0 +1,216 @@
+package video
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/suconghou/videoproxy/db"
+	"github.com/suconghou/videoproxy/request"
+	"github.com/suconghou/videoproxy/util"
+	"github.com/suconghou/youtubevideoparser"
+)
+
+var (
+	brReg  = regexp.MustCompile(`(?i)<br\s*/?>`)
+	tagReg = regexp.MustCompile(`<[^>]*>`)
+)
+
+// timedText 兼容两种字幕格式, <transcript><text start="1.2" dur="3.4"> 与 srv3 <timedtext><body><p t="1200" d="3400">
+type timedText struct {
+	Texts []struct {
+		Start string `xml:"start,attr"`
+		Dur   string `xml:"dur,attr"`
+		Text  string `xml:",innerxml"`
+	} `xml:"text"`
+	Body struct {
+		P []struct {
+			T    string `xml:"t,attr"`
+			D    string `xml:"d,attr"`
+			Text string `xml:",innerxml"`
+		} `xml:"p"`
+	} `xml:"body"`
+}
+
+// cue 时间单位为毫秒
+type cue struct {
+	start int64
+	end   int64
+	text  string
+}
+
+// outPutSubtitle 将timedtext字幕转换为vtt或srt格式输出
+func outPutSubtitle(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.VideoInfo, ext string) error {
+	var useLang, url = findCaption(info, r.URL.Query().Get("lang"))
+	if url == "" || useLang == "" {
+		http.Error(w, "lang not found", http.StatusNotFound)
+		return nil
+	}
+	data, _, status, err := request.GetByCacher(r.Context(), url, videoClient, http.Header{}, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	if status == http.StatusOK {
+		if err = db.SaveCaption(info.ID, useLang, data); err != nil {
+			util.Log.Print(err)
+		}
+	}
+	return convertCaption(w, info.ID, useLang, ext, data)
+}
+
+// useTimedTextCache 数据库中没有转换后的字幕时,尝试使用已缓存的原始字幕转换
+func useTimedTextCache(vid string, lang string, ext string, w http.ResponseWriter) bool {
+	data, exist, err := db.FindCaption(vid, lang)
+	if err != nil {
+		util.Log.Print(err)
+	}
+	if !exist {
+		return false
+	}
+	if err = convertCaption(w, vid, lang, ext, []byte(data)); err != nil {
+		util.Log.Print(err)
+	}
+	return true
+}
+
+// convertCaption 转换字幕,缓存并响应http
+func convertCaption(w http.ResponseWriter, vid string, lang string, ext string, data []byte) error {
+	res, err := formatSubtitle(data, ext)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	h := w.Header()
+	h.Set("Content-Type", captionMime[ext])
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Max-Age", "864000")
+	h.Set("Cache-Control", "public,max-age=864000")
+	_, err = w.Write(res)
+	if er := db.SaveCaption(vid, captionKey(lang, ext), res); er != nil {
+		util.Log.Print(er)
+	}
+	return err
+}
+
+var captionMime = map[string]string{
+	"vtt": "text/vtt; charset=utf-8",
+	"srt": "application/x-subrip; charset=utf-8",
+}
+
+// captionKey 转换后的字幕与原始字幕存储在同一张表,使用带格式的lang区分
+func captionKey(lang string, ext string) string {
+	return lang + "." + ext
+}
+
+// formatSubtitle 解析timedtext xml(可能是gzip压缩过的),输出vtt或srt
+func formatSubtitle(data []byte, ext string) ([]byte, error) {
+	if strings.Contains(http.DetectContentType(data), "gzip") {
+		var err error
+		if data, err = util.GzipDecode(data); err != nil {
+			return nil, err
+		}
+	}
+	cues, err := parseTimedText(data)
+	if err != nil {
+		return nil, err
+	}
+	var b = strings.Builder{}
+	if ext == "vtt" {
+		b.WriteString("WEBVTT\n\n")
+	}
+	for i, c := range cues {
+		if ext == "vtt" {
+			var text = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(c.text)
+			b.WriteString(fmt.Sprintf("%s --> %s\n%s\n\n", formatTime(c.start, "."), formatTime(c.end, "."), text))
+		} else {
+			b.WriteString(fmt.Sprintf("%d\n%s --> %s\n%s\n\n", i+1, formatTime(c.start, ","), formatTime(c.end, ","), c.text))
+		}
+	}
+	return []byte(b.String()), nil
+}
+
+func parseTimedText(data []byte) ([]cue, error) {
+	var (
+		t    timedText
+		cues = []cue{}
+	)
+	if err := xml.Unmarshal(data, &t); err != nil {
+		return nil, err
+	}
+	for _, item := range t.Texts {
+		start, err1 := strconv.ParseFloat(item.Start, 64)
+		dur, err2 := strconv.ParseFloat(item.Dur, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		cues = append(cues, cue{int64(start * 1000), int64((start + dur) * 1000), cleanText(item.Text)})
+	}
+	for _, item := range t.Body.P {
+		start, err1 := strconv.ParseInt(item.T, 10, 64)
+		dur, err2 := strconv.ParseInt(item.D, 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		cues = append(cues, cue{start, start + dur, cleanText(item.Text)})
+	}
+	return fixOverlap(cues), nil
+}
+
+// fixOverlap 按开始时间排序,同时开始的合并,与下一条重叠的截断到下一条开始
+func fixOverlap(cues []cue) []cue {
+	sort.SliceStable(cues, func(i, j int) bool {
+		return cues[i].start < cues[j].start
+	})
+	var res = []cue{}
+	for _, c := range cues {
+		if c.text == "" {
+			continue
+		}
+		if n := len(res); n > 0 {
+			var last = &res[n-1]
+			if last.start == c.start {
+				last.text += "\n" + c.text
+				if c.end > last.end {
+					last.end = c.end
+				}
+				continue
+			}
+			if last.end > c.start {
+				last.end = c.start
+			}
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+// cleanText 去除标签,<br>转为换行,字幕中的实体常被转义两次,需反复解码
+func cleanText(s string) string {
+	s = brReg.ReplaceAllString(s, "\n")
+	s = tagReg.ReplaceAllString(s, "")
+	for i := 0; i < 3; i++ {
+		var t = html.UnescapeString(s)
+		if t == s {
+			break
+		}
+		s = tagReg.ReplaceAllString(brReg.ReplaceAllString(t, "\n"), "")
+	}
+	var lines = []string{}
+	for _, line := range strings.Split(strings.ReplaceAll(s, "\r", ""), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// formatTime 毫秒转为 00:00:01.000 形式,srt使用逗号分隔毫秒
+func formatTime(ms int64, sep string) string {
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, sep, ms%1000)
+}
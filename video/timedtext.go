@@ -11,18 +11,7 @@ import (
 
 // info 解析存在缓存,此处ProxyCall也缓存
 func outPutTimedText(w http.ResponseWriter, r *http.Request, info *youtubevideoparser.VideoInfo) error {
-	var (
-		useLang = ""
-		lang    = r.URL.Query().Get("lang")
-		url     = ""
-	)
-	for _, item := range info.Captions {
-		useLang = item.Language
-		url = item.URL
-		if lang == "" || useLang == lang {
-			break
-		}
-	}
+	var useLang, url = findCaption(info, r.URL.Query().Get("lang"))
 	if url == "" || useLang == "" {
 		http.Error(w, "lang not found", http.StatusNotFound)
 		return nil
@@ -34,5 +23,21 @@ func outPutTimedText(w http.ResponseWriter, r *http.Request, info *youtubevideop
 			}
 		}
 	}
-	return request.ProxyCall(w, url, videoClient, r.Header, hook)
+	return request.ProxyCall(w, r, url, videoClient, 0, hook)
+}
+
+// findCaption 查找指定语言的字幕,lang为空时使用第一个
+func findCaption(info *youtubevideoparser.VideoInfo, lang string) (string, string) {
+	var (
+		useLang = ""
+		url     = ""
+	)
+	for _, item := range info.Captions {
+		useLang = item.Language
+		url = item.URL
+		if lang == "" || useLang == lang {
+			break
+		}
+	}
+	return useLang, url
 }
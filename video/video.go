@@ -1,6 +1,7 @@
 package video
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -8,10 +9,12 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/suconghou/videoproxy/cache"
 	"github.com/suconghou/videoproxy/db"
+	"github.com/suconghou/videoproxy/diskcache"
 	"github.com/suconghou/videoproxy/request"
 	"github.com/suconghou/videoproxy/util"
 
@@ -28,6 +31,8 @@ var (
 	}
 	r1 int
 	r2 int
+	// 清除缓存需要的token,未配置时不允许清除
+	purgeToken = os.Getenv("PURGE_TOKEN")
 )
 
 type resp struct {
@@ -47,7 +52,29 @@ func init() {
 }
 
 func getinfo(id string) (*youtubevideoparser.VideoInfo, error) {
-	return youtubevideoparser.Parse(id, videoClient)
+	return infos.get(id, false)
+}
+
+// refreshinfo 重新解析,不使用缓存,结果会更新缓存
+func refreshinfo(id string) (*youtubevideoparser.VideoInfo, error) {
+	return infos.get(id, true)
+}
+
+// refresher 上游地址过期时重新解析,返回同一itag的新地址,suffix追加到地址后
+func refresher(id string, itag string, suffix string) func() (string, error) {
+	return func() (string, error) {
+		info, err := refreshinfo(id)
+		if err != nil {
+			return "", err
+		}
+		s := info.Streams[itag]
+		if s == nil || s.URL == "" {
+			return "", fmt.Errorf("%s %s not found after refresh", id, itag)
+		}
+		n := atomic.AddInt64(&counter.Refresh, 1)
+		util.Log.Printf("%s %s stream url expired, refreshed %d", id, itag, n)
+		return s.URL + suffix, nil
+	}
 }
 
 // Image proxy yputube image , default/mqdefault/hqdefault/sddefault/maxresdefault
@@ -57,7 +84,7 @@ func Image(w http.ResponseWriter, r *http.Request, match []string) error {
 		ext = match[2]
 		url = fmt.Sprintf("%s%s/%s.%s", youtubeImageHostMap[ext], id, "mqdefault", ext)
 	)
-	return request.Pipe(w, r, url, imageClient, nil)
+	return request.Pipe(w, r, url, imageClient, nil, nil)
 }
 
 // GetInfo for info
@@ -67,6 +94,9 @@ func GetInfo(w http.ResponseWriter, r *http.Request, match []string) error {
 		ext    = match[2]
 		detail = ext == "json" && r.URL.Query().Get("info") == "all"
 	)
+	if r.Method == http.MethodDelete {
+		return purgeCache(w, r, vid, ext)
+	}
 	if !detail {
 		if useCache(vid, ext, w, r) {
 			return nil
@@ -79,8 +109,12 @@ func GetInfo(w http.ResponseWriter, r *http.Request, match []string) error {
 	}
 	if ext == "mpd" {
 		return outPutMpd(w, r, info)
+	} else if ext == "m3u8" {
+		return outPutM3u8(w, r, info)
 	} else if ext == "xml" {
 		return outPutTimedText(w, r, info)
+	} else if ext == "vtt" || ext == "srt" {
+		return outPutSubtitle(w, r, info, ext)
 	} else if detail {
 		_, err = util.JSONPut(w, info, http.StatusOK, 864000)
 		return err
@@ -102,6 +136,8 @@ func useCache(vid string, ext string, w http.ResponseWriter, r *http.Request) bo
 			"mpd":  "application/dash+xml",
 			"xml":  "text/xml",
 			"json": "application/json",
+			"vtt":  captionMime["vtt"],
+			"srt":  captionMime["srt"],
 		}
 		data   string
 		exist  bool
@@ -109,7 +145,11 @@ func useCache(vid string, ext string, w http.ResponseWriter, r *http.Request) bo
 		gziped bool
 	)
 	if ext == "mpd" {
-		data, exist, err = db.GetCacheItem(vid, db.TABLE_CACHEMPD)
+		q, er := parseMpdQuery(r)
+		if er != nil {
+			return false
+		}
+		data, exist, err = db.GetCacheVariant(vid, q.variant(), db.TABLE_CACHEMPD)
 	} else if ext == "json" {
 		data, exist, err = db.GetCacheItem(vid, db.TABLE_CACHEJSON)
 	} else if ext == "xml" {
@@ -123,6 +163,15 @@ func useCache(vid string, ext string, w http.ResponseWriter, r *http.Request) bo
 				gziped = true
 			}
 		}
+	} else if ext == "vtt" || ext == "srt" {
+		var lang = r.URL.Query().Get("lang")
+		if lang == "" {
+			return false
+		}
+		data, exist, err = db.FindCaption(vid, captionKey(lang, ext))
+		if err == nil && !exist {
+			return useTimedTextCache(vid, lang, ext, w)
+		}
 	} else {
 		return false
 	}
@@ -146,6 +195,44 @@ func useCache(vid string, ext string, w http.ResponseWriter, r *http.Request) bo
 	return true
 }
 
+// purgeCache 删除此ID对应类型的全部缓存,mpd会删除所有变体,字幕会删除所有语言和格式
+func purgeCache(w http.ResponseWriter, r *http.Request, vid string, ext string) error {
+	if !purgeAllowed(r) {
+		_, err := util.JSONPut(w, resp{-1, "forbidden"}, http.StatusForbidden, 0)
+		return err
+	}
+	var err error
+	switch ext {
+	case "mpd":
+		err = db.DeleteCacheItem(vid, db.TABLE_CACHEMPD)
+	case "json":
+		err = db.DeleteCacheItem(vid, db.TABLE_CACHEJSON)
+	case "xml", "vtt", "srt":
+		err = db.DeleteCacheItem(vid, db.TABLE_CAPTIONS)
+	default:
+		_, err = util.JSONPut(w, resp{-1, "unsupported ext " + ext}, http.StatusBadRequest, 0)
+		return err
+	}
+	if err != nil {
+		util.JSONPut(w, resp{-1, err.Error()}, http.StatusInternalServerError, 0)
+		return err
+	}
+	_, err = util.JSONPut(w, resp{0, "ok"}, http.StatusOK, 0)
+	return err
+}
+
+// purgeAllowed token从请求头Authorization: Bearer {token}或query参数token获取
+func purgeAllowed(r *http.Request) bool {
+	if purgeToken == "" {
+		return false
+	}
+	var token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(purgeToken)) == 1
+}
+
 // deep clone此对象,然后修改(去除易失效的URL字段),然后转为json字符串
 func copyclean(info *youtubevideoparser.VideoInfo) ([]byte, error) {
 	bs, err := json.Marshal(info)
@@ -175,8 +262,20 @@ func ProxyAuto(w http.ResponseWriter, r *http.Request, match []string) error {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return err
 	}
-	var s = findItem(info, query.Get("prefer"))
+	filter, err := parseCodecFilter(query)
+	if err != nil {
+		util.JSONPut(w, resp{-1, err.Error()}, http.StatusBadRequest, 1)
+		return err
+	}
+	if query.Get("mux") == "1" {
+		return muxStream(w, r, info, match[2], filter)
+	}
+	var s = findItem(info, query.Get("prefer"), filter)
 	if s == nil {
+		if filter != nil {
+			putCodecError(w, filter.incompatible(info))
+			return nil
+		}
 		http.NotFound(w, r)
 		return nil
 	}
@@ -188,24 +287,32 @@ func ProxyAuto(w http.ResponseWriter, r *http.Request, match []string) error {
 			filename = fmt.Sprintf("%s.%s", info.Title, "webm")
 		}
 	}
+	if _, _, ok, _ := clipParams(query); ok {
+		return clipStream(w, r, info, s, filename)
+	}
+	if filename != "" {
+		if ok, err := downloadTagged(w, r, info, s, filename); ok {
+			return err
+		}
+	}
 	return request.Pipe(w, r, s.URL, videoClient, func(res, to http.Header) {
 		if filename != "" {
 			name := url.PathEscape(filename)
 			to.Set("Content-Disposition", fmt.Sprintf("attachment;filename* = UTF-8''%s", name))
 		}
-	})
+	}, refresher(info.ID, s.Itag, ""))
 }
 
-func findItem(info *youtubevideoparser.VideoInfo, prefers string) *youtubevideoparser.StreamItem {
+func findItem(info *youtubevideoparser.VideoInfo, prefers string, filter codecFilter) *youtubevideoparser.StreamItem {
 	for _, itag := range strings.Split(prefers+","+preferList, ",") {
 		if v, ok := info.Streams[itag]; ok {
-			if v.URL != "" {
+			if v.URL != "" && filter.allow(v) {
 				return v
 			}
 		}
 	}
 	for _, v := range info.Streams {
-		if v.URL != "" {
+		if v.URL != "" && filter.allow(v) {
 			return v
 		}
 	}
@@ -236,10 +343,16 @@ func proxy(w http.ResponseWriter, r *http.Request, id string, itag string, ts st
 		http.NotFound(w, r)
 		return nil
 	}
+	if _, _, ok, _ := clipParams(r.URL.Query()); ok && ts == "" {
+		return clipStream(w, r, info, s, "")
+	}
+	if diskcache.Default != nil && contentLength(s) > 0 {
+		return proxyCached(w, r, id, s, ts)
+	}
 	if ts == "" {
-		return request.Pipe(w, r, s.URL, videoClient, nil)
+		return request.Pipe(w, r, s.URL, videoClient, nil, refresher(id, itag, ""))
 	}
-	return request.ProxyData(w, r, s.URL+"&range="+ts, videoClient)
+	return request.ProxyData(w, r, s.URL+"&range="+ts, videoClient, refresher(id, itag, "&range="+ts))
 }
 
 // AuthCode decode vid if encoded